@@ -0,0 +1,137 @@
+package ghca
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Names of clone backends passed to NewCloneBackend.
+const (
+	// BackendExec runs git command to clone repositories. This is the default.
+	BackendExec = "exec"
+	// BackendGoGit clones repositories with go-git, a pure Go implementation of Git. It does not
+	// require git command, but shallow clone by date and Git LFS are not supported.
+	BackendGoGit = "go-git"
+	// BackendArchive downloads a tarball of each repository via GitHub API instead of cloning it.
+	// Please see NewArchiveBackend.
+	BackendArchive = "archive"
+)
+
+// ErrRefNotFound is an error returned from CloneBackend when the ref to clone does not exist in the
+// remote repository.
+var ErrRefNotFound = errors.New("ref was not found in remote repository")
+
+// ErrUnsupported is an error returned from CloneBackend when the requested operation or option is
+// not supported by the backend.
+var ErrUnsupported = errors.New("not supported by clone backend")
+
+// GitError is an error of Git operation on a repository. Underlying error can be checked with
+// errors.Is such as ErrRefNotFound.
+type GitError struct {
+	// Op is a description of the operation such as "clone" or "update".
+	Op string
+	// Target is a URL or a directory of the repository.
+	Target string
+	// Stderr is stderr output of git command. It is empty when git command was not run.
+	Stderr string
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *GitError) Error() string {
+	if e.Stderr == "" {
+		return fmt.Sprintf("Could not %s %s: %v", e.Op, e.Target, e.Err)
+	}
+	return fmt.Sprintf("Could not %s %s: %v\nstderr: %s", e.Op, e.Target, e.Err, e.Stderr)
+}
+
+func (e *GitError) Unwrap() error {
+	return e.Err
+}
+
+// CloneOptions is options to clone or update a repository passed to CloneBackend.
+type CloneOptions struct {
+	// Ref is a branch or tag to clone, or RefAllBranches. Empty means the default branch.
+	Ref string
+	// Mode is one of CloneCheckout, CloneBare and CloneMirror.
+	Mode string
+	// Deep indicates cloning full history.
+	Deep bool
+	// Depth is the number of commits to fetch on shallow clone. 0 means 1.
+	Depth int
+	// ShallowSince is a date to limit history on shallow clone. When it is set, Depth is ignored.
+	ShallowSince string
+	// Submodules indicates cloning submodules recursively.
+	Submodules bool
+	// Keep reports whether the file at the slash-separated path relative to the repository root
+	// remains after cloning. nil means all files remain. Backends which write files directly such as
+	// archive backend should not write files for which it returns false. Other backends can ignore it
+	// since Cloner removes the files after cloning.
+	Keep func(path string) bool
+	// Token is a GitHub API token to authenticate HTTPS access to github.com. Backends must not embed
+	// it in URLs, command line arguments or error messages. Empty means anonymous access.
+	Token string
+	// SSH is configuration of SSH connections. nil means the user's SSH configuration is used as it is.
+	SSH *SSHConfig
+	// Proxy is a URL of HTTP proxy to access remotes. Empty means the user's configuration such as
+	// $HTTPS_PROXY is used.
+	Proxy string
+	// CABundle is a path to PEM file of CA certificates to verify remotes over HTTPS. It contains the
+	// system's CA certificates as well. Empty means the system's ones are used.
+	CABundle string
+	// Progress receives progress output of the operation such as git's stderr. Backends should write
+	// to it whenever data arrives from the remote so that stalled operations can be detected. nil
+	// means progress is not reported.
+	Progress io.Writer
+}
+
+func (o *CloneOptions) depth() int {
+	if o.Depth == 0 {
+		return 1
+	}
+	return o.Depth
+}
+
+func (o *CloneOptions) bare() bool {
+	return o.Mode == CloneBare || o.Mode == CloneMirror
+}
+
+// specificRef returns true when a branch or tag is specified as ref.
+func (o *CloneOptions) specificRef() bool {
+	return o.Ref != "" && o.Ref != RefAllBranches
+}
+
+// CloneBackend is an interface to clone and update Git repositories. Cloner uses it for all Git
+// operations. Retries, size limit and fallback to default branch on missing ref are handled by
+// Cloner. Canceling the context must abort the operation.
+type CloneBackend interface {
+	// Clone clones the repository at 'url' into 'dir'. It returns an error wrapping ErrRefNotFound
+	// when the ref in options does not exist.
+	Clone(ctx context.Context, url, dir string, opts *CloneOptions) error
+	// Update fetches the repository at 'url' into the existing repository at 'dir' and updates its
+	// working tree. It returns an error wrapping ErrRefNotFound as well as Clone.
+	Update(ctx context.Context, url, dir string, opts *CloneOptions) error
+	// HeadSHA returns the commit SHA of HEAD of the repository at 'dir'.
+	HeadSHA(dir string) (string, error)
+	// SetRemoteURL changes the URL of 'origin' remote of the repository at 'dir'.
+	SetRemoteURL(dir, url string) error
+	// FetchLFS downloads Git LFS objects of the repository at 'dir'.
+	FetchLFS(ctx context.Context, url, dir string, opts *CloneOptions) error
+}
+
+// NewCloneBackend creates a clone backend from its name. Empty name means BackendExec. Archive backend
+// cannot be created with this function since it requires GitHub API client.
+func NewCloneBackend(name string) (CloneBackend, error) {
+	switch name {
+	case "", BackendExec:
+		return newExecBackend(), nil
+	case BackendGoGit:
+		return &goGitBackend{}, nil
+	case BackendArchive:
+		return nil, errors.New("Archive backend must be created with NewArchiveBackend")
+	default:
+		return nil, fmt.Errorf("Unknown clone backend '%s'. It must be one of '%s', '%s' or '%s'", name, BackendExec, BackendGoGit, BackendArchive)
+	}
+}
@@ -0,0 +1,287 @@
+package ghca
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/google/go-github/github"
+)
+
+// archiveBackend is a clone backend which downloads a tarball of each repository via GitHub API
+// instead of cloning it. Files are extracted while downloading and files rejected by
+// CloneOptions.Keep are never written. Downloaded directories have no history.
+type archiveBackend struct {
+	client *github.Client
+	mu     sync.Mutex
+	// shas is a map from directory to the commit SHA of the downloaded archive
+	shas map[string]string
+}
+
+// NewArchiveBackend creates a clone backend which downloads tarballs of repositories via GitHub API
+// with the client. Only checkout mode without history is available. Resolved commit SHA of each
+// tarball is returned from HeadSHA.
+func NewArchiveBackend(client *github.Client) CloneBackend {
+	return &archiveBackend{client: client, shas: map[string]string{}}
+}
+
+// slugFromURL returns owner and name of the repository from its URL on GitHub such as
+// 'https://github.com/owner/name.git' or 'git@github.com:owner/name.git'.
+func slugFromURL(url string) (string, string, error) {
+	s := strings.TrimSuffix(url, ".git")
+	if i := strings.LastIndexAny(s, ":/"); i >= 0 {
+		name := s[i+1:]
+		s = s[:i]
+		if j := strings.LastIndexAny(s, ":/"); j >= 0 && name != "" && j+1 < len(s) {
+			return s[j+1:], name, nil
+		}
+	}
+	return "", "", fmt.Errorf("Could not get repository name from URL '%s'", url)
+}
+
+// archivePath returns the path of the entry in the archive relative to the repository root. Archives
+// from GitHub contain all files in a top-level 'owner-name-sha' directory. It returns an error when
+// the entry is outside the repository.
+func archivePath(name string) (string, error) {
+	i := strings.IndexByte(name, '/')
+	if i < 0 {
+		return "", nil
+	}
+	p := name[i+1:]
+	if p == "" {
+		return "", nil
+	}
+	c := path.Clean(p)
+	if path.IsAbs(c) || c == ".." || strings.HasPrefix(c, "../") {
+		return "", fmt.Errorf("Invalid path '%s' in archive", name)
+	}
+	return c, nil
+}
+
+// linkInArchive checks the target of the symlink at the path in the archive stays in the repository.
+// Otherwise files could be written outside the directory through the symlink.
+func linkInArchive(p, link string) error {
+	if path.IsAbs(link) || filepath.IsAbs(link) || filepath.VolumeName(link) != "" {
+		return fmt.Errorf("Symlink '%s' to absolute path '%s' in archive", p, link)
+	}
+	c := path.Join(path.Dir(p), filepath.ToSlash(link))
+	if c == ".." || strings.HasPrefix(c, "../") {
+		return fmt.Errorf("Symlink '%s' to '%s' points outside of repository in archive", p, link)
+	}
+	return nil
+}
+
+// noSymlinkIn checks no component of the slash-separated path relative to 'dir' is a symlink so that
+// writing the entry never follows symlinks extracted before.
+func noSymlinkIn(dir, p string) error {
+	cur := dir
+	for _, c := range strings.Split(p, "/") {
+		cur = filepath.Join(cur, c)
+		st, err := os.Lstat(cur)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if st.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("Path '%s' in archive goes through symlink", p)
+		}
+	}
+	return nil
+}
+
+// extract extracts the gzipped tarball read from 'r' into 'dir' and returns the commit SHA recorded
+// in the archive. Files rejected by 'keep' are skipped.
+func (b *archiveBackend) extract(r io.Reader, dir string, keep func(string) bool) (string, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return "", err
+	}
+	defer gz.Close()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	sha := ""
+	tr := tar.NewReader(gz)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		if h.Typeflag == tar.TypeXGlobalHeader {
+			// git-archive records the commit ID in the comment of pax global header
+			sha = h.PAXRecords["comment"]
+			continue
+		}
+
+		p, err := archivePath(h.Name)
+		if err != nil {
+			return "", err
+		}
+		if p == "" {
+			continue
+		}
+
+		dst := filepath.Join(dir, filepath.FromSlash(p))
+		switch h.Typeflag {
+		case tar.TypeReg:
+			if keep != nil && !keep(p) {
+				continue
+			}
+			if err := noSymlinkIn(dir, p); err != nil {
+				return "", err
+			}
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return "", err
+			}
+			f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, h.FileInfo().Mode().Perm())
+			if err != nil {
+				return "", err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return "", err
+			}
+		case tar.TypeSymlink:
+			// Symlinks are removed on extracting files as well as other backends
+			if keep != nil {
+				continue
+			}
+			if err := linkInArchive(p, h.Linkname); err != nil {
+				return "", err
+			}
+			if err := noSymlinkIn(dir, p); err != nil {
+				return "", err
+			}
+			if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+				return "", err
+			}
+			if err := os.Symlink(h.Linkname, dst); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	if sha == "" {
+		return "", fmt.Errorf("Commit SHA was not found in archive")
+	}
+	return sha, nil
+}
+
+// download downloads the tarball of the repository and extracts it into 'dir'.
+func (b *archiveBackend) download(ctx context.Context, url, dir string, opts *CloneOptions) (string, error) {
+	owner, name, err := slugFromURL(url)
+	if err != nil {
+		return "", err
+	}
+
+	ref := ""
+	if opts.specificRef() {
+		ref = opts.Ref
+	}
+	link, res, err := b.client.Repositories.GetArchiveLink(ctx, owner, name, github.Tarball, &github.RepositoryContentGetOptions{Ref: ref})
+	if err != nil {
+		if ref != "" && res != nil && res.StatusCode == http.StatusNotFound {
+			return "", ErrRefNotFound
+		}
+		return "", err
+	}
+
+	req, err := b.client.NewRequest("GET", link.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := b.client.Do(ctx, req, pw)
+		pw.CloseWithError(err)
+	}()
+	var r io.Reader = pr
+	if opts.Progress != nil {
+		r = io.TeeReader(pr, opts.Progress)
+	}
+	sha, err := b.extract(r, dir, opts.Keep)
+	// Unblock the download when extraction failed
+	pr.CloseWithError(err)
+	return sha, err
+}
+
+func (b *archiveBackend) Clone(ctx context.Context, url, dir string, opts *CloneOptions) error {
+	if opts.Mode != CloneCheckout || opts.Submodules || opts.Ref == RefAllBranches {
+		return &GitError{Op: "download", Target: url, Err: fmt.Errorf("bare clone, mirror clone, submodules and all branches are %w", ErrUnsupported)}
+	}
+	sha, err := b.download(ctx, url, dir, opts)
+	if err != nil {
+		return &GitError{Op: "download", Target: url, Err: err}
+	}
+	b.mu.Lock()
+	b.shas[dir] = sha
+	b.mu.Unlock()
+	return nil
+}
+
+// Update downloads the archive again since downloaded directory has no history. The archive is
+// extracted into a temporary directory next to 'dir' and replaces it only when extraction succeeded
+// so that a failed download does not destroy the existing files.
+func (b *archiveBackend) Update(ctx context.Context, url, dir string, opts *CloneOptions) error {
+	tmp, err := ioutil.TempDir(filepath.Dir(dir), "."+filepath.Base(dir)+".update-")
+	if err != nil {
+		return &GitError{Op: "download", Target: url, Err: err}
+	}
+	defer os.RemoveAll(tmp)
+	if err := b.Clone(ctx, url, tmp, opts); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	sha := b.shas[tmp]
+	delete(b.shas, tmp)
+	b.mu.Unlock()
+
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dir); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	b.shas[dir] = sha
+	b.mu.Unlock()
+	return nil
+}
+
+func (b *archiveBackend) HeadSHA(dir string) (string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	sha, ok := b.shas[dir]
+	if !ok {
+		return "", &GitError{Op: "get HEAD of", Target: dir, Err: fmt.Errorf("archive was not downloaded")}
+	}
+	return sha, nil
+}
+
+// SetRemoteURL does nothing since downloaded directory has no remote.
+func (b *archiveBackend) SetRemoteURL(dir, url string) error {
+	return nil
+}
+
+func (b *archiveBackend) FetchLFS(ctx context.Context, url, dir string, opts *CloneOptions) error {
+	return &GitError{Op: "fetch Git LFS objects of", Target: url, Err: ErrUnsupported}
+}
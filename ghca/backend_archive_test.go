@@ -0,0 +1,416 @@
+package ghca
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+const testArchiveSHA = "0123456789abcdef0123456789abcdef01234567"
+
+func testTarball(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	hs := []*tar.Header{
+		{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": testArchiveSHA}},
+		{Typeflag: tar.TypeDir, Name: "o-r-0123456/", Mode: 0755},
+	}
+	for _, h := range hs {
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, content := range files {
+		h := &tar.Header{Typeflag: tar.TypeReg, Name: "o-r-0123456/" + name, Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func testArchiveServer(t *testing.T, files map[string]string) (*httptest.Server, *github.Client) {
+	tarball := testTarball(t, files)
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/o/r/tarball":
+			http.Redirect(w, r, srv.URL+"/codeload/o/r/legacy.tar.gz/main", http.StatusFound)
+		case "/repos/o/r/tarball/v1.0.0":
+			http.Redirect(w, r, srv.URL+"/codeload/o/r/legacy.tar.gz/v1.0.0", http.StatusFound)
+		case "/codeload/o/r/legacy.tar.gz/main", "/codeload/o/r/legacy.tar.gz/v1.0.0":
+			w.Write(tarball)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+
+	client := github.NewClient(nil)
+	u, err := url.Parse(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.BaseURL = u
+	return srv, client
+}
+
+func TestSlugFromURL(t *testing.T) {
+	for _, u := range []string{"https://github.com/o/r.git", "git@github.com:o/r.git", "https://github.com/o/r"} {
+		owner, name, err := slugFromURL(u)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if owner != "o" || name != "r" {
+			t.Errorf("Unexpected owner and name for '%s': %s/%s", u, owner, name)
+		}
+	}
+	if _, _, err := slugFromURL("r.git"); err == nil {
+		t.Error("URL without owner should cause an error")
+	}
+}
+
+func TestArchivePath(t *testing.T) {
+	for name, want := range map[string]string{
+		"o-r-0123456/":          "",
+		"o-r-0123456/a.txt":     "a.txt",
+		"o-r-0123456/sub/b.txt": "sub/b.txt",
+		"pax_global_header":     "",
+	} {
+		have, err := archivePath(name)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have != want {
+			t.Errorf("Path of '%s' should be '%s' but got '%s'", name, want, have)
+		}
+	}
+	for _, name := range []string{"o-r-0123456/../a.txt", "o-r-0123456//etc/passwd", "o-r-0123456/sub/../../a.txt"} {
+		if p, err := archivePath(name); err == nil {
+			t.Errorf("Path '%s' outside repository should be rejected but got '%s'", name, p)
+		}
+	}
+}
+
+func TestArchiveBackendKeep(t *testing.T) {
+	srv, client := testArchiveServer(t, map[string]string{"a.yml": "a", "sub/b.txt": "b", "sub/c.yml": "c"})
+	defer srv.Close()
+
+	dir, done := testDestDir(t)
+	defer done()
+	dst := filepath.Join(dir, "o", "r")
+
+	b := NewArchiveBackend(client)
+	keep := func(p string) bool { return filepath.Ext(p) == ".yml" }
+	if err := b.Clone(context.Background(), "https://github.com/o/r.git", dst, &CloneOptions{Keep: keep}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{"a.yml", "sub/c.yml"} {
+		if _, err := os.Stat(filepath.Join(dst, filepath.FromSlash(f))); err != nil {
+			t.Error("Matched file was not written:", f)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dst, "sub", "b.txt")); err == nil {
+		t.Error("Unmatched file was written")
+	}
+
+	sha, err := b.HeadSHA(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sha != testArchiveSHA {
+		t.Error("Commit SHA recorded in archive should be resolved but got", sha)
+	}
+}
+
+func TestArchiveBackendRefNotFound(t *testing.T) {
+	srv, client := testArchiveServer(t, map[string]string{"a.txt": "a"})
+	defer srv.Close()
+
+	dir, done := testDestDir(t)
+	defer done()
+
+	b := NewArchiveBackend(client)
+	err := b.Clone(context.Background(), "https://github.com/o/r.git", filepath.Join(dir, "o", "r"), &CloneOptions{Ref: "not-existing"})
+	if !errors.Is(err, ErrRefNotFound) {
+		t.Fatal("ErrRefNotFound should be returned:", err)
+	}
+
+	if err := b.Clone(context.Background(), "https://github.com/o/r.git", filepath.Join(dir, "o", "r"), &CloneOptions{Ref: "v1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClonerWithArchiveBackend(t *testing.T) {
+	srv, client := testArchiveServer(t, map[string]string{"a.vim": "a", "README.md": "r"})
+	defer srv.Close()
+
+	dir, done := testDestDir(t)
+	defer done()
+
+	cl := NewCloner(dir, regexp.MustCompile(`\.vim$`), false, false)
+	cl.Backend = NewArchiveBackend(client)
+	cl.Err = make(chan error, 10)
+	cl.Start(1)
+	cl.Clone("o/r")
+	cl.Shutdown()
+	for err := range cl.Err {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(dir, "o", "r", "a.vim"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "a" {
+		t.Error("Unexpected content:", string(b))
+	}
+	if _, err := os.Stat(filepath.Join(dir, "o", "r", "README.md")); err == nil {
+		t.Error("Unmatched file was written")
+	}
+	if sha := cl.SHAs()["o/r"]; sha != testArchiveSHA {
+		t.Error("Commit SHA should be recorded but got", sha)
+	}
+}
+
+func TestClonerArchiveExtractRelativePath(t *testing.T) {
+	srv, client := testArchiveServer(t, map[string]string{"a.vim": "a", "plugin/b.vim": "b", "plugin/c.txt": "c"})
+	defer srv.Close()
+
+	dir, done := testDestDir(t)
+	defer done()
+
+	// Path is matched relative to the repository root also when cloned into temporary directory
+	re := regexp.MustCompile(`^plugin/.+\.vim$`)
+	l, err := ParseLayout("{owner}/{name}@{sha}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := NewCloner(dir, re, false, false)
+	cl.Backend = NewArchiveBackend(client)
+	cl.Layout = l
+	cl.Err = make(chan error, 10)
+	cl.Start(1)
+	cl.Clone("o/r")
+	cl.Shutdown()
+	for err := range cl.Err {
+		t.Fatal(err)
+	}
+
+	dst := filepath.Join(dir, "o", "r@"+testArchiveSHA)
+	if _, err := os.Stat(filepath.Join(dst, "plugin", "b.vim")); err != nil {
+		t.Error("Matched file was not written:", err)
+	}
+	for _, f := range []string{"a.vim", "plugin/c.txt"} {
+		if _, err := os.Stat(filepath.Join(dst, filepath.FromSlash(f))); err == nil {
+			t.Error("Unmatched file was written:", f)
+		}
+	}
+}
+
+func TestClonerUpdateArchiveFailureKeepsFiles(t *testing.T) {
+	tarball := testTarball(t, map[string]string{"a.vim": "new"})
+	fail := true
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/repos/o/r/tarball" {
+			http.Redirect(w, r, srv.URL+"/codeload/o/r/legacy.tar.gz/main", http.StatusFound)
+			return
+		}
+		if fail {
+			http.Error(w, "oops", http.StatusInternalServerError)
+			return
+		}
+		w.Write(tarball)
+	}))
+	defer srv.Close()
+	client := github.NewClient(nil)
+	u, err := url.Parse(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.BaseURL = u
+
+	dir, done := testDestDir(t)
+	defer done()
+	dst := filepath.Join(dir, "o", "r")
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	testWriteFile(t, dst, "a.vim", "old")
+
+	update := func() []error {
+		cl := NewCloner(dir, nil, false, false)
+		cl.Backend = NewArchiveBackend(client)
+		cl.Update = true
+		cl.Err = make(chan error, 10)
+		cl.Start(1)
+		cl.Clone("o/r")
+		cl.Shutdown()
+		errs := []error{}
+		for err := range cl.Err {
+			errs = append(errs, err)
+		}
+		return errs
+	}
+
+	if errs := update(); len(errs) == 0 {
+		t.Fatal("Update should fail")
+	}
+	if c, err := ioutil.ReadFile(filepath.Join(dst, "a.vim")); err != nil || string(c) != "old" {
+		t.Error("Existing files should remain on failure:", string(c), err)
+	}
+
+	fail = false
+	if errs := update(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	if c, err := ioutil.ReadFile(filepath.Join(dst, "a.vim")); err != nil || string(c) != "new" {
+		t.Error("Files should be replaced on success:", string(c), err)
+	}
+	fs, err := ioutil.ReadDir(filepath.Join(dir, "o"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 1 {
+		t.Error("Temporary directory should be removed:", len(fs))
+	}
+}
+
+// testRawTarball creates a gzipped tarball of the entries. Regular files have the contents.
+func testRawTarball(t *testing.T, entries []*tar.Header, contents map[string]string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, h := range entries {
+		c := ""
+		if h.Typeflag == tar.TypeReg {
+			c = contents[h.Name]
+		}
+		h.Size = int64(len(c))
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(c)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestArchiveBackendMaliciousSymlink(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+	outside := filepath.Join(dir, "outside")
+	if err := os.MkdirAll(outside, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	global := &tar.Header{Typeflag: tar.TypeXGlobalHeader, Name: "pax_global_header", PAXRecords: map[string]string{"comment": testArchiveSHA}}
+	for i, entries := range [][]*tar.Header{
+		{
+			{Typeflag: tar.TypeSymlink, Name: "o-r-0123456/evil", Linkname: outside},
+			{Typeflag: tar.TypeReg, Name: "o-r-0123456/evil/pwned", Mode: 0644},
+		},
+		{
+			{Typeflag: tar.TypeSymlink, Name: "o-r-0123456/sub/evil", Linkname: "../../../outside"},
+			{Typeflag: tar.TypeReg, Name: "o-r-0123456/sub/evil/pwned", Mode: 0644},
+		},
+		{
+			// Target is inside the repository, but writing through it is still refused
+			{Typeflag: tar.TypeSymlink, Name: "o-r-0123456/link", Linkname: "sub"},
+			{Typeflag: tar.TypeReg, Name: "o-r-0123456/link/pwned", Mode: 0644},
+		},
+		{
+			{Typeflag: tar.TypeSymlink, Name: "o-r-0123456/file", Linkname: "README.md"},
+			{Typeflag: tar.TypeReg, Name: "o-r-0123456/file", Mode: 0644},
+		},
+	} {
+		tarball := testRawTarball(t, append([]*tar.Header{global}, entries...), map[string]string{entries[1].Name: "pwned"})
+		dst := filepath.Join(dir, "repos", strconv.Itoa(i))
+		if _, err := NewArchiveBackend(nil).(*archiveBackend).extract(bytes.NewReader(tarball), dst, nil); err == nil {
+			t.Errorf("Malicious archive #%d should be rejected", i)
+		}
+		if _, err := os.Stat(filepath.Join(outside, "pwned")); err == nil {
+			t.Fatalf("File was written outside of repository by archive #%d", i)
+		}
+	}
+
+	tarball := testRawTarball(t, []*tar.Header{
+		global,
+		{Typeflag: tar.TypeReg, Name: "o-r-0123456/sub/a.txt", Mode: 0644},
+		{Typeflag: tar.TypeSymlink, Name: "o-r-0123456/sub/link", Linkname: "../README.md"},
+	}, map[string]string{"o-r-0123456/sub/a.txt": "a"})
+	if _, err := NewArchiveBackend(nil).(*archiveBackend).extract(bytes.NewReader(tarball), filepath.Join(dir, "repos", "ok"), nil); err != nil {
+		t.Error("Symlink inside repository should be extracted:", err)
+	}
+}
+
+func TestArchiveBackendUpdateFailureKeepsFiles(t *testing.T) {
+	srv, client := testArchiveServer(t, map[string]string{"a.txt": "new"})
+	defer srv.Close()
+
+	dir, done := testDestDir(t)
+	defer done()
+	dst := filepath.Join(dir, "o", "r")
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		t.Fatal(err)
+	}
+	testWriteFile(t, dst, "a.txt", "old")
+
+	b := NewArchiveBackend(client)
+	if err := b.Update(context.Background(), "https://github.com/o/r.git", dst, &CloneOptions{Ref: "not-existing"}); err == nil {
+		t.Fatal("Update should fail")
+	}
+	if c, err := ioutil.ReadFile(filepath.Join(dst, "a.txt")); err != nil || string(c) != "old" {
+		t.Error("Existing files should remain on failure:", string(c), err)
+	}
+
+	if err := b.Update(context.Background(), "https://github.com/o/r.git", dst, &CloneOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if c, err := ioutil.ReadFile(filepath.Join(dst, "a.txt")); err != nil || string(c) != "new" {
+		t.Error("Files should be replaced on success:", string(c), err)
+	}
+	if sha, err := b.HeadSHA(dst); err != nil || sha != testArchiveSHA {
+		t.Error("Commit SHA should be recorded for the directory:", sha, err)
+	}
+	fs, err := ioutil.ReadDir(filepath.Join(dir, "o"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs) != 1 {
+		t.Error("Temporary directory should be removed:", len(fs))
+	}
+}
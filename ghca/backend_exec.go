@@ -0,0 +1,307 @@
+package ghca
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// execBackend is a clone backend which runs git command.
+type execBackend struct {
+	git string
+	env []string
+}
+
+func newExecBackend() *execBackend {
+	b := &execBackend{
+		git: os.Getenv("GIT_EXECUTABLE_PATH"),
+		env: append(
+			os.Environ(),
+			"GIT_TERMINAL_PROMPT=0",
+			"GIT_ASKPASS=",
+			"SSH_ASKPASS=",
+			// Git LFS objects are fetched explicitly only when requested. Please see Cloner.LFS
+			"GIT_LFS_SKIP_SMUDGE=1",
+		),
+	}
+	if b.git == "" {
+		b.git = "git"
+	}
+	return b
+}
+
+// refNotFound returns true when git-clone or git-fetch failed because the ref does not exist in the
+// remote repository.
+func refNotFound(stderr string) bool {
+	return strings.Contains(stderr, "not found in upstream origin") || strings.Contains(stderr, "couldn't find remote ref")
+}
+
+// credentialHelper is a Git credential helper which gives the token in $GHCA_GIT_TOKEN to git. The
+// token is passed via environment variable so that it never appears in command line arguments, URLs
+// or logs.
+const credentialHelper = `!f() { test "$1" = get && echo username=x-access-token && echo "password=${GHCA_GIT_TOKEN}"; }; f`
+
+// command creates git command with the arguments. 'opts' can be nil when the command does not
+// access the remote. When the token is not empty, it is given to git only for https://github.com via
+// the credential helper. Other helpers are disabled for the host so that the token is not stored by
+// them. SSH configuration is applied via $GIT_SSH_COMMAND.
+func (b *execBackend) command(ctx context.Context, opts *CloneOptions, args ...string) *exec.Cmd {
+	env := b.env
+	if opts != nil {
+		env = env[:len(env):len(env)]
+		if opts.Token != "" {
+			args = append([]string{
+				"-c", "credential.https://github.com.helper=",
+				"-c", "credential.https://github.com.helper=" + credentialHelper,
+			}, args...)
+			env = append(env, "GHCA_GIT_TOKEN="+opts.Token)
+		}
+		if c := opts.SSH.sshCommand(os.Getenv("GIT_SSH_COMMAND")); c != "" {
+			env = append(env, "GIT_SSH_COMMAND="+c)
+		}
+		if opts.Proxy != "" {
+			args = append([]string{"-c", "http.proxy=" + opts.Proxy}, args...)
+		}
+		if opts.CABundle != "" {
+			args = append([]string{"-c", "http.sslCAInfo=" + opts.CABundle}, args...)
+		}
+	}
+	cmd := exec.CommandContext(ctx, b.git, args...)
+	cmd.Env = env
+	return cmd
+}
+
+// output runs git command with the arguments and returns its stdout. On failure, the error is
+// GitError with 'op' and 'target'. Stderr is also written to opts.Progress when it is set.
+func (b *execBackend) output(ctx context.Context, op, target string, opts *CloneOptions, args ...string) (string, error) {
+	var progress io.Writer
+	if opts != nil {
+		progress = opts.Progress
+	}
+	out, stderr, err := runCommand(ctx, b.command(ctx, opts, args...), progress)
+	if err != nil {
+		stderr = compactProgress(stderr)
+		if refNotFound(stderr) {
+			err = ErrRefNotFound
+		}
+		return "", &GitError{Op: op, Target: target, Stderr: stderr, Err: err}
+	}
+	return out, nil
+}
+
+// runCommand runs the command and returns its stdout and stderr. Output is read via pipes owned by
+// this function instead of exec.Cmd so that it returns soon after the context is canceled even if
+// child processes of killed git such as git-remote-https still hold the pipes.
+func runCommand(ctx context.Context, cmd *exec.Cmd, progress io.Writer) (string, string, error) {
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		return "", "", err
+	}
+	defer outR.Close()
+	errR, errW, err := os.Pipe()
+	if err != nil {
+		outW.Close()
+		return "", "", err
+	}
+	defer errR.Close()
+
+	cmd.Stdout = outW
+	cmd.Stderr = errW
+	err = cmd.Start()
+	outW.Close()
+	errW.Close()
+	if err != nil {
+		return "", "", err
+	}
+
+	var stdout, stderr bytes.Buffer
+	w := io.Writer(&stderr)
+	if progress != nil {
+		w = io.MultiWriter(&stderr, progress)
+	}
+	copied := make(chan struct{}, 2)
+	go func() {
+		io.Copy(&stdout, outR)
+		copied <- struct{}{}
+	}()
+	go func() {
+		io.Copy(w, errR)
+		copied <- struct{}{}
+	}()
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		// Unblock reading output which remaining child processes may keep open
+		outR.Close()
+		errR.Close()
+	}
+	<-copied
+	<-copied
+	return stdout.String(), stderr.String(), err
+}
+
+// compactProgress removes progress lines overwritten with '\r' from stderr of git command.
+func compactProgress(stderr string) string {
+	lines := strings.Split(stderr, "\n")
+	for i, l := range lines {
+		if j := strings.LastIndexByte(strings.TrimRight(l, "\r"), '\r'); j >= 0 {
+			lines[i] = l[j+1:]
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (b *execBackend) run(ctx context.Context, op, target string, opts *CloneOptions, args ...string) error {
+	_, err := b.output(ctx, op, target, opts, args...)
+	return err
+}
+
+// isShallow returns true when the repository was cloned shallowly.
+func isShallow(dir string) bool {
+	for _, p := range []string{filepath.Join(dir, ".git", "shallow"), filepath.Join(dir, "shallow")} {
+		if _, err := os.Stat(p); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// shallowArgs returns arguments of git-clone or git-fetch to limit history. 'dir' is the repository
+// to update. It is empty on cloning. When full history is requested for a shallow repository, its
+// history is deepened with --unshallow.
+func shallowArgs(opts *CloneOptions, dir string) []string {
+	if opts.Deep {
+		if dir != "" && isShallow(dir) {
+			return []string{"--unshallow"}
+		}
+		return nil
+	}
+	if opts.ShallowSince != "" {
+		return []string{"--shallow-since=" + opts.ShallowSince}
+	}
+	return []string{fmt.Sprintf("--depth=%d", opts.depth())}
+}
+
+// cloneArgs returns arguments of git-clone command.
+func (b *execBackend) cloneArgs(url, dir string, opts *CloneOptions) []string {
+	args := make([]string, 0, 5)
+	args = append(args, "clone")
+	if opts.Progress != nil {
+		// git reports progress only to terminal by default
+		args = append(args, "--progress")
+	}
+	switch {
+	case opts.Mode == CloneBare:
+		args = append(args, "--bare")
+	case opts.Mode == CloneMirror:
+		args = append(args, "--mirror")
+	case !opts.Deep:
+		args = append(args, shallowArgs(opts, "")...)
+		if opts.Ref == RefAllBranches {
+			args = append(args, "--no-single-branch")
+		} else {
+			args = append(args, "--single-branch")
+		}
+	}
+	if opts.specificRef() {
+		args = append(args, "--branch", opts.Ref)
+	}
+	if opts.Submodules && !opts.bare() {
+		args = append(args, "--recurse-submodules")
+		if !opts.Deep {
+			args = append(args, "--shallow-submodules")
+		}
+	}
+	return append(args, url, dir)
+}
+
+func (b *execBackend) Clone(ctx context.Context, url, dir string, opts *CloneOptions) error {
+	if err := b.run(ctx, "clone", url, opts, b.cloneArgs(url, dir, opts)...); err != nil {
+		return err
+	}
+	if opts.Mode == CloneBare {
+		// Bare clone has no refspec to fetch. Set it to fetch all branches on update
+		return b.run(ctx, "clone", url, nil, "-C", dir, "config", "remote.origin.fetch", "+refs/heads/*:refs/heads/*")
+	}
+	return nil
+}
+
+// updateArgs returns a list of arguments of git commands to update the repository.
+func (b *execBackend) updateArgs(dir string, opts *CloneOptions) [][]string {
+	if opts.bare() {
+		return [][]string{{"-C", dir, "remote", "update", "--prune"}}
+	}
+
+	head := "HEAD"
+	if opts.specificRef() {
+		head = opts.Ref
+	}
+	fetchArgs := func() []string {
+		if opts.Progress != nil {
+			// git reports progress only to terminal by default
+			return []string{"-C", dir, "fetch", "--progress"}
+		}
+		return []string{"-C", dir, "fetch"}
+	}
+	shallow := shallowArgs(opts, dir)
+	fetch := append(fetchArgs(), shallow...)
+	fetch = append(fetch, "origin", head)
+	reset := []string{"-C", dir, "reset", "--hard", "FETCH_HEAD"}
+	cmds := [][]string{fetch, reset}
+	if opts.Ref == RefAllBranches {
+		all := append(fetchArgs(), "--prune")
+		all = append(all, shallow...)
+		all = append(all, "origin", "+refs/heads/*:refs/remotes/origin/*")
+		// --unshallow is necessary only once
+		next := shallow
+		if opts.Deep {
+			next = nil
+		}
+		fetch = append(fetchArgs(), next...)
+		fetch = append(fetch, "origin", head)
+		cmds = [][]string{all, fetch, reset}
+	}
+	if opts.Submodules {
+		sub := []string{"-C", dir, "submodule", "update", "--init", "--recursive"}
+		if !opts.Deep && opts.ShallowSince == "" {
+			sub = append(sub, fmt.Sprintf("--depth=%d", opts.depth()))
+		}
+		cmds = append(cmds, []string{"-C", dir, "submodule", "sync", "--recursive"}, sub)
+	}
+	return cmds
+}
+
+func (b *execBackend) Update(ctx context.Context, url, dir string, opts *CloneOptions) error {
+	for _, args := range b.updateArgs(dir, opts) {
+		if err := b.run(ctx, "update", url, opts, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *execBackend) HeadSHA(dir string) (string, error) {
+	out, err := b.output(context.Background(), "get HEAD of", dir, nil, "-C", dir, "rev-parse", "HEAD")
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(out), nil
+}
+
+func (b *execBackend) SetRemoteURL(dir, url string) error {
+	return b.run(context.Background(), "update remote URL of", dir, nil, "-C", dir, "remote", "set-url", "origin", url)
+}
+
+func (b *execBackend) FetchLFS(ctx context.Context, url, dir string, opts *CloneOptions) error {
+	args := []string{"-C", dir, "lfs", "pull"}
+	if opts.bare() {
+		// Bare repository has no working tree to check out LFS objects
+		args = []string{"-C", dir, "lfs", "fetch", "--all"}
+	}
+	return b.run(ctx, "fetch Git LFS objects of", url, opts, args...)
+}
@@ -0,0 +1,379 @@
+package ghca
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/go-git/go-git/v5/storage/memory"
+	"golang.org/x/crypto/ssh"
+)
+
+// unshallowDepth is the depth to fetch whole history of a shallow repository. It is the same value
+// as 'git fetch --unshallow' sends.
+const unshallowDepth = math.MaxInt32
+
+// goGitBackend is a clone backend which clones repositories with go-git. It does not require git
+// command.
+type goGitBackend struct{}
+
+func (b *goGitBackend) error(op, target string, err error) error {
+	return &GitError{Op: op, Target: target, Err: err}
+}
+
+// auth returns authentication for the URL. The token is only given to https://github.com. SSH
+// configuration is applied to SSH URLs. It returns nil when go-git's default authentication should
+// be used.
+func auth(url string, opts *CloneOptions) (transport.AuthMethod, error) {
+	if strings.HasPrefix(url, "https://github.com/") {
+		if opts.Token == "" {
+			return nil, nil
+		}
+		return &http.BasicAuth{Username: "x-access-token", Password: opts.Token}, nil
+	}
+
+	c := opts.SSH
+	if c.empty() {
+		return nil, nil
+	}
+	ep, err := transport.NewEndpoint(url)
+	if err != nil || ep.Protocol != "ssh" {
+		return nil, nil
+	}
+	user := ep.User
+	if user == "" {
+		user = "git"
+	}
+
+	var cb ssh.HostKeyCallback
+	if c.Insecure {
+		cb = ssh.InsecureIgnoreHostKey()
+	} else if c.KnownHosts != "" {
+		cb, err = gitssh.NewKnownHostsCallback(c.KnownHosts)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if c.Identity != "" {
+		k, err := gitssh.NewPublicKeysFromFile(user, c.Identity, "")
+		if err != nil {
+			return nil, err
+		}
+		k.HostKeyCallback = cb
+		return k, nil
+	}
+	a, err := gitssh.NewSSHAgentAuth(user)
+	if err != nil {
+		return nil, err
+	}
+	a.HostKeyCallback = cb
+	return a, nil
+}
+
+// network returns proxy options and CA bundle to access remotes.
+func network(opts *CloneOptions) (transport.ProxyOptions, []byte, error) {
+	p := transport.ProxyOptions{URL: opts.Proxy}
+	if opts.CABundle == "" {
+		return p, nil, nil
+	}
+	b, err := ioutil.ReadFile(opts.CABundle)
+	if err != nil {
+		return p, nil, err
+	}
+	return p, b, nil
+}
+
+// updateSubmodules initializes and updates submodules recursively. Submodules are updated one by one
+// instead of using RecurseSubmodules so that the token is not given to submodules on other hosts.
+func (b *goGitBackend) updateSubmodules(ctx context.Context, w *git.Worktree, opts *CloneOptions, level int) error {
+	if level >= int(git.DefaultSubmoduleRecursionDepth) {
+		return nil
+	}
+	subs, err := w.Submodules()
+	if err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		a, err := auth(sub.Config().URL, opts)
+		if err != nil {
+			return err
+		}
+		o := &git.SubmoduleUpdateOptions{Init: true, Auth: a}
+		if !opts.Deep {
+			o.Depth = opts.depth()
+		}
+		if err := sub.UpdateContext(ctx, o); err != nil {
+			return err
+		}
+		r, err := sub.Repository()
+		if err != nil {
+			return err
+		}
+		sw, err := r.Worktree()
+		if err != nil {
+			return err
+		}
+		if err := b.updateSubmodules(ctx, sw, opts, level+1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolveRef resolves the ref to its full reference name by listing refs of the remote. Branches are
+// preferred to tags as well as git-clone. Empty ref is resolved to the default branch.
+func resolveRef(ctx context.Context, remote *git.Remote, ref string, auth transport.AuthMethod, opts *CloneOptions) (plumbing.ReferenceName, error) {
+	proxy, ca, err := network(opts)
+	if err != nil {
+		return "", err
+	}
+	refs, err := remote.ListContext(ctx, &git.ListOptions{Auth: auth, ProxyOptions: proxy, CABundle: ca})
+	if err != nil {
+		return "", err
+	}
+
+	if ref == "" {
+		var head *plumbing.Reference
+		for _, r := range refs {
+			if r.Name() == plumbing.HEAD {
+				head = r
+				break
+			}
+		}
+		if head == nil {
+			return "", ErrRefNotFound
+		}
+		if head.Type() == plumbing.SymbolicReference {
+			return head.Target(), nil
+		}
+		// Remote did not advertise symbolic ref. Find the branch pointing to the same commit
+		for _, r := range refs {
+			if r.Name().IsBranch() && r.Hash() == head.Hash() {
+				return r.Name(), nil
+			}
+		}
+		return "", ErrRefNotFound
+	}
+
+	for _, n := range []plumbing.ReferenceName{plumbing.NewBranchReferenceName(ref), plumbing.NewTagReferenceName(ref)} {
+		for _, r := range refs {
+			if r.Name() == n {
+				return n, nil
+			}
+		}
+	}
+	return "", ErrRefNotFound
+}
+
+func (b *goGitBackend) Clone(ctx context.Context, url, dir string, opts *CloneOptions) error {
+	if opts.ShallowSince != "" {
+		return b.error("clone", url, fmt.Errorf("shallow clone by date is %w", ErrUnsupported))
+	}
+
+	a, err := auth(url, opts)
+	if err != nil {
+		return b.error("clone", url, err)
+	}
+	proxy, ca, err := network(opts)
+	if err != nil {
+		return b.error("clone", url, err)
+	}
+	o := &git.CloneOptions{URL: url, RemoteName: "origin", Auth: a, ProxyOptions: proxy, CABundle: ca, Progress: opts.Progress}
+	switch opts.Mode {
+	case CloneMirror:
+		o.Mirror = true
+	case CloneBare:
+		o.Tags = git.AllTags
+	default:
+		if !opts.Deep {
+			o.Depth = opts.depth()
+		}
+		o.SingleBranch = opts.Ref != RefAllBranches
+	}
+
+	if opts.specificRef() {
+		remote := git.NewRemote(memory.NewStorage(), &config.RemoteConfig{Name: "origin", URLs: []string{url}})
+		n, err := resolveRef(ctx, remote, opts.Ref, a, opts)
+		if err != nil {
+			return b.error("clone", url, err)
+		}
+		o.ReferenceName = n
+	}
+
+	r, err := git.PlainCloneContext(ctx, dir, opts.Mode == CloneBare, o)
+	if err != nil {
+		return b.error("clone", url, err)
+	}
+
+	if opts.Mode == CloneBare {
+		// Fetch all branches as local branches as well as 'git clone --bare'
+		if err := b.setFetchRefSpec(r, "+refs/heads/*:refs/heads/*"); err != nil {
+			return b.error("clone", url, err)
+		}
+		return b.fetchAll(ctx, url, r, a, opts)
+	}
+	if opts.Submodules && opts.Mode == CloneCheckout {
+		w, err := r.Worktree()
+		if err != nil {
+			return b.error("clone", url, err)
+		}
+		if err := b.updateSubmodules(ctx, w, opts, 0); err != nil {
+			return b.error("clone", url, err)
+		}
+	}
+	return nil
+}
+
+func (b *goGitBackend) setFetchRefSpec(r *git.Repository, spec config.RefSpec) error {
+	c, err := r.Config()
+	if err != nil {
+		return err
+	}
+	remote, ok := c.Remotes["origin"]
+	if !ok {
+		return fmt.Errorf("remote 'origin' does not exist")
+	}
+	remote.Fetch = []config.RefSpec{spec}
+	return r.SetConfig(c)
+}
+
+// fetchAll fetches the remote with its configured refspecs.
+func (b *goGitBackend) fetchAll(ctx context.Context, url string, r *git.Repository, a transport.AuthMethod, opts *CloneOptions) error {
+	proxy, ca, err := network(opts)
+	if err != nil {
+		return b.error("update", url, err)
+	}
+	err = r.FetchContext(ctx, &git.FetchOptions{RemoteName: "origin", Force: true, Tags: git.AllTags, Auth: a, ProxyOptions: proxy, CABundle: ca, Progress: opts.Progress})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return b.error("update", url, err)
+	}
+	return nil
+}
+
+func (b *goGitBackend) Update(ctx context.Context, url, dir string, opts *CloneOptions) error {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return b.error("update", url, err)
+	}
+	a, err := auth(url, opts)
+	if err != nil {
+		return b.error("update", url, err)
+	}
+	if opts.bare() {
+		return b.fetchAll(ctx, url, r, a, opts)
+	}
+
+	remote, err := r.Remote("origin")
+	if err != nil {
+		return b.error("update", url, err)
+	}
+	ref := opts.Ref
+	if ref == RefAllBranches {
+		ref = ""
+	}
+	name, err := resolveRef(ctx, remote, ref, a, opts)
+	if err != nil {
+		return b.error("update", url, err)
+	}
+
+	spec := config.RefSpec(fmt.Sprintf("+%s:%s", name, name))
+	if name.IsBranch() {
+		spec = config.RefSpec(fmt.Sprintf("+%s:refs/remotes/origin/%s", name, name.Short()))
+	}
+	specs := []config.RefSpec{spec}
+	if opts.Ref == RefAllBranches {
+		specs = append(specs, "+refs/heads/*:refs/remotes/origin/*")
+	}
+	proxy, ca, err := network(opts)
+	if err != nil {
+		return b.error("update", url, err)
+	}
+	fo := &git.FetchOptions{RemoteName: "origin", RefSpecs: specs, Force: true, Tags: git.NoTags, Auth: a, ProxyOptions: proxy, CABundle: ca, Progress: opts.Progress}
+	shallow, err := r.Storer.Shallow()
+	if err != nil {
+		return b.error("update", url, err)
+	}
+	unshallow := opts.Deep && len(shallow) > 0
+	if !opts.Deep {
+		fo.Depth = opts.depth()
+	} else if unshallow {
+		// Fetching without depth does not deepen a shallow repository. Fetch whole history explicitly
+		fo.Depth = unshallowDepth
+	}
+	if err := r.FetchContext(ctx, fo); err != nil && err != git.NoErrAlreadyUpToDate {
+		return b.error("update", url, err)
+	}
+	if unshallow {
+		// go-git only adds shallow commits on fetching. Whole history was fetched so the repository
+		// is no longer shallow. Remove the file since git regards even an empty file as shallow
+		if err := os.Remove(filepath.Join(dir, ".git", "shallow")); err != nil && !os.IsNotExist(err) {
+			return b.error("update", url, err)
+		}
+	}
+
+	h, err := r.ResolveRevision(plumbing.Revision(spec.Dst(name)))
+	if err != nil {
+		return b.error("update", url, err)
+	}
+	w, err := r.Worktree()
+	if err != nil {
+		return b.error("update", url, err)
+	}
+	if err := w.Reset(&git.ResetOptions{Commit: *h, Mode: git.HardReset}); err != nil {
+		return b.error("update", url, err)
+	}
+
+	if opts.Submodules {
+		if err := b.updateSubmodules(ctx, w, opts, 0); err != nil {
+			return b.error("update", url, err)
+		}
+	}
+	return nil
+}
+
+func (b *goGitBackend) HeadSHA(dir string) (string, error) {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return "", b.error("get HEAD of", dir, err)
+	}
+	h, err := r.Head()
+	if err != nil {
+		return "", b.error("get HEAD of", dir, err)
+	}
+	return h.Hash().String(), nil
+}
+
+func (b *goGitBackend) SetRemoteURL(dir, url string) error {
+	r, err := git.PlainOpen(dir)
+	if err != nil {
+		return b.error("update remote URL of", dir, err)
+	}
+	c, err := r.Config()
+	if err != nil {
+		return b.error("update remote URL of", dir, err)
+	}
+	remote, ok := c.Remotes["origin"]
+	if !ok {
+		return b.error("update remote URL of", dir, fmt.Errorf("remote 'origin' does not exist"))
+	}
+	remote.URLs = []string{url}
+	if err := r.SetConfig(c); err != nil {
+		return b.error("update remote URL of", dir, err)
+	}
+	return nil
+}
+
+func (b *goGitBackend) FetchLFS(ctx context.Context, url, dir string, opts *CloneOptions) error {
+	return b.error("fetch Git LFS objects of", url, ErrUnsupported)
+}
@@ -0,0 +1,350 @@
+package ghca
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// testGitRepo creates a Git repository at the path with empty commits of the messages and returns
+// the path.
+func testGitRepo(t *testing.T, path string, msgs ...string) string {
+	if out, err := exec.Command("git", "init", "-q", path).CombinedOutput(); err != nil {
+		t.Fatal(err, string(out))
+	}
+	for _, m := range msgs {
+		testGitCommit(t, path, m)
+	}
+	return path
+}
+
+func testGitCommit(t *testing.T, dir, msg string) {
+	cmd := exec.Command("git", "-C", dir, "-c", "user.name=test", "-c", "user.email=test@example.com", "commit", "-q", "--allow-empty", "-m", msg)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatal(err, string(out))
+	}
+}
+
+func testLog(t *testing.T, dir string) []string {
+	out, err := exec.Command("git", "-C", dir, "log", "--format=%s").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Fields(string(out))
+}
+
+func TestNewCloneBackend(t *testing.T) {
+	for name, want := range map[string]interface{}{
+		"":            &execBackend{},
+		BackendExec:   &execBackend{},
+		BackendGoGit:  &goGitBackend{},
+		"libgit2":     nil,
+		"exec-go-git": nil,
+	} {
+		b, err := NewCloneBackend(name)
+		if want == nil {
+			if err == nil {
+				t.Errorf("Unknown backend '%s' should cause an error", name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		switch want.(type) {
+		case *execBackend:
+			if _, ok := b.(*execBackend); !ok {
+				t.Errorf("Backend '%s' should be exec backend but got %T", name, b)
+			}
+		case *goGitBackend:
+			if _, ok := b.(*goGitBackend); !ok {
+				t.Errorf("Backend '%s' should be go-git backend but got %T", name, b)
+			}
+		}
+	}
+}
+
+func TestGitError(t *testing.T) {
+	err := error(&GitError{Op: "clone", Target: "u", Stderr: "fatal: foo", Err: ErrRefNotFound})
+	if !errors.Is(err, ErrRefNotFound) {
+		t.Error("GitError should wrap underlying error:", err)
+	}
+	if msg := err.Error(); msg != "Could not clone u: "+ErrRefNotFound.Error()+"\nstderr: fatal: foo" {
+		t.Error("Unexpected error message:", msg)
+	}
+	err = &GitError{Op: "get HEAD of", Target: "d", Err: ErrUnsupported}
+	if msg := err.Error(); strings.Contains(msg, "stderr") {
+		t.Error("Empty stderr should not be shown:", msg)
+	}
+}
+
+func TestBackendCloneAndUpdate(t *testing.T) {
+	for _, name := range []string{BackendExec, BackendGoGit} {
+		t.Run(name, func(t *testing.T) {
+			dir, done := testDestDir(t)
+			defer done()
+			src := testGitRepo(t, filepath.Join(dir, ".src"), "first", "second")
+			// Local path without file:// ignores --depth
+			url := "file://" + filepath.ToSlash(src)
+
+			cl := NewCloner(dir, nil, false, false)
+			b, err := NewCloneBackend(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cl.Backend = b
+
+			dst := filepath.Join(dir, "a", "b")
+			if err := cl.gitClone(url, dst, ""); err != nil {
+				t.Fatal(err)
+			}
+			if s := testLog(t, dst); len(s) != 1 || s[0] != "second" {
+				t.Fatal("Only the latest commit should be cloned:", s)
+			}
+
+			testGitCommit(t, src, "third")
+			if err := cl.gitUpdate(url, dst, ""); err != nil {
+				t.Fatal(err)
+			}
+			if s := testLog(t, dst); s[0] != "third" {
+				t.Error("Repository was not updated:", s)
+			}
+
+			out, err := exec.Command("git", "-C", src, "rev-parse", "HEAD").Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sha, err := b.HeadSHA(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sha != strings.TrimSpace(string(out)) {
+				t.Error("Unexpected HEAD:", sha)
+			}
+
+			if err := b.SetRemoteURL(dst, "https://example.com/a/b.git"); err != nil {
+				t.Fatal(err)
+			}
+			out, err = exec.Command("git", "-C", dst, "remote", "get-url", "origin").Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if u := strings.TrimSpace(string(out)); u != "https://example.com/a/b.git" {
+				t.Error("Remote URL was not updated:", u)
+			}
+		})
+	}
+}
+
+func TestBackendUpdateShallowCloneDeeply(t *testing.T) {
+	for _, name := range []string{BackendExec, BackendGoGit} {
+		t.Run(name, func(t *testing.T) {
+			dir, done := testDestDir(t)
+			defer done()
+			src := testGitRepo(t, filepath.Join(dir, ".src"), "first", "second")
+			url := "file://" + filepath.ToSlash(src)
+
+			cl := NewCloner(dir, nil, false, false)
+			b, err := NewCloneBackend(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cl.Backend = b
+
+			dst := filepath.Join(dir, "a", "b")
+			if err := cl.gitClone(url, dst, ""); err != nil {
+				t.Fatal(err)
+			}
+			if s := testLog(t, dst); len(s) != 1 {
+				t.Fatal("Repository should be cloned shallowly:", s)
+			}
+
+			testGitCommit(t, src, "third")
+			cl.deep = true
+			if err := cl.gitUpdate(url, dst, ""); err != nil {
+				t.Fatal(err)
+			}
+			if s := strings.Join(testLog(t, dst), " "); s != "third second first" {
+				t.Error("Whole history should be fetched:", s)
+			}
+			if isShallow(dst) {
+				t.Error("Repository should not be shallow after updating deeply")
+			}
+		})
+	}
+}
+
+func TestBackendRefNotFound(t *testing.T) {
+	for _, name := range []string{BackendExec, BackendGoGit} {
+		t.Run(name, func(t *testing.T) {
+			dir, done := testDestDir(t)
+			defer done()
+			src := testGitRepo(t, filepath.Join(dir, ".src"), "first")
+
+			b, err := NewCloneBackend(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dst := filepath.Join(dir, "a", "b")
+			err = b.Clone(context.Background(), src, dst, &CloneOptions{Ref: "not-existing-branch"})
+			if !errors.Is(err, ErrRefNotFound) {
+				t.Fatal("ErrRefNotFound should be returned:", err)
+			}
+			var gitErr *GitError
+			if !errors.As(err, &gitErr) || gitErr.Op != "clone" || gitErr.Target != src {
+				t.Error("GitError should be returned:", err)
+			}
+		})
+	}
+}
+
+func TestGoGitBackendBare(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+	src := testGitRepo(t, filepath.Join(dir, ".src"), "first")
+	if out, err := exec.Command("git", "-C", src, "branch", "topic").CombinedOutput(); err != nil {
+		t.Fatal(err, string(out))
+	}
+
+	cl := NewCloner(dir, nil, false, false)
+	cl.Backend = &goGitBackend{}
+	cl.Mode = CloneBare
+	dst := filepath.Join(dir, "a", "b.git")
+	if err := cl.gitClone(src, dst, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !isGitRepo(dst) {
+		t.Fatal("Bare repository was not cloned")
+	}
+	out, err := exec.Command("git", "-C", dst, "branch", "--format=%(refname:short)").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "topic") {
+		t.Error("All branches should be cloned into bare repository:", string(out))
+	}
+
+	testGitCommit(t, src, "second")
+	if err := cl.gitUpdate(src, dst, ""); err != nil {
+		t.Fatal(err)
+	}
+	if s := testLog(t, dst); len(s) != 2 || s[0] != "second" {
+		t.Error("Bare repository was not updated:", s)
+	}
+}
+
+func TestGoGitBackendUnsupported(t *testing.T) {
+	b := &goGitBackend{}
+	err := b.Clone(context.Background(), "u", "d", &CloneOptions{ShallowSince: "2020-01-02T00:00:00Z"})
+	if !errors.Is(err, ErrUnsupported) {
+		t.Error("Shallow clone by date should not be supported:", err)
+	}
+	if err := b.FetchLFS(context.Background(), "u", "d", &CloneOptions{}); !errors.Is(err, ErrUnsupported) {
+		t.Error("Git LFS should not be supported:", err)
+	}
+}
+
+func TestExecBackendCredentialHelper(t *testing.T) {
+	b := newExecBackend()
+	fill := func(host string) (*exec.Cmd, string) {
+		cmd := b.command(context.Background(), &CloneOptions{Token: "secret-token"}, "credential", "fill")
+		cmd.Stdin = strings.NewReader("protocol=https\nhost=" + host + "\n\n")
+		out, _ := cmd.Output()
+		return cmd, string(out)
+	}
+
+	cmd, out := fill("github.com")
+	if !strings.Contains(out, "username=x-access-token\n") || !strings.Contains(out, "password=secret-token\n") {
+		t.Error("Token should be given to git for github.com:", out)
+	}
+	for _, a := range cmd.Args {
+		if strings.Contains(a, "secret-token") {
+			t.Error("Token should not appear in command line arguments:", cmd.Args)
+		}
+	}
+
+	if _, out := fill("example.com"); strings.Contains(out, "secret-token") {
+		t.Error("Token should not be given to other hosts:", out)
+	}
+}
+
+func TestGoGitAuth(t *testing.T) {
+	for _, tc := range []struct {
+		url   string
+		token string
+		want  bool
+	}{
+		{"https://github.com/o/r.git", "t", true},
+		{"https://github.com/o/r.git", "", false},
+		{"git@github.com:o/r.git", "t", false},
+		{"https://example.com/o/r.git", "t", false},
+		{"https://github.com.example.com/o/r.git", "t", false},
+	} {
+		a, err := auth(tc.url, &CloneOptions{Token: tc.token})
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if (a != nil) != tc.want {
+			t.Errorf("Unexpected authentication for %+v: %v", tc, a)
+		}
+	}
+}
+
+func TestCloneOptionsToken(t *testing.T) {
+	cl := NewCloner("dest", nil, false, false)
+	cl.Tokens = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "t"})
+	if o := cl.options(""); o.Token != "t" {
+		t.Error("Token should be passed to backend for HTTPS:", o.Token)
+	}
+	cl = NewCloner("dest", nil, false, true)
+	cl.Tokens = oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "t"})
+	if o := cl.options(""); o.Token != "" {
+		t.Error("Token should not be passed to backend for SSH:", o.Token)
+	}
+}
+
+func TestExecBackendProgress(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+	src := testGitRepo(t, filepath.Join(dir, ".src"), "first")
+
+	var progress bytes.Buffer
+	opts := &CloneOptions{Progress: &progress}
+	if err := newExecBackend().Clone(context.Background(), "file://"+filepath.ToSlash(src), filepath.Join(dir, "dst"), opts); err != nil {
+		t.Fatal(err)
+	}
+	if progress.Len() == 0 {
+		t.Error("Progress of git clone should be reported")
+	}
+}
+
+func TestCompactProgress(t *testing.T) {
+	have := compactProgress("Cloning into 'r'...\nReceiving objects:  50% (1/2)\rReceiving objects: 100% (2/2), done.\r\nfatal: error\n")
+	want := "Cloning into 'r'...\nReceiving objects: 100% (2/2), done.\r\nfatal: error\n"
+	if have != want {
+		t.Errorf("Wanted %q but got %q", want, have)
+	}
+}
+
+func TestRunCommandCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	// Child process keeps stdout and stderr open after the shell is killed
+	cmd := exec.CommandContext(ctx, "sh", "-c", "sleep 10 & sleep 10")
+	start := time.Now()
+	if _, _, err := runCommand(ctx, cmd, nil); err == nil {
+		t.Error("Canceled command should fail")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Error("Command should return soon after it was canceled:", d)
+	}
+}
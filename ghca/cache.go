@@ -0,0 +1,165 @@
+package ghca
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// cacheHeader is a header added to responses served from HTTPCache.
+const cacheHeader = "X-Ghca-Cache"
+
+// HTTPCache is an HTTP transport which caches responses of GitHub API on disk. Cached responses are
+// always revalidated with conditional requests (If-None-Match) and served only when GitHub responds
+// with '304 Not Modified', which does not count toward the rate limit. Only JSON responses with ETag
+// are cached so that large downloads such as tarballs are never stored.
+type HTTPCache struct {
+	// Dir is a directory to store cached responses. It is created on the first write.
+	Dir string
+	// Base is a transport to send requests. nil means http.DefaultTransport.
+	Base http.RoundTripper
+	// hits is the number of responses served from the cache
+	hits int64
+}
+
+// NewHTTPCache creates a new HTTP cache which stores responses in the directory.
+func NewHTTPCache(dir string) *HTTPCache {
+	return &HTTPCache{Dir: dir}
+}
+
+func (c *HTTPCache) base() http.RoundTripper {
+	if c.Base == nil {
+		return http.DefaultTransport
+	}
+	return c.Base
+}
+
+// path returns the path of the cache file for the request. Authorization header is not a part of the
+// key since cached responses are always revalidated by GitHub with the token of the request.
+func (c *HTTPCache) path(req *http.Request) string {
+	h := sha256.New()
+	h.Write([]byte(req.URL.String()))
+	h.Write([]byte{'\n'})
+	h.Write([]byte(req.Header.Get("Accept")))
+	return filepath.Join(c.Dir, hex.EncodeToString(h.Sum(nil)))
+}
+
+// load reads the cached response for the request. It returns nil when it is not cached.
+func (c *HTTPCache) load(req *http.Request) *http.Response {
+	res, err := readResponseFile(c.path(req), req)
+	if err != nil {
+		return nil
+	}
+	return res
+}
+
+// readResponseFile reads the HTTP response dumped by httputil.DumpResponse as the response of the
+// request.
+func readResponseFile(path string, req *http.Request) (*http.Response, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), req)
+}
+
+// store writes the response to the cache when it is cacheable. The body of the response is read and
+// replaced so that the caller can still read it.
+func (c *HTTPCache) store(req *http.Request, res *http.Response) {
+	if res.StatusCode != http.StatusOK || res.Header.Get("ETag") == "" {
+		return
+	}
+	if t, _, err := mime.ParseMediaType(res.Header.Get("Content-Type")); err != nil || t != "application/json" {
+		return
+	}
+	b, err := httputil.DumpResponse(res, true)
+	if err != nil {
+		return
+	}
+	if err := writeFileAtomic(c.path(req), b); err != nil {
+		log.Println("Could not write HTTP cache:", err)
+	}
+}
+
+// writeFileAtomic writes the content to the file via a temporary file so that other goroutines or
+// processes never read a partially written file. The parent directory is created only accessible by
+// the user since API responses may contain information of private repositories.
+func writeFileAtomic(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// RoundTrip sends the request with If-None-Match header when its response was cached. On '304 Not
+// Modified', the cached response is returned with headers of the fresh response such as rate limit.
+func (c *HTTPCache) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" || req.Header.Get("Range") != "" {
+		return c.base().RoundTrip(req)
+	}
+
+	cached := c.load(req)
+	if cached == nil {
+		res, err := c.base().RoundTrip(req)
+		if err != nil {
+			return nil, err
+		}
+		c.store(req, res)
+		return res, nil
+	}
+
+	r := req.Clone(req.Context())
+	r.Header.Set("If-None-Match", cached.Header.Get("ETag"))
+	res, err := c.base().RoundTrip(r)
+	if err != nil {
+		cached.Body.Close()
+		return nil, err
+	}
+	if res.StatusCode != http.StatusNotModified {
+		cached.Body.Close()
+		c.store(req, res)
+		return res, nil
+	}
+
+	res.Body.Close()
+	for k, vs := range res.Header {
+		switch k {
+		case "Content-Length", "Content-Type", "Content-Encoding", "Transfer-Encoding":
+			// They describe the body of the cached response
+		default:
+			cached.Header[k] = vs
+		}
+	}
+	cached.Header.Set(cacheHeader, "hit")
+	cached.Request = req
+	atomic.AddInt64(&c.hits, 1)
+	return cached, nil
+}
+
+// Hits returns the number of responses served from the cache.
+func (c *HTTPCache) Hits() int {
+	return int(atomic.LoadInt64(&c.hits))
+}
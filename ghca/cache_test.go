@@ -0,0 +1,113 @@
+package ghca
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+// testETagServer responds with JSON and ETag. It responds with '304 Not Modified' when If-None-Match
+// matches. 'body' can be changed to update the content.
+func testETagServer(body *string, statuses *[]int) *httptest.Server {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		etag := fmt.Sprintf(`"%x"`, len(*body))
+		w.Header().Set("X-RateLimit-Remaining", fmt.Sprint(100-len(*statuses)))
+		if r.Header.Get("If-None-Match") == etag {
+			*statuses = append(*statuses, http.StatusNotModified)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		*statuses = append(*statuses, http.StatusOK)
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(*body))
+	}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	return srv
+}
+
+func testCacheGet(t *testing.T, c *http.Client, url string) (string, *http.Response) {
+	res, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b), res
+}
+
+func TestHTTPCacheRevalidate(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+	body := `{"total_count":1}`
+	statuses := []int{}
+	srv := testETagServer(&body, &statuses)
+	defer srv.Close()
+
+	cache := NewHTTPCache(filepath.Join(dir, "cache"))
+	cache.Base = srv.Client().Transport
+	c := &http.Client{Transport: cache}
+
+	for i := 0; i < 2; i++ {
+		b, _ := testCacheGet(t, c, srv.URL+"/search/repositories?q=foo")
+		if b != body {
+			t.Errorf("Unexpected body at #%d: %q", i, b)
+		}
+	}
+	b, res := testCacheGet(t, c, srv.URL+"/search/repositories?q=foo")
+	if b != body || res.StatusCode != http.StatusOK || res.Header.Get(cacheHeader) != "hit" {
+		t.Errorf("Response should be served from cache: %d %q %v", res.StatusCode, b, res.Header)
+	}
+	if r := res.Header.Get("X-RateLimit-Remaining"); r != "98" {
+		t.Error("Rate limit header should be taken from fresh response but got", r)
+	}
+	if len(statuses) != 3 || statuses[1] != http.StatusNotModified || statuses[2] != http.StatusNotModified {
+		t.Error("Cached responses should be revalidated:", statuses)
+	}
+	if cache.Hits() != 2 {
+		t.Error("Unexpected cache hits:", cache.Hits())
+	}
+
+	body = `{"total_count":10}`
+	if b, _ := testCacheGet(t, c, srv.URL+"/search/repositories?q=foo"); b != body {
+		t.Error("Modified response should be returned:", b)
+	}
+	if b, _ := testCacheGet(t, c, srv.URL+"/search/repositories?q=foo"); b != body {
+		t.Error("Cache should be updated with modified response:", b)
+	}
+	if b, _ := testCacheGet(t, c, srv.URL+"/search/repositories?q=bar"); b != body || statuses[len(statuses)-1] != http.StatusOK {
+		t.Error("Different URL should not hit cache:", b, statuses)
+	}
+}
+
+func TestHTTPCacheNotCacheable(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") != "" {
+			t.Error("Request should not be conditional:", r.URL)
+		}
+		w.Header().Set("ETag", `"tarball"`)
+		w.Header().Set("Content-Type", "application/x-gzip")
+		w.Write([]byte("archive"))
+	}))
+	defer srv.Close()
+
+	cache := NewHTTPCache(filepath.Join(dir, "cache"))
+	c := &http.Client{Transport: cache}
+	for i := 0; i < 2; i++ {
+		if b, _ := testCacheGet(t, c, srv.URL+"/archive.tar.gz"); b != "archive" {
+			t.Error("Unexpected body:", b)
+		}
+	}
+	if fs, _ := ioutil.ReadDir(cache.Dir); len(fs) != 0 {
+		t.Error("Non-JSON response should not be cached:", len(fs))
+	}
+}
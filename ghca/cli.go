@@ -9,10 +9,16 @@ package ghca
 import (
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
 )
 
 // CLI represents a command line interface of github-clone-all.
@@ -25,6 +31,205 @@ type CLI struct {
 	dry     bool
 	deep    bool
 	ssh     bool
+	// tokenSource describes where the token was read from
+	tokenSource string
+	// Code indicates searching code instead of repositories. Please see Collector.Code.
+	Code bool
+	// MatchedOnly indicates only files matched by code search remain. Please see Collector.MatchedOnly.
+	MatchedOnly bool
+	// Filter is an expression to filter repositories before cloning them. Please see Filter.
+	Filter string
+	// Queries are additional queries to search. Please see Collector.Queries.
+	Queries []string
+	// Sort is a field to sort search results. Please see Collector.Sort.
+	Sort string
+	// Order is an order of sorting search results. Please see Collector.Order.
+	Order string
+	// Repos is a list of repositories to clone in addition to search results. Please see Collector.Repos.
+	Repos []string
+	// Concurrency is the number of workers to clone repositories. Please see Collector.Concurrency.
+	Concurrency int
+	// Retries is how many times cloning a repository is retried on failure.
+	Retries int
+	// Format is a format of dry-run output. Please see Collector.Format.
+	Format string
+	// Layout is a template of directory path to clone each repository into. Empty means
+	// DefaultLayout. Please see Layout.
+	Layout string
+	// PruneStale indicates repositories in dest directory which are no longer in search results are
+	// pruned after cloning. Please see Pruner.
+	PruneStale bool
+	// Quarantine is a directory to move pruned repositories into instead of removing them. Please see
+	// Pruner.Quarantine.
+	Quarantine string
+	// MaxRepoSize is max size of one repository such as '500MB'. Please see Collector.MaxRepoSize.
+	MaxRepoSize string
+	// DiskBudget is a disk budget of dest directory such as '50GB,free:10GB'. Please see
+	// ParseDiskBudget.
+	DiskBudget string
+	// Bare indicates cloning bare repositories. Please see Cloner.Mode.
+	Bare bool
+	// Mirror indicates cloning mirror repositories. Please see Cloner.Mode.
+	Mirror bool
+	// WithWiki indicates wikis are also cloned. Please see Cloner.WithWiki.
+	WithWiki bool
+	// WithIssues indicates issues and pull requests are also exported. Please see
+	// Collector.WithIssues.
+	WithIssues bool
+	// Submodules indicates submodules are cloned recursively. Please see Cloner.Submodules.
+	Submodules bool
+	// LFS is how to handle Git LFS objects. 'skip' or 'fetch'. Please see Cloner.LFS.
+	LFS string
+	// Ref is a branch or tag to clone. Please see Collector.Ref.
+	Ref string
+	// Depth is the number of commits to fetch on shallow clone. Please see Cloner.Depth.
+	Depth int
+	// ShallowSince limits history on shallow clone. It is a date such as '2020-01-02', RFC3339 time
+	// or age such as '1y' or '90d'. Please see Cloner.ShallowSince.
+	ShallowSince string
+	// Backend is a name of backend to clone repositories. 'exec', 'go-git' or 'archive'. Please see
+	// NewCloneBackend and NewArchiveBackend.
+	Backend string
+	// SSHKnownHosts is a path to known_hosts file to verify host keys on cloning via SSH. Please see
+	// SSHConfig.KnownHosts.
+	SSHKnownHosts string
+	// SSHIdentity is a path to private key file to authenticate on cloning via SSH. Please see
+	// SSHConfig.Identity.
+	SSHIdentity string
+	// InsecureSSH disables verification of host keys on cloning via SSH. Please see
+	// SSHConfig.Insecure.
+	InsecureSSH bool
+	// Tokens are GitHub API tokens added to the token pool in addition to the token. Please see
+	// TokenPool.
+	Tokens []string
+	// AppID is an ID of GitHub App to authenticate with its installation tokens. Please see
+	// NewAppTokenSource.
+	AppID int64
+	// AppInstallationID is an ID of installation of the GitHub App.
+	AppInstallationID int64
+	// AppPrivateKey is a path to private key file of the GitHub App.
+	AppPrivateKey string
+	// Verbose indicates showing verbose logs such as where the token was read from.
+	Verbose bool
+	// Proxy is a URL of HTTP proxy to access GitHub API and remotes. Please see NetworkConfig.Proxy.
+	Proxy string
+	// CABundle is a path to PEM file of extra CA certificates. Please see NetworkConfig.CABundle.
+	CABundle string
+	// APITimeout is a timeout of each API request such as '30s'. Please see
+	// NetworkConfig.APITimeout.
+	APITimeout string
+	// CloneTimeout is a timeout of cloning one repository such as '10m'. Please see Cloner.Timeout.
+	CloneTimeout string
+	// StallTimeout is a duration to wait for progress of cloning one repository such as '60s'.
+	// Please see Cloner.StallTimeout.
+	StallTimeout string
+	// HTTPCache is a directory to cache responses of GitHub API. Empty means no cache. Please see
+	// HTTPCache.
+	HTTPCache string
+	// Record is a directory to record responses of GitHub API into. Please see Recorder.
+	Record string
+	// Replay is a directory of API responses recorded with Record. They are used instead of calling
+	// GitHub API. Please see Replayer.
+	Replay string
+}
+
+// network creates network configuration from the options. It returns nil when nothing is
+// configured.
+func (c *CLI) network() (*NetworkConfig, error) {
+	if c.Proxy == "" && c.CABundle == "" && c.APITimeout == "" {
+		return nil, nil
+	}
+	n := &NetworkConfig{Proxy: c.Proxy, CABundle: c.CABundle}
+	if c.APITimeout != "" {
+		d, err := time.ParseDuration(c.APITimeout)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid API timeout: %v", err)
+		}
+		n.APITimeout = d
+	}
+	if err := n.Validate(); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// tokenPool creates a token pool from the token, additional tokens and GitHub App. It returns nil
+// when no token is given or only the token is given since NewCollector handles it.
+func (c *CLI) tokenPool(base http.RoundTripper) (*TokenPool, error) {
+	app := c.AppID != 0 || c.AppInstallationID != 0 || c.AppPrivateKey != ""
+	if len(c.Tokens) == 0 && !app {
+		return nil, nil
+	}
+
+	srcs := []oauth2.TokenSource{}
+	for _, t := range append([]string{c.token}, c.Tokens...) {
+		if t != "" {
+			srcs = append(srcs, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: t}))
+		}
+	}
+	if app {
+		b, err := ioutil.ReadFile(c.AppPrivateKey)
+		if err != nil {
+			return nil, fmt.Errorf("Could not read private key of GitHub App: %v", err)
+		}
+		src, err := NewAppTokenSource(c.AppID, c.AppInstallationID, b, base)
+		if err != nil {
+			return nil, err
+		}
+		srcs = append(srcs, src)
+	}
+	return NewTokenPool(srcs...), nil
+}
+
+func validateSlug(slug string) error {
+	ss := strings.Split(slug, "/")
+	if len(ss) != 2 || ss[0] == "" || ss[1] == "" {
+		return fmt.Errorf("Repository must be in 'owner/name' format but got '%s'", slug)
+	}
+	return nil
+}
+
+// validateSort checks the sort field and the order. 'merged' is true when results of multiple queries
+// or the repository list are merged and sorted again locally.
+func validateSort(sort, order string, code, merged bool) error {
+	switch order {
+	case "", "asc", "desc":
+	default:
+		return fmt.Errorf("Order must be 'asc' or 'desc' but got '%s'", order)
+	}
+	if order != "" && sort == "" {
+		return errors.New("Order cannot be specified without sort")
+	}
+	if code {
+		if sort != "" && sort != "indexed" {
+			return fmt.Errorf("Code search can only be sorted by 'indexed' but got '%s'", sort)
+		}
+		return nil
+	}
+	switch sort {
+	case "", "stars", "forks", "updated":
+		return nil
+	case "help-wanted-issues":
+		if merged {
+			return errors.New("Results of multiple queries or repositories cannot be sorted by 'help-wanted-issues' since search results do not contain the number of help wanted issues")
+		}
+		return nil
+	default:
+		return fmt.Errorf("Sort must be one of 'stars', 'forks', 'updated' and 'help-wanted-issues' but got '%s'", sort)
+	}
+}
+
+// parseShallowSince parses the date to limit history and returns it in RFC3339 format.
+func parseShallowSince(s string, now time.Time) (string, error) {
+	for _, l := range []string{"2006-01-02", time.RFC3339} {
+		if t, err := time.Parse(l, s); err == nil {
+			return t.UTC().Format(time.RFC3339), nil
+		}
+	}
+	if d, ok := parseAge(s); ok {
+		return now.Add(-d).UTC().Format(time.RFC3339), nil
+	}
+	return "", fmt.Errorf("Shallow-since must be a date such as '2020-01-02', RFC3339 time or age such as '1y' or '90d' but got '%s'", s)
 }
 
 func (c *CLI) ensureReposDir() error {
@@ -41,31 +246,492 @@ func (c *CLI) ensureReposDir() error {
 	return nil
 }
 
-// Run processes github-clone-all with given options.
-func (c *CLI) Run() (err error) {
-	if err = c.ensureReposDir(); err != nil {
-		return
+// cliConfig is configuration of a collector parsed from options.
+type cliConfig struct {
+	filter       *Filter
+	layout       *Layout
+	mode         string
+	since        string
+	backend      CloneBackend
+	network      *NetworkConfig
+	cloneTimeout time.Duration
+	stallTimeout time.Duration
+	sshConfig    *SSHConfig
+	maxSize      int64
+	budget       *DiskBudget
+}
+
+// config validates options and parses them. It has no side effect such as looking up tokens or
+// reading private key of GitHub App so that options can be checked before running.
+func (c *CLI) config() (*cliConfig, error) {
+	if c.query == "" && len(c.Queries) == 0 && len(c.Repos) == 0 {
+		return nil, errors.New("Query or repository cannot be empty")
+	}
+	for _, r := range c.Repos {
+		if err := validateSlug(r); err != nil {
+			return nil, err
+		}
+	}
+	if c.MatchedOnly && !c.Code {
+		return nil, errors.New("Extracting matched files is only available with code search")
+	}
+	if c.PruneStale {
+		if err := c.checkPrunable(); err != nil {
+			return nil, err
+		}
+	}
+	if c.MatchedOnly && c.extract != nil {
+		return nil, errors.New("Extracting matched files cannot be used with regular expression to extract files")
+	}
+	sources := len(c.Queries)
+	if c.query != "" {
+		sources++
+	}
+	if len(c.Repos) > 0 {
+		sources++
+	}
+	merged := sources > 1
+	if err := validateSort(c.Sort, c.Order, c.Code, merged); err != nil {
+		return nil, err
+	}
+	if c.Concurrency < 0 {
+		return nil, fmt.Errorf("Concurrency must not be negative but got %d", c.Concurrency)
+	}
+	if c.Retries < 0 {
+		return nil, fmt.Errorf("Retries must not be negative but got %d", c.Retries)
+	}
+	switch c.Format {
+	case "", "text", "table", "json":
+	default:
+		return nil, fmt.Errorf("Format must be one of 'text', 'table' and 'json' but got '%s'", c.Format)
+	}
+	var filter *Filter
+	if c.Filter != "" {
+		if c.Code {
+			return nil, errors.New("Filter cannot be used with code search since results of code search do not contain metadata of repositories")
+		}
+		f, err := ParseFilter(c.Filter)
+		if err != nil {
+			return nil, err
+		}
+		filter = f
+	}
+	var layout *Layout
+	if c.Layout != "" {
+		l, err := ParseLayout(c.Layout)
+		if err != nil {
+			return nil, err
+		}
+		layout = l
+	}
+	if c.Quarantine != "" {
+		if err := c.pruner().validate(); err != nil {
+			return nil, err
+		}
+	}
+	mode := CloneCheckout
+	if c.Bare || c.Mirror {
+		if c.Bare && c.Mirror {
+			return nil, errors.New("Bare clone and mirror clone cannot be used together")
+		}
+		if c.extract != nil || c.MatchedOnly {
+			return nil, errors.New("Extracting files is not available with bare clone or mirror clone since they have no working tree")
+		}
+		mode = CloneBare
+		if c.Mirror {
+			mode = CloneMirror
+		}
+	}
+	if c.Submodules && mode != CloneCheckout {
+		return nil, errors.New("Submodules cannot be cloned with bare clone or mirror clone since they have no working tree")
+	}
+	if c.Depth < 0 {
+		return nil, fmt.Errorf("Depth must not be negative but got %d", c.Depth)
+	}
+	since := ""
+	if c.Depth > 0 || c.ShallowSince != "" {
+		if c.deep || mode != CloneCheckout {
+			return nil, errors.New("Depth and shallow-since cannot be used with deep clone, bare clone nor mirror clone since they clone full history")
+		}
+		if c.Depth > 0 && c.ShallowSince != "" {
+			return nil, errors.New("Only one of depth or shallow-since can be specified")
+		}
+		if c.ShallowSince != "" {
+			s, err := parseShallowSince(c.ShallowSince, time.Now())
+			if err != nil {
+				return nil, err
+			}
+			since = s
+		}
+	}
+	if c.Ref != "" && mode == CloneMirror {
+		return nil, errors.New("Ref cannot be specified with mirror clone since it clones all refs")
+	}
+	if strings.HasPrefix(c.Ref, ":") && c.Ref != RefLatestRelease && c.Ref != RefAllBranches {
+		return nil, fmt.Errorf("Ref must be a branch, a tag, '%s' or '%s' but got '%s'", RefLatestRelease, RefAllBranches, c.Ref)
+	}
+	switch c.LFS {
+	case "", LFSSkip, LFSFetch:
+	default:
+		return nil, fmt.Errorf("LFS must be 'skip' or 'fetch' but got '%s'", c.LFS)
+	}
+	var backend CloneBackend
+	if c.Backend == BackendArchive {
+		if c.deep || mode != CloneCheckout || c.Depth > 0 || c.ShallowSince != "" || c.Ref == RefAllBranches {
+			return nil, errors.New("Archive backend downloads files of one commit without history. Deep clone, bare clone, mirror clone, depth, shallow-since and all branches are not available with it")
+		}
+		if c.Submodules || c.LFS == LFSFetch || c.WithWiki {
+			return nil, errors.New("Submodules, Git LFS objects and wikis are not available with archive backend")
+		}
+	} else {
+		b, err := NewCloneBackend(c.Backend)
+		if err != nil {
+			return nil, err
+		}
+		backend = b
+	}
+	network, err := c.network()
+	if err != nil {
+		return nil, err
+	}
+	if c.Backend == BackendGoGit {
+		if c.ShallowSince != "" {
+			return nil, errors.New("Shallow-since is not available with go-git backend")
+		}
+		if c.LFS == LFSFetch {
+			return nil, errors.New("Fetching Git LFS objects is not available with go-git backend")
+		}
+		if c.Submodules && network != nil && (network.Proxy != "" || network.CABundle != "") {
+			return nil, errors.New("Proxy and CA bundle are not applied to submodules with go-git backend")
+		}
+	}
+	var cloneTimeout time.Duration
+	if c.CloneTimeout != "" {
+		d, err := time.ParseDuration(c.CloneTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid clone timeout: %v", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("Clone timeout must be positive but got %s", c.CloneTimeout)
+		}
+		cloneTimeout = d
+	}
+	var stallTimeout time.Duration
+	if c.StallTimeout != "" {
+		d, err := time.ParseDuration(c.StallTimeout)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid stall timeout: %v", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("Stall timeout must be positive but got %s", c.StallTimeout)
+		}
+		stallTimeout = d
+	}
+	var sshConfig *SSHConfig
+	if c.SSHKnownHosts != "" || c.SSHIdentity != "" || c.InsecureSSH {
+		if !c.ssh {
+			return nil, errors.New("SSH known hosts, SSH identity and insecure SSH are only available with SSH")
+		}
+		if c.Backend == BackendArchive {
+			return nil, errors.New("SSH options are not available with archive backend since it does not clone via SSH")
+		}
+		sshConfig = &SSHConfig{KnownHosts: c.SSHKnownHosts, Identity: c.SSHIdentity, Insecure: c.InsecureSSH}
+		if err := sshConfig.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	if c.Record != "" && c.Replay != "" {
+		return nil, errors.New("Recording and replaying API responses cannot be specified at the same time")
+	}
+	if app := c.AppID != 0 || c.AppInstallationID != 0 || c.AppPrivateKey != ""; app {
+		if c.AppID == 0 || c.AppInstallationID == 0 || c.AppPrivateKey == "" {
+			return nil, errors.New("App ID, app installation ID and app private key must be specified together to authenticate as GitHub App")
+		}
+		if c.Replay != "" {
+			return nil, errors.New("GitHub App is not available on replaying API responses since installation tokens are not recorded")
+		}
+	}
+	var maxSize int64
+	if c.MaxRepoSize != "" {
+		n, err := ParseSize(c.MaxRepoSize)
+		if err != nil {
+			return nil, err
+		}
+		maxSize = n
+	}
+	var budget *DiskBudget
+	if c.DiskBudget != "" {
+		b, err := ParseDiskBudget(c.DiskBudget)
+		if err != nil {
+			return nil, err
+		}
+		budget = b
+	}
+
+	return &cliConfig{
+		filter:       filter,
+		layout:       layout,
+		mode:         mode,
+		since:        since,
+		backend:      backend,
+		network:      network,
+		cloneTimeout: cloneTimeout,
+		stallTimeout: stallTimeout,
+		sshConfig:    sshConfig,
+		maxSize:      maxSize,
+		budget:       budget,
+	}, nil
+}
+
+// collector validates options and creates a collector from them.
+func (c *CLI) collector() (*Collector, error) {
+	cfg, err := c.config()
+	if err != nil {
+		return nil, err
+	}
+	var replayer *Replayer
+	if c.Replay != "" {
+		r, err := NewReplayer(c.Replay)
+		if err != nil {
+			return nil, err
+		}
+		replayer = r
+	}
+	var transport http.RoundTripper
+	if cfg.network != nil {
+		transport, err = cfg.network.Transport()
+		if err != nil {
+			return nil, err
+		}
+	}
+	pool, err := c.tokenPool(transport)
+	if err != nil {
+		return nil, err
 	}
+
 	col := NewCollector(c.query, c.token, c.dest, c.extract, c.count, c.dry, c.deep, c.ssh, nil)
-	_, _, err = col.Collect()
-	return
+	if cfg.network != nil {
+		if err := col.SetNetwork(cfg.network); err != nil {
+			return nil, err
+		}
+	}
+	if pool != nil {
+		col.SetTokenPool(pool)
+	}
+	if c.HTTPCache != "" {
+		col.SetHTTPCache(NewHTTPCache(c.HTTPCache))
+	}
+	if c.Record != "" {
+		col.SetRecorder(NewRecorder(c.Record))
+	}
+	if replayer != nil {
+		log.Println("Replaying API responses recorded in", c.Replay)
+		col.SetReplayer(replayer)
+	}
+	col.Code = c.Code
+	col.MatchedOnly = c.MatchedOnly
+	col.Filter = cfg.filter
+	col.Repos = c.Repos
+	col.Queries = c.Queries
+	col.Sort = c.Sort
+	col.Order = c.Order
+	col.Concurrency = c.Concurrency
+	col.Retries = c.Retries
+	col.Format = c.Format
+	col.Layout = cfg.layout
+	col.MaxRepoSize = cfg.maxSize
+	col.Mode = cfg.mode
+	col.WithWiki = c.WithWiki
+	col.WithIssues = c.WithIssues
+	col.Submodules = c.Submodules
+	col.LFS = c.LFS
+	col.Ref = c.Ref
+	col.Depth = c.Depth
+	col.ShallowSince = cfg.since
+	col.Backend = cfg.backend
+	if c.Backend == BackendArchive {
+		col.Backend = NewArchiveBackend(col.client)
+	}
+	col.SSHConfig = cfg.sshConfig
+	col.CloneTimeout = cfg.cloneTimeout
+	col.StallTimeout = cfg.stallTimeout
+	col.DiskBudget = cfg.budget
+	return col, nil
+}
+
+// Run processes github-clone-all with given options.
+func (c *CLI) Run() error {
+	col, err := c.collector()
+	if err != nil {
+		return err
+	}
+	c.logAuth()
+	if err := c.ensureReposDir(); err != nil {
+		return err
+	}
+	if _, _, err := col.Collect(); err != nil {
+		return err
+	}
+	return c.pruneStale(col)
+}
+
+// logAuth shows how to authenticate. Where the token was read from is only shown in verbose mode.
+// The token itself is never shown.
+func (c *CLI) logAuth() {
+	if c.Verbose {
+		if c.token == "" {
+			log.Println("No GitHub API token was found. Calling API without authentication")
+		} else {
+			log.Println("Using GitHub API token from", c.tokenSource)
+		}
+	}
+	if c.InsecureSSH {
+		log.Println("Warning: Host keys are not verified on cloning via SSH since insecure SSH is enabled")
+	}
+}
+
+// checkPrunable returns an error when search results are truncated by count or repositories are
+// excluded by max repository size since repositories missing in the results would be pruned wrongly.
+func (c *CLI) checkPrunable() error {
+	if c.count > 0 {
+		return errors.New("Pruning is not available with count since repositories beyond the count would be pruned")
+	}
+	if c.MaxRepoSize != "" {
+		return errors.New("Pruning is not available with max repository size since skipped repositories would be pruned")
+	}
+	return nil
+}
+
+func (c *CLI) pruner() *Pruner {
+	return &Pruner{Dest: c.dest, Quarantine: c.Quarantine, Dry: c.dry}
+}
+
+// pruneStale prunes repositories which were not in search results of the collector when PruneStale
+// is enabled.
+func (c *CLI) pruneStale(col *Collector) error {
+	if !c.PruneStale {
+		return nil
+	}
+	pruned, err := c.pruner().Prune(col.matched)
+	if err != nil {
+		return err
+	}
+	if c.dry {
+		log.Printf("%d repositories would be pruned from '%s'\n", len(pruned), c.dest)
+	} else {
+		log.Printf("%d repositories were pruned from '%s'\n", len(pruned), c.dest)
+	}
+	return nil
+}
+
+// Update updates repositories in dest directory. When no query nor repository is given, repositories
+// recorded in the manifest of dest directory are updated. Otherwise repositories are searched and new
+// ones are cloned in addition.
+func (c *CLI) Update() error {
+	if c.query == "" && len(c.Queries) == 0 && len(c.Repos) == 0 {
+		m, err := LoadManifest(c.dest)
+		if err != nil {
+			return err
+		}
+		if len(m.Repos) == 0 {
+			return fmt.Errorf("No repository to update is recorded in '%s'", filepath.Join(c.dest, ManifestFile))
+		}
+		c.Repos = m.Slugs()
+	}
+	col, err := c.collector()
+	if err != nil {
+		return err
+	}
+	col.Update = true
+	c.logAuth()
+	if err := c.ensureReposDir(); err != nil {
+		return err
+	}
+	if _, _, err := col.Collect(); err != nil {
+		return err
+	}
+	return c.pruneStale(col)
+}
+
+// Prune removes repositories in dest directory which are no longer found by the search, or moves
+// them to Quarantine directory. It returns slugs of pruned repositories. When dry-run is enabled,
+// nothing is pruned and repositories to be pruned are returned.
+func (c *CLI) Prune() ([]string, error) {
+	if err := c.checkPrunable(); err != nil {
+		return nil, err
+	}
+	col, err := c.collector()
+	if err != nil {
+		return nil, err
+	}
+	c.logAuth()
+	slugs, err := col.Search()
+	if err != nil {
+		return nil, err
+	}
+	return c.pruner().Prune(slugs)
+}
+
+// ReadQueryFile reads queries from the file. Each line is one query. Empty lines and lines starting
+// with '#' are ignored.
+func ReadQueryFile(path string) ([]string, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	qs := []string{}
+	for _, l := range strings.Split(string(b), "\n") {
+		l = strings.TrimSpace(l)
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		qs = append(qs, l)
+	}
+	if len(qs) == 0 {
+		return nil, fmt.Errorf("No query was found in file '%s'", path)
+	}
+	return qs, nil
 }
 
 // NewCLI creates a new command line interface to run github-clone-all.
 // Query ('q' parameter) must not be empty.
 func NewCLI(token, query, dest, extract string, count int, dry bool, deep bool, ssh bool) (*CLI, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return nil, errors.New("Query cannot be empty")
+	}
+	c, err := newCLI(token, query, dest, extract, count, dry, deep, ssh)
+	if err != nil {
+		return nil, err
+	}
+	c.lookupToken()
+	return c, nil
+}
+
+// ResolveDest returns the directory to clone repositories into. When 'dest' is empty, it is 'repos'
+// in current working directory.
+func ResolveDest(dest string) (string, error) {
+	if dest != "" {
+		return dest, nil
+	}
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cwd, "repos"), nil
+}
+
+func newCLI(token, query, dest, extract string, count int, dry bool, deep bool, ssh bool) (*CLI, error) {
 	var err error
 
-	if token == "" {
-		token = os.Getenv("GITHUB_TOKEN")
+	source := ""
+	if token != "" {
+		source = "token option"
 	}
 
-	if dest == "" {
-		dest, err = os.Getwd()
-		if err != nil {
-			return nil, err
-		}
-		dest = filepath.Join(dest, "repos")
+	dest, err = ResolveDest(dest)
+	if err != nil {
+		return nil, err
 	}
 
 	var r *regexp.Regexp
@@ -76,10 +742,22 @@ func NewCLI(token, query, dest, extract string, count int, dry bool, deep bool,
 		}
 	}
 
-	query = strings.TrimSpace(query)
-	if query == "" {
-		return nil, errors.New("Query cannot be empty")
-	}
+	return &CLI{
+		token:       token,
+		tokenSource: source,
+		query:       query,
+		dest:        dest,
+		extract:     r,
+		count:       count,
+		dry:         dry,
+		deep:        deep,
+		ssh:         ssh,
+	}, nil
+}
 
-	return &CLI{token, query, dest, r, count, dry, deep, ssh}, nil
+// lookupToken looks up an API token from environment when it is not given explicitly.
+func (c *CLI) lookupToken() {
+	if c.token == "" {
+		c.token, c.tokenSource = resolveToken(tokenChain("github.com"))
+	}
 }
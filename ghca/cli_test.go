@@ -1,9 +1,12 @@
 package ghca
 
 import (
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewCLI(t *testing.T) {
@@ -176,3 +179,482 @@ func TestCannotRunCLI(t *testing.T) {
 		t.Fatal("Error should occur when file is already created")
 	}
 }
+
+func TestMatchedOnlyRequiresCode(t *testing.T) {
+	cli, err := NewCLI("token", "query", "", "", 0, true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.MatchedOnly = true
+	if err := cli.Run(); err == nil {
+		t.Fatal("Extracting matched files without code search should raise an error")
+	}
+
+	cli, err = NewCLI("token", "query", "", "foo", 0, true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Code = true
+	cli.MatchedOnly = true
+	if err := cli.Run(); err == nil {
+		t.Fatal("Extracting matched files with -extract should raise an error")
+	}
+}
+
+func TestValidateSort(t *testing.T) {
+	for _, tc := range []struct {
+		sort   string
+		order  string
+		code   bool
+		merged bool
+		ok     bool
+	}{
+		{"", "", false, false, true},
+		{"stars", "", false, false, true},
+		{"forks", "asc", false, false, true},
+		{"updated", "desc", false, false, true},
+		{"help-wanted-issues", "", false, false, true},
+		{"indexed", "asc", true, false, true},
+		{"stars", "", false, true, true},
+		{"", "asc", false, false, false},
+		{"stars", "up", false, false, false},
+		{"indexed", "", false, false, false},
+		{"stars", "", true, false, false},
+		{"help-wanted-issues", "", false, true, false},
+	} {
+		err := validateSort(tc.sort, tc.order, tc.code, tc.merged)
+		if tc.ok && err != nil {
+			t.Errorf("sort=%q order=%q code=%v merged=%v should be valid: %v", tc.sort, tc.order, tc.code, tc.merged, err)
+		}
+		if !tc.ok && err == nil {
+			t.Errorf("sort=%q order=%q code=%v merged=%v should be invalid", tc.sort, tc.order, tc.code, tc.merged)
+		}
+	}
+
+	cli, err := NewCLI("token", "foo", "", "", 0, true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Sort = "help-wanted-issues"
+	if _, err := cli.collector(); err != nil {
+		t.Fatal("Single query can be sorted by help wanted issues:", err)
+	}
+	cli.Queries = []string{"bar"}
+	if _, err := cli.collector(); err == nil || !strings.Contains(err.Error(), "help-wanted-issues") {
+		t.Error("Merged results should not be sorted by help wanted issues:", err)
+	}
+	cli.Queries = nil
+	cli.Repos = []string{"a/b"}
+	if _, err := cli.collector(); err == nil || !strings.Contains(err.Error(), "help-wanted-issues") {
+		t.Error("Results merged with repository list should not be sorted by help wanted issues:", err)
+	}
+}
+
+func TestReadQueryFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "ghca-queries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("language:vim\n\n# comment\n  filename:.vimrc  \n"); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	qs, err := ReadQueryFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(qs) != 2 || qs[0] != "language:vim" || qs[1] != "filename:.vimrc" {
+		t.Error("Unexpected queries:", qs)
+	}
+
+	if _, err := ReadQueryFile(filepath.Join("path", "to", "unknown")); err == nil {
+		t.Error("Not existing file should cause an error")
+	}
+}
+
+func TestBareAndMirrorOptions(t *testing.T) {
+	for _, tc := range []struct {
+		bare    bool
+		mirror  bool
+		extract string
+		want    string
+	}{
+		{true, true, "", "cannot be used together"},
+		{true, false, "foo", "no working tree"},
+		{false, true, "foo", "no working tree"},
+		{true, false, "", CloneBare},
+		{false, true, "", CloneMirror},
+	} {
+		cli, err := NewCLI("token", "query", "", tc.extract, 0, true, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.Bare = tc.bare
+		cli.Mirror = tc.mirror
+		col, err := cli.collector()
+		if err != nil {
+			if !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("Unexpected error for %+v: %s", tc, err)
+			}
+			continue
+		}
+		if col.Mode != tc.want {
+			t.Errorf("Mode should be %q but got %q", tc.want, col.Mode)
+		}
+	}
+}
+
+func TestSubmodulesAndLFSOptions(t *testing.T) {
+	cli, err := NewCLI("token", "query", "", "", 0, true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Mirror = true
+	cli.Submodules = true
+	if _, err := cli.collector(); err == nil {
+		t.Error("Submodules with mirror clone should cause an error")
+	}
+
+	cli.Mirror = false
+	cli.LFS = "pull"
+	if _, err := cli.collector(); err == nil {
+		t.Error("Unknown LFS mode should cause an error")
+	}
+
+	cli.LFS = LFSFetch
+	col, err := cli.collector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !col.Submodules || col.LFS != LFSFetch {
+		t.Error("Options were not mapped to collector:", col.Submodules, col.LFS)
+	}
+}
+
+func TestParseShallowSince(t *testing.T) {
+	now := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	for s, want := range map[string]string{
+		"2019-12-31":           "2019-12-31T00:00:00Z",
+		"2019-12-31T12:00:00Z": "2019-12-31T12:00:00Z",
+		"1d":                   "2020-02-29T00:00:00Z",
+	} {
+		have, err := parseShallowSince(s, now)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if have != want {
+			t.Errorf("'%s' should be parsed as '%s' but got '%s'", s, want, have)
+		}
+	}
+	if _, err := parseShallowSince("last year", now); err == nil {
+		t.Error("Invalid date should cause an error")
+	}
+}
+
+func TestDepthOptions(t *testing.T) {
+	for _, tc := range []struct {
+		deep  bool
+		depth int
+		since string
+	}{
+		{false, -1, ""},
+		{true, 10, ""},
+		{true, 0, "1y"},
+		{false, 10, "1y"},
+		{false, 0, "foo"},
+	} {
+		cli, err := NewCLI("token", "query", "", "", 0, true, tc.deep, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.Depth = tc.depth
+		cli.ShallowSince = tc.since
+		if _, err := cli.collector(); err == nil {
+			t.Errorf("Options %+v should cause an error", tc)
+		}
+	}
+}
+
+func TestBackendOption(t *testing.T) {
+	cli, err := NewCLI("token", "query", "", "", 0, true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Backend = "libgit2"
+	if _, err := cli.collector(); err == nil {
+		t.Error("Unknown backend should cause an error")
+	}
+
+	cli.Backend = BackendGoGit
+	cli.LFS = LFSFetch
+	if _, err := cli.collector(); err == nil {
+		t.Error("Fetching LFS objects with go-git backend should cause an error")
+	}
+	cli.LFS = ""
+	cli.ShallowSince = "1y"
+	if _, err := cli.collector(); err == nil {
+		t.Error("Shallow-since with go-git backend should cause an error")
+	}
+
+	cli.ShallowSince = ""
+	col, err := cli.collector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := col.Backend.(*goGitBackend); !ok {
+		t.Errorf("Backend should be go-git but got %T", col.Backend)
+	}
+}
+
+func TestArchiveBackendOption(t *testing.T) {
+	for _, f := range []func(c *CLI){
+		func(c *CLI) { c.deep = true },
+		func(c *CLI) { c.Mirror = true },
+		func(c *CLI) { c.Depth = 10 },
+		func(c *CLI) { c.Ref = RefAllBranches },
+		func(c *CLI) { c.Submodules = true },
+		func(c *CLI) { c.WithWiki = true },
+	} {
+		cli, err := NewCLI("token", "query", "", "", 0, true, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cli.Backend = BackendArchive
+		f(cli)
+		if _, err := cli.collector(); err == nil {
+			t.Errorf("Option should not be available with archive backend: %+v", cli)
+		}
+	}
+
+	cli, err := NewCLI("token", "query", "", "", 0, true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Backend = BackendArchive
+	col, err := cli.collector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, ok := col.Backend.(*archiveBackend); !ok || b.client != col.client {
+		t.Errorf("Archive backend should be created with API client but got %T", col.Backend)
+	}
+}
+
+func TestSSHOptions(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+	id := testIdentityFile(t, dir)
+
+	for _, tc := range []struct {
+		ssh bool
+		f   func(c *CLI)
+	}{
+		{false, func(c *CLI) { c.SSHIdentity = id }},
+		{false, func(c *CLI) { c.InsecureSSH = true }},
+		{true, func(c *CLI) { c.SSHKnownHosts = id; c.InsecureSSH = true }},
+		{true, func(c *CLI) { c.SSHIdentity = filepath.Join(dir, "not-existing") }},
+		{true, func(c *CLI) { c.SSHIdentity = id; c.Backend = BackendArchive }},
+	} {
+		cli, err := NewCLI("token", "query", "", "", 0, true, false, tc.ssh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tc.f(cli)
+		if _, err := cli.collector(); err == nil {
+			t.Errorf("Invalid SSH options should cause an error: %+v", cli)
+		}
+	}
+
+	cli, err := NewCLI("token", "query", "", "", 0, true, false, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.SSHKnownHosts = id
+	cli.SSHIdentity = id
+	col, err := cli.collector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := col.SSHConfig; c == nil || c.KnownHosts != id || c.Identity != id || c.Insecure {
+		t.Errorf("Unexpected SSH config: %+v", c)
+	}
+}
+
+func TestTokenPoolOptions(t *testing.T) {
+	cli, err := NewCLI("token", "query", "", "", 0, true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Tokens = []string{"token2", "token3"}
+	col, err := cli.collector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool := col.tokens; pool == nil || pool.Len() != 3 {
+		t.Errorf("All tokens should be in pool: %#v", col.tokens)
+	}
+
+	cli.AppID = 12
+	if _, err := cli.collector(); err == nil {
+		t.Error("App ID without installation ID and private key should cause an error")
+	}
+	cli.AppInstallationID = 42
+	cli.AppPrivateKey = "/path/to/not-existing.pem"
+	if _, err := cli.collector(); err == nil {
+		t.Error("Not existing private key should cause an error")
+	}
+}
+
+func TestTokenSource(t *testing.T) {
+	cli, err := NewCLI("token", "query", "", "", 0, true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cli.tokenSource != "token option" {
+		t.Error("Unexpected token source:", cli.tokenSource)
+	}
+
+	saved := os.Getenv("GH_TOKEN")
+	savedGitHub := os.Getenv("GITHUB_TOKEN")
+	os.Setenv("GITHUB_TOKEN", "")
+	os.Setenv("GH_TOKEN", "from-gh-env")
+	defer func() {
+		os.Setenv("GH_TOKEN", saved)
+		os.Setenv("GITHUB_TOKEN", savedGitHub)
+	}()
+	cli, err = NewCLI("", "query", "", "", 0, true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cli.token != "from-gh-env" || cli.tokenSource != "$GH_TOKEN" {
+		t.Errorf("Token should be read from $GH_TOKEN but got '%s' from '%s'", cli.token, cli.tokenSource)
+	}
+}
+
+func TestNetworkOptions(t *testing.T) {
+	for _, f := range []func(c *CLI){
+		func(c *CLI) { c.Proxy = "not a URL" },
+		func(c *CLI) { c.CABundle = "/path/to/not-existing.pem" },
+		func(c *CLI) { c.APITimeout = "30" },
+		func(c *CLI) { c.CloneTimeout = "ten minutes" },
+		func(c *CLI) { c.CloneTimeout = "-1m" },
+		func(c *CLI) { c.StallTimeout = "0s" },
+		func(c *CLI) { c.Backend = BackendGoGit; c.Submodules = true; c.Proxy = "http://proxy:8080" },
+	} {
+		cli, err := NewCLI("token", "query", "", "", 0, true, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f(cli)
+		if _, err := cli.collector(); err == nil {
+			t.Errorf("Invalid network options should cause an error: %+v", cli)
+		}
+	}
+
+	cli, err := NewCLI("token", "query", "", "", 0, true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Proxy = "http://proxy:8080"
+	cli.APITimeout = "30s"
+	cli.CloneTimeout = "10m"
+	cli.StallTimeout = "60s"
+	col, err := cli.collector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if col.network == nil || col.network.Proxy != "http://proxy:8080" || col.network.APITimeout != 30*time.Second {
+		t.Errorf("Unexpected network config: %+v", col.network)
+	}
+	if col.CloneTimeout != 10*time.Minute {
+		t.Error("Unexpected clone timeout:", col.CloneTimeout)
+	}
+	if col.StallTimeout != time.Minute {
+		t.Error("Unexpected stall timeout:", col.StallTimeout)
+	}
+	if col.tokens == nil || col.tokens.Base == nil {
+		t.Error("Token pool should send requests with configured transport")
+	}
+}
+
+func TestHTTPCacheOption(t *testing.T) {
+	cli, err := NewCLI("token", "query", "", "", 0, true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.HTTPCache = "/path/to/cache"
+	col, err := cli.collector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if col.cache == nil || col.cache.Dir != "/path/to/cache" {
+		t.Fatalf("Unexpected HTTP cache: %+v", col.cache)
+	}
+	if col.tokens == nil || col.tokens.Base != col.cache {
+		t.Error("Token pool should send requests via HTTP cache")
+	}
+}
+
+func TestRecordReplayOptions(t *testing.T) {
+	replay := filepath.Join("testdata", "replay", "user-rhysd")
+	for _, f := range []func(c *CLI){
+		func(c *CLI) { c.Record = "/path/to/rec"; c.Replay = replay },
+		func(c *CLI) { c.Replay = "/path/to/not-existing" },
+		func(c *CLI) { c.Replay = replay; c.AppID = 12 },
+	} {
+		cli, err := NewCLI("token", "query", "", "", 0, true, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f(cli)
+		if _, err := cli.collector(); err == nil {
+			t.Errorf("Invalid record or replay options should cause an error: %+v", cli)
+		}
+	}
+
+	cli, err := NewCLI("token", "query", "", "", 0, true, false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cli.Replay = replay
+	col, err := cli.collector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if col.replayer == nil || col.tokens == nil || col.tokens.Base != col.replayer {
+		t.Error("API should be called via replayer")
+	}
+
+	cli.Replay = ""
+	cli.Record = "/path/to/rec"
+	col, err = cli.collector()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if col.recorder == nil || col.tokens.Base != col.recorder {
+		t.Error("API responses should be recorded")
+	}
+}
+
+func TestPruneWithTruncatedResults(t *testing.T) {
+	for _, f := range []func(c *CLI){
+		func(c *CLI) { c.count = 10 },
+		func(c *CLI) { c.MaxRepoSize = "1GB" },
+	} {
+		cli, err := NewCLI("token", "query", "", "", 0, true, false, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f(cli)
+		if _, err := cli.Prune(); err == nil {
+			t.Errorf("Prune subcommand should be rejected: %+v", cli)
+		}
+		cli.PruneStale = true
+		if _, err := cli.collector(); err == nil {
+			t.Errorf("-prune should be rejected: %+v", cli)
+		}
+	}
+}
@@ -1,142 +1,1011 @@
 package ghca
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
 )
 
 const maxConcurrency = 4
 const maxBuffer = 1000
 
+// tmpDir is a directory in dest to clone repositories temporarily. The name is specific to this
+// tool not to conflict with user's files.
+const tmpDir = ".github-clone-all.tmp"
+
+// Clone modes of Cloner.Mode.
+const (
+	// CloneCheckout clones repositories with working trees. This is the default.
+	CloneCheckout = ""
+	// CloneBare clones repositories as bare repositories which have all branches and tags.
+	CloneBare = "bare"
+	// CloneMirror clones repositories as mirrors which have all refs and track them on update.
+	CloneMirror = "mirror"
+)
+
+// Modes of Cloner.LFS.
+const (
+	// LFSSkip does not download Git LFS objects. Pointer files remain in working trees. This is the
+	// default.
+	LFSSkip = "skip"
+	// LFSFetch downloads Git LFS objects after cloning or updating repositories.
+	LFSFetch = "fetch"
+)
+
+// Special refs for cloneJob.ref. ':' cannot be contained in Git ref names so they never conflict with
+// actual branches or tags.
+const (
+	// RefLatestRelease means the tag of the latest release of each repository.
+	RefLatestRelease = ":latest-release"
+	// RefAllBranches means all branches. Shallow clone fetches the latest commit of each branch.
+	RefAllBranches = ":all"
+)
+
+// sizeCheckInterval is an interval to check size of the repository being cloned
+const sizeCheckInterval = time.Second
+
+// ErrCloneTimeout is an error when cloning or updating a repository was aborted because it exceeded
+// Cloner.Timeout or made no progress for Cloner.StallTimeout. It can be checked with errors.Is.
+var ErrCloneTimeout = errors.New("timed out")
+
+// errStalled is a cause of ErrCloneTimeout when no progress was made for Cloner.StallTimeout.
+var errStalled = errors.New("no progress")
+
+// timeoutError is an error of Git operation aborted by Cloner.Timeout or Cloner.StallTimeout. It is
+// ErrCloneTimeout and its cause is context.DeadlineExceeded or errStalled.
+type timeoutError struct {
+	op    string
+	url   string
+	limit time.Duration
+	cause error
+}
+
+func (e *timeoutError) Error() string {
+	if e.cause == errStalled {
+		return fmt.Sprintf("Could not %s %s: %v since no progress was made for %s", e.op, e.url, ErrCloneTimeout, e.limit)
+	}
+	return fmt.Sprintf("Could not %s %s: %v after %s", e.op, e.url, ErrCloneTimeout, e.limit)
+}
+
+func (e *timeoutError) Is(target error) bool {
+	return target == ErrCloneTimeout
+}
+
+func (e *timeoutError) Unwrap() error {
+	return e.cause
+}
+
+// progressWriter is passed to backends as CloneOptions.Progress to record when the last progress
+// output arrived.
+type progressWriter struct {
+	// last is the last time when progress was made in Unix nanoseconds
+	last int64
+}
+
+func newProgressWriter() *progressWriter {
+	p := &progressWriter{}
+	p.touch()
+	return p
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.touch()
+	return len(b), nil
+}
+
+func (p *progressWriter) touch() {
+	atomic.StoreInt64(&p.last, time.Now().UnixNano())
+}
+
+// idle returns the duration since the last progress.
+func (p *progressWriter) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&p.last))
+}
+
 // Cloner is a git-clone worker to clone given repositories with workers in parallel.
 type Cloner struct {
-	git     string
 	dest    string
 	extract *regexp.Regexp
 	deep    bool
-	slugs   chan string
+	jobs    chan cloneJob
 	// Err is a receiver of errors which occurs while cloning repositories
 	Err chan error
 	wg  sync.WaitGroup
 	// ssh is a flag to use SSH for git-clone. By default, it's false and HTTPS is used.
 	ssh bool
+	// Retries is how many times cloning a repository is retried on failure.
+	Retries int
+	// Update indicates repositories already existing in dest are updated with git-fetch instead of
+	// being cloned. Repositories whose files were extracted are cloned again.
+	Update bool
+	// Layout is a layout of directories to clone repositories into. nil means DefaultLayout.
+	Layout *Layout
+	// Mode is a mode of cloning. One of CloneCheckout, CloneBare and CloneMirror. In bare and mirror
+	// modes, repositories are cloned into directories with '.git' suffix with full history and
+	// updated with 'git remote update --prune'.
+	Mode string
+	mu   sync.Mutex
+	// cloned is a map from slug to path of the repository relative to dest
+	cloned map[string]string
+	// shas is a map from slug to commit SHA of HEAD of the cloned repository
+	shas map[string]string
+	// claimed is a map from path relative to dest to slug of the repository to detect collisions
+	claimed map[string]string
+	// MaxSize is max size of one repository on disk in bytes. Cloning a repository which grows past
+	// it is aborted and the repository is skipped. 0 means unlimited.
+	MaxSize int64
+	// Budget is a disk budget of dest directory. Once it is exceeded, remaining repositories are
+	// skipped. nil means unlimited.
+	Budget *DiskBudget
+	// usage is approximate total size of dest directory in bytes
+	usage int64
+	// skipped is a map from slug to the reason why the repository was skipped
+	skipped map[string]string
+	// WithWiki indicates wikis of repositories which have them are also cloned into their sidecar
+	// directories.
+	WithWiki bool
+	// Issues exports issues and pull requests of repositories into their sidecar directories. nil
+	// means they are not exported.
+	Issues *IssueExporter
+	// wikis is the number of cloned wikis
+	wikis int
+	// exports is the number of repositories whose issues were exported
+	exports int
+	// Submodules indicates submodules are cloned recursively. When shallow clone is used, submodules
+	// are also cloned shallowly.
+	Submodules bool
+	// Depth is the number of commits to fetch on shallow clone. 0 means 1. It is ignored when deep
+	// clone is used.
+	Depth int
+	// ShallowSince is a date to limit history on shallow clone. Commits after the date are fetched.
+	// When it is set, Depth is ignored. Update also fetches history with the same depth or date so
+	// shallow repositories are deepened consistently.
+	ShallowSince string
+	// LFS is how to handle Git LFS objects. LFSSkip or LFSFetch. Empty means LFSSkip. LFS smudge
+	// filter is always disabled while cloning so that results do not depend on whether Git LFS is
+	// installed.
+	LFS string
+	// Backend is a backend to run Git operations. By default, it runs git command.
+	Backend CloneBackend
+	// Tokens is a source of GitHub API tokens to authenticate cloning private repositories via HTTPS.
+	// A token is taken for each clone and passed to the backend. It is never embedded in URLs. It is
+	// not used with SSH. nil means anonymous access.
+	Tokens oauth2.TokenSource
+	// SSHConfig is configuration of SSH connections used when cloning via SSH. nil means the user's
+	// $GIT_SSH_COMMAND and SSH config are used.
+	SSHConfig *SSHConfig
+	// Network is configuration of proxy and CA certificates to access remotes. nil means the user's
+	// configuration is used as it is.
+	Network *NetworkConfig
+	// Timeout is a timeout of cloning or updating one repository. Git operation is aborted when it
+	// exceeds the timeout. 0 means no timeout.
+	Timeout time.Duration
+	// StallTimeout is a duration to wait for progress of cloning or updating one repository. Git
+	// operation is aborted when neither progress output nor growth of the directory is observed for
+	// the duration. 0 means stalls are not detected.
+	StallTimeout time.Duration
+	// caBundle is a path to CA bundle file for Git prepared from Network on starting workers
+	caBundle string
+	// timedOut is a map from slug to the error of the repository which was aborted by timeout
+	timedOut map[string]string
+	// temps are paths in tmpDir created by this cloner. They are removed on Shutdown
+	temps []string
+	// RemoteBase is a base URL of remote repositories to clone via HTTPS such as
+	// 'file:///path/to/mirrors/'. '{owner}/{name}.git' is appended to it. Empty means
+	// 'https://github.com/'. The token is only given to 'https://github.com'.
+	RemoteBase string
 }
 
 // NewCloner creates a new cloner instance. 'extract' parameter can be nil.
 func NewCloner(dest string, extract *regexp.Regexp, deep bool, ssh bool) *Cloner {
 	c := &Cloner{
-		git:     os.Getenv("GIT_EXECUTABLE_PATH"),
-		dest:    dest,
-		extract: extract,
-		slugs:   make(chan string, maxBuffer),
-		deep:    deep,
-		ssh:     ssh,
+		dest:     dest,
+		extract:  extract,
+		jobs:     make(chan cloneJob, maxBuffer),
+		deep:     deep,
+		ssh:      ssh,
+		cloned:   map[string]string{},
+		shas:     map[string]string{},
+		claimed:  map[string]string{},
+		skipped:  map[string]string{},
+		timedOut: map[string]string{},
+		Backend:  newExecBackend(),
 	}
+	return c
+}
 
-	if c.git == "" {
-		c.git = "git"
-	}
+// cloneJob is a unit of work sent to workers.
+type cloneJob struct {
+	slug string
+	// repo is metadata of the repository used for rendering layout
+	repo *github.Repository
+	// files is a list of slash-separated paths relative to the repository root which should remain
+	// after cloning. nil means all files remain (or files matching to 'extract' remain).
+	files []string
+	// from is a path relative to dest where the repository was cloned before it was renamed or
+	// transferred. Empty means it was not renamed.
+	from string
+	// ref is a branch or tag to clone, or RefAllBranches. Empty means the default branch.
+	ref string
+}
 
-	return c
+func repoFromSlug(slug string) *github.Repository {
+	ss := strings.SplitN(slug, "/", 2)
+	r := &github.Repository{Owner: &github.User{Login: github.String(ss[0])}, FullName: github.String(slug)}
+	if len(ss) == 2 {
+		r.Name = github.String(ss[1])
+	}
+	return r
 }
 
 // Clone clones the repository. Format of 'slug' parameter is 'owner/name'.
 func (cl *Cloner) Clone(slug string) {
-	cl.slugs <- slug
+	cl.jobs <- cloneJob{slug: slug, repo: repoFromSlug(slug)}
 }
 
-func (cl *Cloner) newWorker() {
-	cl.wg.Add(1)
-	dest := cl.dest
-	git := cl.git
-	deep := cl.deep
-	env := append(
-		os.Environ(),
-		"GIT_TERMINAL_PROMPT=0",
-		"GIT_ASKPASS=",
-		"SSH_ASKPASS=",
-		"GIT_SSH_COMMAND=ssh -o StrictHostKeyChecking=no",
-	)
+// CloneFiles clones the repository and only leaves given files in it. Format of 'slug' parameter is
+// 'owner/name'. Each file path is slash-separated and relative to the root of the repository.
+func (cl *Cloner) CloneFiles(slug string, files []string) {
+	cl.jobs <- cloneJob{slug: slug, repo: repoFromSlug(slug), files: files}
+}
 
-	var extract *regexp.Regexp
-	if cl.extract != nil {
-		extract = cl.extract.Copy()
+// CloneRepo clones the repository. Metadata of the repository is used for rendering Layout. 'files'
+// is the same as CloneFiles and can be nil.
+func (cl *Cloner) CloneRepo(repo *github.Repository, files []string) {
+	cl.push(cloneJob{slug: repoSlug(repo), repo: repo, files: files})
+}
+
+func (cl *Cloner) push(job cloneJob) {
+	cl.jobs <- job
+}
+
+// Reserve reserves the path relative to dest for the repository. It is used to detect collisions
+// with repositories cloned in previous runs.
+func (cl *Cloner) Reserve(path, slug string) {
+	cl.mu.Lock()
+	cl.claimed[path] = slug
+	cl.mu.Unlock()
+}
+
+// claim claims the path relative to dest for the repository. It returns an error when the path is
+// already claimed by another repository.
+func (cl *Cloner) claim(path, slug string) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if s, ok := cl.claimed[path]; ok && s != slug {
+		return fmt.Errorf("Path '%s' for repository %s collides with repository %s", path, slug, s)
+	}
+	cl.claimed[path] = slug
+	return nil
+}
+
+func keepOnly(dir string, files []string) error {
+	keep := make(map[string]struct{}, len(files))
+	for _, f := range files {
+		keep[filepath.FromSlash(f)] = struct{}{}
+	}
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if _, ok := keep[rel]; !ok || info.Mode()&os.ModeSymlink != 0 {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+func (cl *Cloner) report(err error) {
+	if cl.Err != nil {
+		cl.Err <- err
+	}
+}
+
+func (cl *Cloner) url(slug string) string {
+	if cl.ssh {
+		return fmt.Sprintf("git@github.com:%s.git", slug)
+	}
+	if cl.RemoteBase != "" {
+		return fmt.Sprintf("%s%s.git", cl.RemoteBase, slug)
+	}
+	return fmt.Sprintf("https://github.com/%s.git", slug)
+}
+
+// Cloned returns a map from slug to path of repositories which were successfully cloned or updated.
+// Path is slash-separated and relative to dest directory. It should be called after Shutdown.
+func (cl *Cloner) Cloned() map[string]string {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return cl.cloned
+}
+
+func isGitRepo(dir string) bool {
+	s, err := os.Stat(filepath.Join(dir, ".git", "HEAD"))
+	if err == nil && !s.IsDir() {
+		return true
 	}
+	// Bare repository
+	s, err = os.Stat(filepath.Join(dir, "HEAD"))
+	if err != nil || s.IsDir() {
+		return false
+	}
+	s, err = os.Stat(filepath.Join(dir, "objects"))
+	return err == nil && s.IsDir()
+}
+
+func (cl *Cloner) bare() bool {
+	return cl.Mode == CloneBare || cl.Mode == CloneMirror
+}
+
+// render renders the path of the repository relative to dest with the layout. Bare repositories have
+// '.git' suffix.
+func (cl *Cloner) render(layout *Layout, repo *github.Repository, sha string) string {
+	p := layout.Render(repo, sha)
+	if cl.bare() {
+		p += ".git"
+	}
+	return p
+}
+
+func (cl *Cloner) token() string {
+	if cl.ssh || cl.Tokens == nil {
+		return ""
+	}
+	t, err := cl.Tokens.Token()
+	if err != nil {
+		log.Println("Could not get token to clone. Cloning without token:", err)
+		return ""
+	}
+	return t.AccessToken
+}
+
+func (cl *Cloner) sshConfig() *SSHConfig {
+	if !cl.ssh {
+		return nil
+	}
+	return cl.SSHConfig
+}
+
+// options returns options passed to the backend to clone the ref.
+func (cl *Cloner) options(ref string) *CloneOptions {
+	return &CloneOptions{
+		Ref:          ref,
+		Mode:         cl.Mode,
+		Deep:         cl.deep,
+		Depth:        cl.Depth,
+		ShallowSince: cl.ShallowSince,
+		Submodules:   cl.Submodules,
+		Token:        cl.token(),
+		SSH:          cl.sshConfig(),
+		Proxy:        cl.proxy(),
+		CABundle:     cl.caBundle,
+	}
+}
 
+func (cl *Cloner) proxy() string {
+	if cl.Network == nil {
+		return ""
+	}
+	return cl.Network.Proxy
+}
+
+// context returns a context to run one Git operation. It is canceled when Timeout is exceeded.
+func (cl *Cloner) context() (context.Context, context.CancelFunc) {
+	if cl.Timeout == 0 {
+		return context.WithCancel(context.Background())
+	}
+	return context.WithTimeout(context.Background(), cl.Timeout)
+}
+
+// gitUpdate updates the repository with the backend. 'ref' is the same as cloneJob.ref. When the ref
+// is not found, the default branch is fetched instead.
+func (cl *Cloner) gitUpdate(url, dir, ref string) error {
+	err := cl.watch("update", url, dir, cl.options(ref), cl.Backend.Update)
+	if err == nil {
+		return nil
+	}
+	if ref != "" && ref != RefAllBranches && errors.Is(err, ErrRefNotFound) {
+		log.Printf("Ref '%s' was not found in %s. Falling back to default branch\n", ref, url)
+		return cl.gitUpdate(url, dir, "")
+	}
+	log.Println("Failed to update", url, err)
+	return err
+}
+
+// watch runs the Git operation on the directory with the backend. The operation is canceled when the
+// directory grows past MaxSize, when Timeout is exceeded, or when neither progress output nor growth
+// of the directory is observed for StallTimeout. errTooLarge is returned on the first case and
+// timeoutError is returned on the others.
+func (cl *Cloner) watch(op, url, dir string, opts *CloneOptions, run func(ctx context.Context, url, dir string, opts *CloneOptions) error) error {
+	ctx, cancel := cl.context()
+	defer cancel()
+	if cl.MaxSize == 0 && cl.StallTimeout == 0 {
+		return cl.timedOutError(ctx, op, url, run(ctx, url, dir, opts))
+	}
+
+	progress := newProgressWriter()
+	o := *opts
+	o.Progress = progress
+	interval := sizeCheckInterval
+	if cl.StallTimeout > 0 && cl.StallTimeout/4 < interval {
+		interval = cl.StallTimeout / 4
+	}
+
+	done := make(chan struct{})
+	aborted := make(chan error, 1)
 	go func() {
-		defer cl.wg.Done()
-		for slug := range cl.slugs {
-			var url string
-			if cl.ssh {
-				url = fmt.Sprintf("git@github.com:%s.git", slug)
-			} else {
-				url = fmt.Sprintf("https://github.com/%s.git", slug)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		size := int64(-1)
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.C:
+				quiet := cl.StallTimeout > 0 && progress.idle() >= interval
+				if cl.MaxSize == 0 && !quiet {
+					continue
+				}
+				if s, err := dirSize(dir); err == nil {
+					if cl.MaxSize > 0 && s > cl.MaxSize {
+						aborted <- errTooLarge
+						cancel()
+						return
+					}
+					// Some Git operations such as 'git remote update' report no progress
+					if s != size {
+						size = s
+						progress.touch()
+					}
+				}
+				if cl.StallTimeout > 0 && progress.idle() > cl.StallTimeout {
+					aborted <- errStalled
+					cancel()
+					return
+				}
 			}
-			log.Println("Cloning", url)
+		}
+	}()
 
-			dir := filepath.FromSlash(fmt.Sprintf("%s/%s", dest, slug))
+	err := run(ctx, url, dir, &o)
+	close(done)
+	if err == nil {
+		return nil
+	}
+	select {
+	case cause := <-aborted:
+		if cause == errStalled {
+			return &timeoutError{op, url, cl.StallTimeout, cause}
+		}
+		return cause
+	default:
+	}
+	return cl.timedOutError(ctx, op, url, err)
+}
+
+// timedOutError returns timeoutError instead of the error of the operation when the context was
+// canceled by Timeout.
+func (cl *Cloner) timedOutError(ctx context.Context, op, url string, err error) error {
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		return &timeoutError{op, url, cl.Timeout, context.DeadlineExceeded}
+	}
+	return err
+}
+
+// gitClone clones the repository with the backend. 'ref' is the same as cloneJob.ref. When the ref is
+// not found, the default branch is cloned instead.
+func (cl *Cloner) gitClone(url, dir, ref string) error {
+	return cl.cloneWith(url, dir, cl.options(ref))
+}
+
+func (cl *Cloner) cloneWith(url, dir string, opts *CloneOptions) error {
+	var err error
+	for i := 0; i <= cl.Retries; i++ {
+		if i > 0 {
+			log.Println("Retrying to clone", url, "after failure:", err)
+			if err := os.RemoveAll(dir); err != nil {
+				return err
+			}
+		}
 
-			args := make([]string, 0, 5)
-			args = append(args, "clone")
-			if !deep {
-				args = append(args, "--depth=1", "--single-branch")
+		err = cl.watch("clone", url, dir, opts, cl.Backend.Clone)
+		if err == nil {
+			return nil
+		}
+		if err == errTooLarge {
+			os.RemoveAll(dir)
+			return fmt.Errorf("Could not clone %s: %w (%s)", url, err, formatSize(cl.MaxSize))
+		}
+		if errors.Is(err, ErrCloneTimeout) {
+			// Retrying would likely time out again
+			os.RemoveAll(dir)
+			return err
+		}
+		if opts.specificRef() && errors.Is(err, ErrRefNotFound) {
+			log.Printf("Ref '%s' was not found in %s. Falling back to default branch\n", opts.Ref, url)
+			if err := os.RemoveAll(dir); err != nil {
+				return err
 			}
-			args = append(args, url, dir)
+			o := *opts
+			o.Ref = ""
+			return cl.cloneWith(url, dir, &o)
+		}
+	}
 
-			cmd := exec.Command(git, args...)
-			cmd.Env = env
-			_, err := cmd.Output()
+	log.Println("Failed to clone", url, err)
+	return err
+}
 
+// keeper returns a function to report whether the file at the slash-separated path relative to the
+// repository root remains after cloning. It returns nil when all files remain. 'extract' is matched
+// in the same way as extractFiles.
+func keeper(files []string, extract *regexp.Regexp) func(string) bool {
+	if files != nil {
+		keep := make(map[string]struct{}, len(files))
+		for _, f := range files {
+			keep[f] = struct{}{}
+		}
+		return func(path string) bool {
+			_, ok := keep[path]
+			return ok
+		}
+	}
+	if extract != nil {
+		return func(path string) bool {
+			return extract.MatchString(path)
+		}
+	}
+	return nil
+}
+
+// extractFiles removes files in the repository cloned into 'dir' which do not match 'extract'. The
+// regular expression is matched against the slash-separated path relative to the repository root so
+// that the result does not depend on where the repository was cloned.
+func extractFiles(dir string, extract *regexp.Regexp) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		if (info.Mode()&os.ModeSymlink != 0) || !extract.MatchString(filepath.ToSlash(rel)) {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// follow moves the directory of the repository cloned at the old path before it was renamed or
+// transferred to the path for the current slug, and points its remote to the new URL. It returns the
+// new path relative to dest, or an empty string when nothing was moved.
+func (cl *Cloner) follow(job cloneJob, layout *Layout, url string) (string, error) {
+	from := filepath.Join(cl.dest, filepath.FromSlash(job.from))
+	if !isGitRepo(from) {
+		return "", nil
+	}
+
+	sha := ""
+	if layout.NeedsSHA() {
+		s, err := cl.Backend.HeadSHA(from)
+		if err != nil {
+			return "", err
+		}
+		sha = s
+	}
+	rel := cl.render(layout, job.repo, sha)
+	if rel == job.from {
+		// Path does not depend on slug (e.g. '{id}'). Only the remote URL needs to be updated
+		cl.Reserve(rel, job.slug)
+	} else {
+		if err := cl.claim(rel, job.slug); err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(filepath.Join(cl.dest, filepath.FromSlash(rel))); err == nil {
+			return "", fmt.Errorf("Could not move %s to '%s' since the directory already exists", job.from, rel)
+		}
+	}
+
+	if err := cl.Backend.SetRemoteURL(from, url); err != nil {
+		return "", err
+	}
+
+	if rel != job.from {
+		to := filepath.Join(cl.dest, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return "", err
+		}
+		if err := os.Rename(from, to); err != nil {
+			return "", err
+		}
+		removeEmptyParents(cl.dest, from)
+		log.Println("Moved", from, "to", to)
+		side := filepath.Join(cl.dest, filepath.FromSlash(sidecarDir(job.from)))
+		if _, err := os.Stat(side); err == nil {
+			if err := os.Rename(side, filepath.Join(cl.dest, filepath.FromSlash(sidecarDir(rel)))); err != nil {
+				return "", err
+			}
+		}
+	}
+	return rel, nil
+}
+
+// fetchLFS downloads Git LFS objects of the repository when LFS is LFSFetch.
+func (cl *Cloner) fetchLFS(url, dir string) error {
+	if cl.LFS != LFSFetch {
+		return nil
+	}
+	ctx, cancel := cl.context()
+	defer cancel()
+	return cl.Backend.FetchLFS(ctx, url, dir, cl.options(""))
+}
+
+// checkSize checks size of the cloned repository and accounts it as usage of dest directory.
+func (cl *Cloner) checkSize(url, dir string) error {
+	if cl.MaxSize == 0 && (cl.Budget == nil || cl.Budget.MaxUsage == 0) {
+		return nil
+	}
+	size, err := dirSize(dir)
+	if err != nil {
+		return err
+	}
+	if cl.MaxSize > 0 && size > cl.MaxSize {
+		os.RemoveAll(dir)
+		return fmt.Errorf("Could not clone %s: %w (%s)", url, errTooLarge, formatSize(cl.MaxSize))
+	}
+	cl.mu.Lock()
+	cl.usage += size
+	cl.mu.Unlock()
+	return nil
+}
+
+// overBudget returns the reason when the disk budget is exceeded. Otherwise it returns an empty
+// string.
+func (cl *Cloner) overBudget() (string, error) {
+	if cl.Budget == nil {
+		return "", nil
+	}
+	cl.mu.Lock()
+	usage := cl.usage
+	cl.mu.Unlock()
+	return cl.Budget.exceeded(cl.dest, usage)
+}
+
+func (cl *Cloner) skip(slug, reason string) {
+	log.Printf("Skipped %s: %s\n", slug, reason)
+	cl.mu.Lock()
+	cl.skipped[slug] = reason
+	cl.mu.Unlock()
+}
+
+// timeout records the repository was aborted by timeout.
+func (cl *Cloner) timeout(slug string, err error) {
+	log.Printf("Timed out %s: %v\n", slug, err)
+	cl.mu.Lock()
+	cl.timedOut[slug] = err.Error()
+	cl.mu.Unlock()
+	cl.report(err)
+}
+
+// cloneWiki clones or updates the wiki of the repository in the sidecar directory.
+func (cl *Cloner) cloneWiki(slug, side string) error {
+	url := cl.url(slug + ".wiki")
+	dir := filepath.Join(side, "wiki")
+	if cl.bare() {
+		dir += ".git"
+	}
+	if cl.Update && isGitRepo(dir) {
+		log.Println("Updating", url)
+		return cl.gitUpdate(url, dir, "")
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(side, 0755); err != nil {
+		return err
+	}
+	log.Println("Cloning", url)
+	return cl.gitClone(url, dir, "")
+}
+
+// sidecar clones the wiki and exports issues of the cloned repository into its sidecar directory.
+func (cl *Cloner) sidecar(job cloneJob) {
+	if !cl.WithWiki && cl.Issues == nil {
+		return
+	}
+	cl.mu.Lock()
+	rel, ok := cl.cloned[job.slug]
+	cl.mu.Unlock()
+	if !ok {
+		return
+	}
+	side := filepath.Join(cl.dest, filepath.FromSlash(sidecarDir(rel)))
+
+	if cl.WithWiki && job.repo.GetHasWiki() {
+		// has_wiki is true even if no page is created. Then the wiki repository does not exist
+		if err := cl.cloneWiki(job.slug, side); err != nil {
+			log.Println("Could not clone wiki of", job.slug, err)
+		} else {
+			cl.mu.Lock()
+			cl.wikis++
+			cl.mu.Unlock()
+		}
+	}
+
+	if cl.Issues != nil {
+		if err := cl.Issues.Export(job.repo, side); err != nil {
+			cl.report(err)
+		} else {
+			cl.mu.Lock()
+			cl.exports++
+			cl.mu.Unlock()
+		}
+	}
+}
+
+// Sidecars returns the number of cloned wikis and the number of repositories whose issues were
+// exported. It should be called after Shutdown.
+func (cl *Cloner) Sidecars() (int, int) {
+	return cl.wikis, cl.exports
+}
+
+// SHAs returns a map from slug to commit SHA of HEAD of repositories which were cloned or updated. It
+// should be called after Shutdown.
+func (cl *Cloner) SHAs() map[string]string {
+	return cl.shas
+}
+
+// Skipped returns a map from slug to the reason of repositories which were skipped because of MaxSize
+// or Budget. It should be called after Shutdown.
+func (cl *Cloner) Skipped() map[string]string {
+	return cl.skipped
+}
+
+// TimedOut returns a map from slug to the error of repositories whose cloning or updating was aborted
+// because of Timeout or StallTimeout. It should be called after Shutdown.
+func (cl *Cloner) TimedOut() map[string]string {
+	return cl.timedOut
+}
+
+func (cl *Cloner) cloneRepo(job cloneJob, extract *regexp.Regexp) error {
+	slug := job.slug
+	url := cl.url(slug)
+	log.Println("Cloning", url)
+
+	layout := cl.Layout
+	if layout == nil {
+		layout, _ = ParseLayout(DefaultLayout)
+	}
+
+	if job.from != "" {
+		moved, err := cl.follow(job, layout, url)
+		if err != nil {
+			return err
+		}
+		if moved != "" && !cl.Update {
+			// Directory was moved. Nothing to clone
+			cl.done(slug, moved, "")
+			log.Println("Followed:", slug)
+			return nil
+		}
+	}
+
+	var rel, dir string
+	if layout.NeedsSHA() {
+		// Path cannot be determined until cloning. Clone into temporary directory at first
+		dir = filepath.Join(cl.dest, tmpDir, strings.Replace(slug, "/", "__", -1))
+		if cl.bare() {
+			dir += ".git"
+		}
+		cl.addTemp(dir)
+		if err := os.RemoveAll(dir); err != nil {
+			return err
+		}
+	} else {
+		rel = cl.render(layout, job.repo, "")
+		if err := cl.claim(rel, slug); err != nil {
+			return err
+		}
+		dir = filepath.Join(cl.dest, filepath.FromSlash(rel))
+	}
+
+	if cl.Update && rel != "" && job.files == nil && extract == nil && isGitRepo(dir) {
+		log.Println("Updating", url)
+		if err := cl.gitUpdate(url, dir, job.ref); err != nil {
+			return err
+		}
+		if err := cl.fetchLFS(url, dir); err != nil {
+			return err
+		}
+		sha, err := cl.Backend.HeadSHA(dir)
+		if err != nil {
+			return err
+		}
+		cl.done(slug, rel, sha)
+		log.Println("Updated:", slug)
+		return nil
+	}
+
+	// replaced is a directory replaced with the clone on success
+	replaced := ""
+	if cl.Update && rel != "" {
+		// Repositories whose files were extracted or downloaded as archives cannot be updated with
+		// git. Clone them again into a temporary directory next to them and replace them only on
+		// success so that existing files remain when cloning fails.
+		if _, err := os.Stat(dir); err == nil {
+			tmp, err := ioutil.TempDir(filepath.Dir(dir), "."+filepath.Base(dir)+".update-")
 			if err != nil {
-				log.Println("Failed to clone", url, err)
-				stderr := ""
-				if err, ok := err.(*exec.ExitError); ok {
-					stderr = string(err.Stderr)
-				}
-				cl.Err <- fmt.Errorf("Could not clone %s: %v\nstderr: %s", url, err, stderr)
-				continue
+				return err
 			}
+			defer os.RemoveAll(tmp)
+			replaced, dir = dir, tmp
+		}
+	}
+	opts := cl.options(job.ref)
+	// Backends which write files directly such as archive backend do not write unmatched files
+	opts.Keep = keeper(job.files, extract)
+	if err := cl.cloneWith(url, dir, opts); err != nil {
+		return err
+	}
+	if err := cl.fetchLFS(url, dir); err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	if err := cl.checkSize(url, dir); err != nil {
+		return err
+	}
+	// Get HEAD before extracting files since .git directory is removed
+	sha, err := cl.Backend.HeadSHA(dir)
+	if err != nil {
+		return err
+	}
 
-			if extract != nil {
-				if err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-					if err != nil {
-						return err
-					}
-					if info.IsDir() {
-						return nil
-					}
-					if (info.Mode()&os.ModeSymlink != 0) || !extract.MatchString(path) {
-						return os.Remove(path)
-					}
-					return nil
-				}); err != nil {
-					log.Println("Failed to extract files", slug, extract.String(), err)
-					if cl.Err != nil {
-						cl.Err <- err
-					}
-					return
+	if replaced != "" {
+		if err := os.RemoveAll(replaced); err != nil {
+			return err
+		}
+		if err := os.Rename(dir, replaced); err != nil {
+			return err
+		}
+		dir = replaced
+	}
+
+	if layout.NeedsSHA() {
+		rel = cl.render(layout, job.repo, sha)
+		if err := cl.claim(rel, slug); err != nil {
+			os.RemoveAll(dir)
+			return err
+		}
+		to := filepath.Join(cl.dest, filepath.FromSlash(rel))
+		if isGitRepo(to) {
+			// The same commit was already cloned
+			log.Println("Already cloned:", rel)
+			cl.done(slug, rel, sha)
+			return os.RemoveAll(dir)
+		}
+		if err := os.RemoveAll(to); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(dir, to); err != nil {
+			return err
+		}
+		dir = to
+	}
+
+	if job.files != nil {
+		if err := keepOnly(dir, job.files); err != nil {
+			log.Println("Failed to extract matched files", slug, err)
+			return err
+		}
+	} else if extract != nil {
+		if err := extractFiles(dir, extract); err != nil {
+			log.Println("Failed to extract files", slug, extract.String(), err)
+			return err
+		}
+	}
+
+	cl.done(slug, rel, sha)
+	log.Println("Cloned:", slug)
+	return nil
+}
+
+// done records the repository was cloned into the path. Empty 'sha' means HEAD is unknown.
+func (cl *Cloner) done(slug, path, sha string) {
+	cl.mu.Lock()
+	cl.cloned[slug] = path
+	if sha != "" {
+		cl.shas[slug] = sha
+	}
+	cl.mu.Unlock()
+}
+
+func (cl *Cloner) newWorker() {
+	cl.wg.Add(1)
+	var extract *regexp.Regexp
+	if cl.extract != nil {
+		extract = cl.extract.Copy()
+	}
+
+	go func() {
+		defer cl.wg.Done()
+		for job := range cl.jobs {
+			reason, err := cl.overBudget()
+			if err != nil {
+				cl.report(err)
+				continue
+			}
+			if reason != "" {
+				cl.skip(job.slug, reason)
+				continue
+			}
+			if err := cl.cloneRepo(job, extract); err != nil {
+				if errors.Is(err, errTooLarge) {
+					cl.skip(job.slug, err.Error())
+				} else if errors.Is(err, ErrCloneTimeout) {
+					cl.timeout(job.slug, err)
+				} else {
+					cl.report(err)
 				}
+				continue
 			}
-
-			log.Println("Cloned:", slug)
+			cl.sidecar(job)
 		}
 	}()
 }
 
 // Start starts underlying workers and makes ready for running.
-// Parameter 'para' indicates how many workers should be used.a
-// Max number is '# of CPU - 1' and 0 indicates using the default value.
+// Parameter 'para' indicates how many workers should be used.
+// Max number is '# of CPU - 1' and 0 indicates using the default value. At least one worker is started.
 func (cl *Cloner) Start(para int) {
 	auto := runtime.NumCPU() - 1
+	if auto < 1 {
+		auto = 1
+	}
 	if para == 0 || para > auto {
 		para = auto
 	}
+	if cl.Budget != nil && cl.Budget.MaxUsage > 0 {
+		if s, err := dirSize(cl.dest); err == nil {
+			cl.usage = s
+		}
+	}
+	if cl.Network != nil && cl.Network.CABundle != "" {
+		p, err := cl.Network.writeGitCABundle(filepath.Join(cl.dest, tmpDir))
+		if err != nil {
+			log.Println("Could not prepare CA bundle for Git. Using", cl.Network.CABundle, "as it is:", err)
+			p = cl.Network.CABundle
+		} else {
+			cl.addTemp(p)
+		}
+		cl.caBundle = p
+	}
 	log.Println("Start to clone with", para, "workers")
 	for i := 0; i < para; i++ {
 		cl.newWorker()
@@ -145,9 +1014,27 @@ func (cl *Cloner) Start(para int) {
 
 // Shutdown stops all workers and waits until all of current tasks are completed.
 func (cl *Cloner) Shutdown() {
-	close(cl.slugs)
+	close(cl.jobs)
 	cl.wg.Wait()
+	cl.removeTemps()
 	if cl.Err != nil {
 		close(cl.Err)
 	}
 }
+
+// addTemp remembers the path in tmpDir to remove it on Shutdown.
+func (cl *Cloner) addTemp(path string) {
+	cl.mu.Lock()
+	cl.temps = append(cl.temps, path)
+	cl.mu.Unlock()
+}
+
+// removeTemps removes paths in tmpDir created by this cloner. tmpDir itself is removed only when it
+// is empty so that files not created by this cloner are never removed.
+func (cl *Cloner) removeTemps() {
+	for _, p := range cl.temps {
+		os.RemoveAll(p)
+	}
+	cl.temps = nil
+	os.Remove(filepath.Join(cl.dest, tmpDir))
+}
@@ -1,18 +1,23 @@
 package ghca
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewCloner(t *testing.T) {
 	c := NewCloner("/path/to/dest", nil, true, true)
-	if c.git != "git" {
-		t.Error("Git command should be initialized as 'git' by default:", c.git)
+	if b, ok := c.Backend.(*execBackend); !ok || b.git != "git" {
+		t.Error("Git command should be initialized as 'git' by default:", c.Backend)
 	}
 	if c.dest != "/path/to/dest" {
 		t.Error("Distination to clone should be set to given path:", c.dest)
@@ -26,8 +31,8 @@ func TestNewCloner(t *testing.T) {
 
 	os.Setenv("GIT_EXECUTABLE_PATH", "/path/to/git")
 	c = NewCloner("/path/to/dest", nil, false, false)
-	if c.git != "/path/to/git" {
-		t.Error("Git command should respect environment variable $GIT_EXECUTABLE_PATH:", c.git)
+	if b := c.Backend.(*execBackend); b.git != "/path/to/git" {
+		t.Error("Git command should respect environment variable $GIT_EXECUTABLE_PATH:", b.git)
 	}
 
 	os.Setenv("GIT_EXECUTABLE_PATH", "")
@@ -207,3 +212,364 @@ func TestCloneSSH(t *testing.T) {
 		t.Fatal("Error did not occur")
 	}
 }
+
+func TestExtractFilesRelativePath(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+	repo := filepath.Join(dir, "plugin", "r")
+	if err := os.MkdirAll(filepath.Join(repo, "plugin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	testWriteFile(t, repo, "a.vim", "")
+	testWriteFile(t, filepath.Join(repo, "plugin"), "b.vim", "")
+
+	re := regexp.MustCompile(`^plugin/`)
+	if err := extractFiles(repo, re); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(repo, "a.vim")); err == nil {
+		t.Error("File should be matched by path relative to repository root")
+	}
+	if _, err := os.Stat(filepath.Join(repo, "plugin", "b.vim")); err != nil {
+		t.Error("Matched file was removed:", err)
+	}
+
+	keep := keeper(nil, re)
+	if keep("a.vim") || !keep("plugin/b.vim") {
+		t.Error("Keeper should match in the same way as extracting files")
+	}
+}
+
+func TestKeepOnlyMatchedFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ghca-keep-only")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, f := range []string{"a.yml", "sub/a.yml", "sub/b.txt", "c.txt"} {
+		p := filepath.Join(dir, filepath.FromSlash(f))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := keepOnly(dir, []string{"a.yml", "sub/a.yml"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, f := range []string{"a.yml", "sub/a.yml"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f))); err != nil {
+			t.Error("Matched file was removed:", f)
+		}
+	}
+	for _, f := range []string{"sub/b.txt", "c.txt"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(f))); err == nil {
+			t.Error("Unmatched file remains:", f)
+		}
+	}
+}
+
+func TestUpdateMirror(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	src := testGitRepo(t, filepath.Join(dir, ".src"), "first")
+	mirror := filepath.Join(dir, "a", "b.git")
+	if out, err := exec.Command("git", "clone", "-q", "--mirror", src, mirror).CombinedOutput(); err != nil {
+		t.Fatal(err, string(out))
+	}
+	if !isGitRepo(mirror) {
+		t.Fatal("Mirror repository should be regarded as a Git repository")
+	}
+	testGitCommit(t, src, "second")
+
+	cl := NewCloner(dir, nil, false, false)
+	cl.Mode = CloneMirror
+	if err := cl.gitUpdate(src, mirror, ""); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("git", "-C", mirror, "log", "--format=%s").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := strings.Fields(string(out)); len(s) != 2 || s[0] != "second" {
+		t.Error("Mirror should be updated with 'git remote update':", s)
+	}
+}
+
+func TestRenderBarePath(t *testing.T) {
+	l, err := ParseLayout(DefaultLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := NewCloner("dest", nil, false, false)
+	repo := repoFromSlug("a/b")
+	if p := cl.render(l, repo, ""); p != "a/b" {
+		t.Error("Unexpected path:", p)
+	}
+	cl.Mode = CloneBare
+	if p := cl.render(l, repo, ""); p != "a/b.git" {
+		t.Error("Bare repository should have '.git' suffix:", p)
+	}
+}
+
+func TestCloneArgs(t *testing.T) {
+	for _, tc := range []struct {
+		deep       bool
+		mode       string
+		submodules bool
+		want       string
+	}{
+		{false, CloneCheckout, false, "clone --depth=1 --single-branch u d"},
+		{true, CloneCheckout, false, "clone u d"},
+		{false, CloneCheckout, true, "clone --depth=1 --single-branch --recurse-submodules --shallow-submodules u d"},
+		{true, CloneCheckout, true, "clone --recurse-submodules u d"},
+		{false, CloneBare, true, "clone --bare u d"},
+		{false, CloneMirror, false, "clone --mirror u d"},
+	} {
+		opts := &CloneOptions{Mode: tc.mode, Deep: tc.deep, Submodules: tc.submodules}
+		if have := strings.Join(newExecBackend().cloneArgs("u", "d", opts), " "); have != tc.want {
+			t.Errorf("Wanted 'git %s' but got 'git %s'", tc.want, have)
+		}
+	}
+}
+
+func TestCloneArgsWithRef(t *testing.T) {
+	b := newExecBackend()
+	for ref, want := range map[string]string{
+		"v1.0.0":       "clone --depth=1 --single-branch --branch v1.0.0 u d",
+		RefAllBranches: "clone --depth=1 --no-single-branch u d",
+	} {
+		if have := strings.Join(b.cloneArgs("u", "d", &CloneOptions{Ref: ref}), " "); have != want {
+			t.Errorf("Wanted 'git %s' but got 'git %s'", want, have)
+		}
+	}
+}
+
+func TestCloneMissingRefFallback(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	src := testGitRepo(t, filepath.Join(dir, ".src"), "first")
+
+	cl := NewCloner(dir, nil, true, false)
+	dst := filepath.Join(dir, "a", "b")
+	if err := cl.gitClone(src, dst, "not-existing-branch"); err != nil {
+		t.Fatal("Default branch should be cloned when ref is missing:", err)
+	}
+	if !isGitRepo(dst) {
+		t.Error("Repository was not cloned")
+	}
+}
+
+func TestCloneArgsWithDepth(t *testing.T) {
+	b := newExecBackend()
+	opts := &CloneOptions{Depth: 10}
+	if have := strings.Join(b.cloneArgs("u", "d", opts), " "); have != "clone --depth=10 --single-branch u d" {
+		t.Error("Unexpected arguments:", have)
+	}
+	opts.ShallowSince = "2020-01-02T00:00:00Z"
+	if have := strings.Join(b.cloneArgs("u", "d", opts), " "); have != "clone --shallow-since=2020-01-02T00:00:00Z --single-branch u d" {
+		t.Error("Unexpected arguments:", have)
+	}
+}
+
+func TestUpdateDeepens(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	src := testGitRepo(t, filepath.Join(dir, ".src"), "first", "second", "third")
+	url := "file://" + filepath.ToSlash(src)
+
+	commits := func(dir string) int {
+		out, err := exec.Command("git", "-C", dir, "rev-list", "--count", "HEAD").Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := strconv.Atoi(strings.TrimSpace(string(out)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	dst := filepath.Join(dir, "a", "b")
+	cl := NewCloner(dir, nil, false, false)
+	if err := cl.gitClone(url, dst, ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := commits(dst); n != 1 {
+		t.Fatal("Only the latest commit should be cloned:", n)
+	}
+
+	cl.Depth = 2
+	if err := cl.gitUpdate(url, dst, ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := commits(dst); n != 2 {
+		t.Error("History should be deepened to depth 2:", n)
+	}
+
+	cl = NewCloner(dir, nil, true, false)
+	if err := cl.gitUpdate(url, dst, ""); err != nil {
+		t.Fatal(err)
+	}
+	if n := commits(dst); n != 3 || isShallow(dst) {
+		t.Error("Full history should be fetched on deep update:", n)
+	}
+}
+
+// hangingBackend is a clone backend whose Clone and Update hang until the context is canceled.
+type hangingBackend struct {
+	CloneBackend
+}
+
+func (b *hangingBackend) Clone(ctx context.Context, url, dir string, opts *CloneOptions) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func (b *hangingBackend) Update(ctx context.Context, url, dir string, opts *CloneOptions) error {
+	<-ctx.Done()
+	return ctx.Err()
+}
+
+func TestCloneTimeout(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	cl := NewCloner(dir, nil, false, false)
+	cl.Backend = &hangingBackend{}
+	cl.Timeout = 50 * time.Millisecond
+	if err := cl.gitClone("https://github.com/o/r.git", filepath.Join(dir, "o", "r"), ""); !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrCloneTimeout) {
+		t.Error("Clone should time out:", err)
+	}
+	if err := cl.gitUpdate("https://github.com/o/r.git", filepath.Join(dir, "o", "r"), ""); !errors.Is(err, context.DeadlineExceeded) || !errors.Is(err, ErrCloneTimeout) {
+		t.Error("Update should time out:", err)
+	}
+}
+
+// progressBackend is a clone backend which writes a file and reports progress periodically until
+// 'stall' elapses. After that, it hangs until the context is canceled.
+type progressBackend struct {
+	CloneBackend
+	stall time.Duration
+	total time.Duration
+}
+
+func (b *progressBackend) Clone(ctx context.Context, url, dir string, opts *CloneOptions) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "README"), []byte("hello"), 0644); err != nil {
+		return err
+	}
+	start := time.Now()
+	t := time.NewTicker(10 * time.Millisecond)
+	defer t.Stop()
+	for time.Since(start) < b.total {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+			if time.Since(start) < b.stall && opts.Progress != nil {
+				opts.Progress.Write([]byte("Receiving objects\r"))
+			}
+		}
+	}
+	return nil
+}
+
+func TestCloneStallTimeout(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	cl := NewCloner(dir, nil, false, false)
+	cl.Backend = &progressBackend{stall: 50 * time.Millisecond, total: 5 * time.Second}
+	cl.StallTimeout = 200 * time.Millisecond
+	cl.Retries = 2
+	repo := filepath.Join(dir, "o", "r")
+	start := time.Now()
+	err := cl.gitClone("https://github.com/o/r.git", repo, "")
+	if !errors.Is(err, ErrCloneTimeout) || !errors.Is(err, errStalled) {
+		t.Fatal("Stalled clone should time out:", err)
+	}
+	if d := time.Since(start); d > 3*time.Second {
+		t.Error("Stalled clone should not be retried:", d)
+	}
+	if _, err := os.Stat(repo); !os.IsNotExist(err) {
+		t.Error("Directory of stalled clone should be removed:", err)
+	}
+	if strings.Contains(err.Error(), "after") || !strings.Contains(err.Error(), "no progress") {
+		t.Error("Stall should be reported distinctly from timeout:", err)
+	}
+}
+
+func TestCloneWithProgressDoesNotStall(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	cl := NewCloner(dir, nil, false, false)
+	cl.Backend = &progressBackend{stall: time.Hour, total: 500 * time.Millisecond}
+	cl.StallTimeout = 100 * time.Millisecond
+	if err := cl.gitClone("https://github.com/o/r.git", filepath.Join(dir, "o", "r"), ""); err != nil {
+		t.Error("Clone making progress should not be aborted:", err)
+	}
+}
+
+func TestShutdownRemovesOnlyOwnTemps(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	tmp := filepath.Join(dir, tmpDir)
+	if err := os.MkdirAll(filepath.Join(tmp, "a__b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	testWriteFile(t, tmp, "not-mine", "")
+
+	cl := NewCloner(dir, nil, false, false)
+	cl.Start(1)
+	cl.addTemp(filepath.Join(tmp, "a__b"))
+	cl.Shutdown()
+
+	if _, err := os.Stat(filepath.Join(tmp, "a__b")); !os.IsNotExist(err) {
+		t.Error("Temporary directory created by cloner should be removed:", err)
+	}
+	if _, err := os.Stat(filepath.Join(tmp, "not-mine")); err != nil {
+		t.Error("File not created by cloner should not be removed:", err)
+	}
+
+	os.Remove(filepath.Join(tmp, "not-mine"))
+	cl = NewCloner(dir, nil, false, false)
+	cl.Start(1)
+	cl.Shutdown()
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Error("Empty temporary directory should be removed:", err)
+	}
+}
+
+func TestTimedOutRepos(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	cl := NewCloner(dir, nil, false, false)
+	cl.Backend = &hangingBackend{}
+	cl.StallTimeout = 100 * time.Millisecond
+	cl.Start(1)
+	cl.Clone("o/r")
+	cl.Shutdown()
+
+	if _, ok := cl.TimedOut()["o/r"]; !ok {
+		t.Error("Stalled repository should be recorded as timed out:", cl.TimedOut())
+	}
+	if _, ok := cl.Cloned()["o/r"]; ok {
+		t.Error("Stalled repository should not be recorded as cloned")
+	}
+	if len(cl.Skipped()) != 0 {
+		t.Error("Stalled repository should not be skipped:", cl.Skipped())
+	}
+}
@@ -2,11 +2,16 @@ package ghca
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"math"
 	"net/http"
+	"os"
 	"regexp"
+	"sort"
+	"strings"
+	"text/tabwriter"
 	"time"
 
 	"github.com/google/go-github/github"
@@ -19,6 +24,21 @@ type Collector struct {
 	perPage uint
 	maxPage uint
 	page    uint
+	// maxPageByCount is true when maxPage was calculated from Count
+	maxPageByCount bool
+	filtered       int
+	// queued is a map from slug to repositories sent to cloner
+	queued map[string]*found
+	// matched is a list of slugs of all repositories in search results and their new slugs when they
+	// were renamed. It is used for pruning
+	matched []string
+	// manifest is the manifest in Dest. It is nil on dry run
+	manifest *Manifest
+	// ids is a map from repository ID to slug recorded in the manifest
+	ids map[int64]string
+	// renamed is a map from current slug to old slug of repositories renamed or transferred
+	renamed map[string]string
+	table   *tabwriter.Writer
 	// Query is a query to search repositories on GitHub.
 	// Please refer following links to know about query:
 	// https://help.github.com/articles/understanding-the-search-syntax/
@@ -35,65 +55,706 @@ type Collector struct {
 	// Deep indicates shallow clone is not used
 	Deep bool
 	// SSH indicates use of SSH protocol instead of HTTPS
-	SSH    bool
-	client *github.Client
-	ctx    context.Context
+	SSH bool
+	// Code indicates searching code via GitHub Code Search API instead of repositories. Each
+	// repository containing matched files is cloned only once.
+	Code bool
+	// MatchedOnly indicates only files matched by code search remain in cloned repositories. It is
+	// effective only when Code is true.
+	MatchedOnly bool
+	// Repos is a list of repositories to clone in 'owner/name' format in addition to search results.
+	// Filter is not applied to them.
+	Repos []string
+	// Queries are additional queries to search. Results of all queries are merged and repositories
+	// found by multiple queries are cloned only once. When Sort is set, merged results are sorted again
+	// before applying Count.
+	Queries []string
+	// Filter filters repositories returned from GitHub Search API before cloning them. It can be nil.
+	// It is not applied to results of code search since they do not contain metadata of repositories.
+	Filter *Filter
+	// Sort is a field to sort search results. One of 'stars', 'forks', 'updated' and
+	// 'help-wanted-issues' for repositories or 'indexed' for code. Empty means best match. Merged
+	// results of Queries cannot be sorted by 'help-wanted-issues'.
+	Sort string
+	// Order is an order of sorting search results. 'asc' or 'desc'. Empty means 'desc'.
+	Order string
+	// Concurrency is the number of workers to clone repositories. 0 means the default value. Please
+	// see Cloner.Start.
+	Concurrency int
+	// Retries is how many times cloning a repository is retried on failure.
+	Retries int
+	// Format is a format of dry-run output. 'text', 'table' or 'json'. Empty means 'text'. In 'table'
+	// format, stars and language are shown in aligned columns. In 'json' format, each line is a JSON
+	// object describing one repository.
+	Format string
+	// Update indicates repositories already existing in Dest are updated instead of cloned. Please see
+	// Cloner.Update.
+	Update bool
+	// Layout is a layout of directories to clone repositories into. nil means DefaultLayout. Please
+	// see Layout.
+	Layout *Layout
+	// MaxRepoSize is max size of one repository in bytes. Repositories whose size in search results
+	// exceeds it are skipped before cloning. Please see also Cloner.MaxSize. 0 means unlimited.
+	MaxRepoSize int64
+	// DiskBudget is a disk budget of Dest. Please see Cloner.Budget. nil means unlimited.
+	DiskBudget *DiskBudget
+	// Mode is a mode of cloning. Please see Cloner.Mode.
+	Mode string
+	// WithWiki indicates wikis are also cloned. Please see Cloner.WithWiki.
+	WithWiki bool
+	// Submodules indicates submodules are cloned recursively. Please see Cloner.Submodules.
+	Submodules bool
+	// LFS is how to handle Git LFS objects. Please see Cloner.LFS.
+	LFS string
+	// Ref is a branch or tag to clone instead of the default branch. RefLatestRelease clones the tag
+	// of the latest release resolved via GitHub Releases API and RefAllBranches clones all branches.
+	// When the ref is missing in a repository, its default branch is cloned. Empty means the default
+	// branch.
+	Ref string
+	// Depth is the number of commits to fetch on shallow clone. Please see Cloner.Depth.
+	Depth int
+	// ShallowSince is a date to limit history on shallow clone. Please see Cloner.ShallowSince.
+	ShallowSince string
+	// Backend is a backend to run Git operations. nil means running git command. Please see
+	// CloneBackend.
+	Backend CloneBackend
+	// SSHConfig is configuration of SSH connections on cloning via SSH. Please see Cloner.SSHConfig.
+	SSHConfig *SSHConfig
+	// CloneTimeout is a timeout of cloning one repository. Please see Cloner.Timeout.
+	CloneTimeout time.Duration
+	// StallTimeout is a duration to wait for progress of cloning one repository. Please see
+	// Cloner.StallTimeout.
+	StallTimeout time.Duration
+	// WithIssues indicates issues, pull requests and their comments are exported as JSON files into
+	// the sidecar directory of each repository. Please see IssueExporter.
+	WithIssues bool
+	// RemoteBase is a base URL of remote repositories to clone via HTTPS. Please see
+	// Cloner.RemoteBase.
+	RemoteBase string
+	// skipped is the number of repositories skipped because of MaxRepoSize
+	skipped int
+	client  *github.Client
+	ctx     context.Context
+	// tokens is a pool of GitHub API tokens. They are also used for cloning private repositories via
+	// HTTPS. nil means anonymous access
+	tokens *TokenPool
+	// network is configuration of network connections set by SetNetwork
+	network   *NetworkConfig
+	transport http.RoundTripper
+	// cache is an on-disk cache of API responses set by SetHTTPCache
+	cache *HTTPCache
+	// recorder records API responses. It is set by SetRecorder
+	recorder *Recorder
+	// replayer serves recorded API responses instead of calling GitHub API. It is set by SetReplayer
+	replayer *Replayer
 }
 
-func (col *Collector) searchRepos() (*github.RepositoriesSearchResult, error) {
+// search fetches the page of search results for the query. In code search, matched file paths are
+// also returned. Each of them corresponds to the repository at the same index.
+func (col *Collector) search(query string, page uint) ([]*github.Repository, []string, int, error) {
 	o := &github.SearchOptions{
+		Sort:  col.Sort,
+		Order: col.Order,
 		ListOptions: github.ListOptions{
-			Page:    int(col.page),
+			Page:    int(page),
 			PerPage: int(col.perPage),
 		},
 	}
-	r, _, err := col.client.Search.Repositories(col.ctx, col.Query, o)
+
+	if col.Code {
+		r, _, err := col.client.Search.Code(col.ctx, query, o)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		repos := make([]*github.Repository, 0, len(r.CodeResults))
+		files := make([]string, 0, len(r.CodeResults))
+		for _, c := range r.CodeResults {
+			repos = append(repos, c.GetRepository())
+			files = append(files, c.GetPath())
+		}
+		return repos, files, r.GetTotal(), nil
+	}
+
+	r, _, err := col.client.Search.Repositories(col.ctx, query, o)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if r.GetIncompleteResults() {
+		log.Println("TODO: Handle incomplete result returned from GitHub API")
+	}
+	repos := make([]*github.Repository, 0, len(r.Repositories))
+	for i := range r.Repositories {
+		repos = append(repos, &r.Repositories[i])
+	}
+	return repos, nil, r.GetTotal(), nil
+}
+
+// lastPage returns the last page to fetch. maxPage calculated from Count assumes one result per
+// repository. When results are grouped or filtered (including skipping by MaxRepoSize), pages are
+// fetched until enough repositories are found.
+func (col *Collector) lastPage() uint {
+	if col.maxPageByCount && (col.Code || col.Filter != nil || col.MaxRepoSize > 0 || len(col.Queries) > 0) {
+		return uint(math.Ceil(maxSearchResults / float64(col.perPage)))
+	}
+	return col.maxPage
+}
+
+func waitRateLimit(err error) bool {
+	if _, ok := err.(*github.RateLimitError); !ok {
+		return false
+	}
+	log.Println("Rate limit exceeded. Sleeping 1 minute")
+	time.Sleep(1 * time.Minute)
+	return true
+}
+
+// sortRepos sorts repositories merged from multiple search results in the same order as GitHub
+// Search API does. The sort is stable so equal repositories keep their best-match order. Results are
+// not sorted by fields which search results do not contain (e.g. 'help-wanted-issues'). CLI rejects
+// such sort with multiple queries.
+func sortRepos(repos []*found, by, order string) {
+	var key func(r *github.Repository) int64
+	switch by {
+	case "stars":
+		key = func(r *github.Repository) int64 { return int64(r.GetStargazersCount()) }
+	case "forks":
+		key = func(r *github.Repository) int64 { return int64(r.GetForksCount()) }
+	case "updated":
+		key = func(r *github.Repository) int64 { return r.GetUpdatedAt().Unix() }
+	default:
+		return
+	}
+	sort.SliceStable(repos, func(i, j int) bool {
+		if order == "asc" {
+			return key(repos[i].repo) < key(repos[j].repo)
+		}
+		return key(repos[i].repo) > key(repos[j].repo)
+	})
+}
+
+func repoSlug(repo *github.Repository) string {
+	return fmt.Sprintf("%s/%s", repo.GetOwner().GetLogin(), repo.GetName())
+}
+
+// found is a repository found by searches.
+type found struct {
+	repo *github.Repository
+	// files is a list of matched file paths in code search
+	files []string
+	// queries is a list of queries which matched the repository
+	queries []string
+}
+
+// queries returns all queries to search.
+func (col *Collector) queries() []string {
+	qs := make([]string, 0, len(col.Queries)+1)
+	if col.Query != "" {
+		qs = append(qs, col.Query)
+	}
+	return append(qs, col.Queries...)
+}
+
+// searchAll searches all queries and merges their results. Repositories found by multiple queries are
+// deduplicated. In code search, matched files are grouped by repository.
+func (col *Collector) searchAll() ([]*found, int, error) {
+	queries := col.queries()
+	results := []*found{}
+	index := map[string]*found{}
+	rejected := map[string]struct{}{}
+	total := 0
+	maxPage := col.lastPage()
+	// When results of multiple queries or the repository list are merged, they are sorted again. All
+	// results must be fetched before applying Count
+	sources := len(queries)
+	if len(col.Repos) > 0 {
+		sources++
+	}
+	resort := col.Sort != "" && !col.Code && sources > 1
+	enough := func() bool {
+		return col.Count > 0 && len(results) >= col.Count && !resort
+	}
+
+	for _, slug := range col.Repos {
+		if _, ok := index[slug]; ok {
+			continue
+		}
+		f := &found{repo: repoFromSlug(slug)}
+		index[slug] = f
+		results = append(results, f)
+	}
+
+	for _, q := range queries {
+		if enough() {
+			break
+		}
+		if len(queries) > 1 {
+			log.Println("Searching with query:", q)
+		}
+
+		for page := col.page; page <= maxPage; {
+			repos, files, t, err := col.search(q, page)
+			if waitRateLimit(err) {
+				continue
+			} else if err != nil {
+				return nil, 0, err
+			}
+
+			if len(repos) == 0 {
+				// All results were searched
+				break
+			}
+			if page == col.page {
+				total += t
+			}
+
+			for i, repo := range repos {
+				slug := repoSlug(repo)
+				if _, ok := rejected[slug]; ok {
+					continue
+				}
+				f, ok := index[slug]
+				if ok && resort && len(f.queries) == 0 {
+					// Repository given via Repos has no metadata to sort results
+					f.repo = repo
+				}
+				if !ok {
+					if enough() {
+						continue
+					}
+					if !col.Code && col.Filter != nil && !col.Filter.Match(repo) {
+						log.Println("Filtered out:", slug)
+						col.filtered++
+						rejected[slug] = struct{}{}
+						continue
+					}
+					if col.tooLarge(repo) {
+						rejected[slug] = struct{}{}
+						continue
+					}
+					f = &found{repo: repo}
+					index[slug] = f
+					results = append(results, f)
+				}
+				if n := len(f.queries); n == 0 || f.queries[n-1] != q {
+					f.queries = append(f.queries, q)
+				}
+				if files != nil {
+					f.files = append(f.files, files[i])
+				}
+			}
+
+			if enough() {
+				break
+			}
+			page++
+		}
+	}
+
+	if resort {
+		for _, f := range results {
+			if len(f.queries) == 0 {
+				col.metadata(f)
+			}
+		}
+		sortRepos(results, col.Sort, col.Order)
+	}
+	if col.Count > 0 && len(results) > col.Count {
+		results = results[:col.Count]
+	}
+
+	return results, total, nil
+}
+
+type dryRunEntry struct {
+	Slug        string   `json:"slug"`
+	Description string   `json:"description,omitempty"`
+	URL         string   `json:"url,omitempty"`
+	Language    string   `json:"language,omitempty"`
+	Stars       int      `json:"stars"`
+	Files       []string `json:"files,omitempty"`
+	Queries     []string `json:"queries,omitempty"`
+}
+
+func (col *Collector) printDryRun(f *found, tagged bool) error {
+	slug := repoSlug(f.repo)
+	if col.Format == "json" {
+		b, err := json.Marshal(&dryRunEntry{
+			Slug:        slug,
+			Description: f.repo.GetDescription(),
+			URL:         f.repo.GetHTMLURL(),
+			Language:    f.repo.GetLanguage(),
+			Stars:       f.repo.GetStargazersCount(),
+			Files:       f.files,
+			Queries:     f.queries,
+		})
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
+	desc := f.repo.GetDescription()
+	if col.Code {
+		desc = strings.Join(f.files, ", ")
+	}
+	if col.Format == "table" {
+		if col.table == nil {
+			col.table = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+			fmt.Fprintln(col.table, "REPOSITORY\tSTARS\tLANGUAGE\tDESCRIPTION")
+		}
+		if tagged {
+			desc = fmt.Sprintf("%s (queries: '%s')", desc, strings.Join(f.queries, "', '"))
+		}
+		fmt.Fprintf(col.table, "%s\t%d\t%s\t%s\n", slug, f.repo.GetStargazersCount(), f.repo.GetLanguage(), desc)
+		return nil
+	}
+	if tagged {
+		fmt.Printf("dry-run: %s: %s (queries: '%s')\n", slug, desc, strings.Join(f.queries, "', '"))
+	} else {
+		fmt.Printf("dry-run: %s: %s\n", slug, desc)
+	}
+	return nil
+}
+
+// collectAll searches all queries at first, then clones found repositories. It is used when search
+// results need to be merged.
+func (col *Collector) collectAll(cloner *Cloner) (int, int, error) {
+	results, total, err := col.searchAll()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	tagged := len(col.Queries) > 0
+	for _, f := range results {
+		slug := repoSlug(f.repo)
+		col.matched = append(col.matched, slug)
+		if col.Dry {
+			if err := col.printDryRun(f, tagged); err != nil {
+				return 0, 0, err
+			}
+			continue
+		}
+		if tagged {
+			log.Printf("%s matched queries: '%s'\n", slug, strings.Join(f.queries, "', '"))
+		}
+		col.clone(cloner, f)
+	}
+
+	return len(results), total, nil
+}
+
+// tooLarge returns true when size of the repository in search results exceeds MaxRepoSize. Note that
+// size in search results is in KB.
+func (col *Collector) tooLarge(repo *github.Repository) bool {
+	if col.MaxRepoSize == 0 {
+		return false
+	}
+	size := int64(repo.GetSize()) * 1024
+	if size <= col.MaxRepoSize {
+		return false
+	}
+	log.Printf("Skipped %s: size %s exceeds max size %s\n", repoSlug(repo), formatSize(size), formatSize(col.MaxRepoSize))
+	col.skipped++
+	return true
+}
+
+// lookup fetches metadata of the repository recorded in the manifest by its ID. It is used to know the
+// current slug of the repository which has no metadata such as repositories given via Repos.
+func (col *Collector) lookup(f *found) {
+	e, ok := col.manifest.Repos[repoSlug(f.repo)]
+	if !ok || e.ID == 0 {
+		return
+	}
+	for {
+		repo, _, err := col.client.Repositories.GetByID(col.ctx, e.ID)
+		if waitRateLimit(err) {
+			continue
+		}
+		if err != nil {
+			log.Println("Could not fetch metadata of", e.Slug, err)
+			return
+		}
+		f.repo = repo
+		return
+	}
+}
+
+// metadata fetches metadata of the repository given via Repos and not found by any query. It is used
+// to sort the repository with search results.
+func (col *Collector) metadata(f *found) {
+	slug := repoSlug(f.repo)
+	for {
+		repo, _, err := col.client.Repositories.Get(col.ctx, f.repo.GetOwner().GetLogin(), f.repo.GetName())
+		if waitRateLimit(err) {
+			continue
+		}
+		if err != nil {
+			log.Println("Could not fetch metadata of", slug, err)
+			return
+		}
+		f.repo = repo
+		return
+	}
+}
+
+// latestRelease returns the tag name of the latest release of the repository. When the repository has
+// no release, it returns an empty string to clone the default branch.
+func (col *Collector) latestRelease(repo *github.Repository) string {
+	slug := repoSlug(repo)
+	for {
+		r, _, err := col.client.Repositories.GetLatestRelease(col.ctx, repo.GetOwner().GetLogin(), repo.GetName())
+		if waitRateLimit(err) {
+			continue
+		}
+		if err != nil {
+			log.Println("No release was found in", slug, "so default branch is cloned:", err)
+			return ""
+		}
+		log.Println("Latest release of", slug, "is", r.GetTagName())
+		return r.GetTagName()
+	}
+}
+
+// clone sends the repository to the cloner. When the repository was recorded in the manifest with a
+// different slug, it was renamed or transferred. Then its directory is moved instead of recloning.
+func (col *Collector) clone(cloner *Cloner, f *found) {
+	if f.repo.GetID() == 0 && col.Update {
+		before := repoSlug(f.repo)
+		col.lookup(f)
+		if s := repoSlug(f.repo); s != before {
+			// Search results only have the slug before the rename. Keep the renamed one on pruning
+			col.matched = append(col.matched, s)
+		}
+	}
+	slug := repoSlug(f.repo)
+	if _, ok := col.queued[slug]; ok {
+		return
+	}
+	col.queued[slug] = f
+
+	job := cloneJob{slug: slug, repo: f.repo, ref: col.Ref}
+	if col.Ref == RefLatestRelease {
+		job.ref = col.latestRelease(f.repo)
+	}
+	if col.MatchedOnly {
+		job.files = f.files
+	}
+	if old, ok := col.ids[f.repo.GetID()]; ok && old != slug {
+		log.Printf("%s was renamed or transferred to %s\n", old, slug)
+		col.renamed[slug] = old
+		job.from = col.manifest.Repos[old].RelPath()
+	}
+	cloner.push(job)
+}
+
+// checkLayout checks the layout is the same as the layout recorded in the manifest. Mixing layouts
+// in one directory makes it impossible to know where repositories are.
+func (col *Collector) checkLayout(m *Manifest) error {
+	if len(m.Repos) == 0 {
+		return nil
+	}
+	want := m.Layout
+	if want == "" {
+		want = DefaultLayout
+	}
+	have := DefaultLayout
+	if col.Layout != nil {
+		have = col.Layout.String()
+	}
+	if want != have {
+		return fmt.Errorf("Layout '%s' is different from layout '%s' recorded in manifest of '%s'", have, want, col.Dest)
+	}
+	return nil
+}
+
+// recordManifest records cloned repositories in the manifest in Dest. 'shas' is a map from slug to
+// commit SHA of the cloned HEAD.
+func (col *Collector) recordManifest(cloned, shas map[string]string) error {
+	if len(cloned) == 0 {
+		return nil
+	}
+	m := col.manifest
+	if col.Layout != nil {
+		m.Layout = col.Layout.String()
+	}
+	now := time.Now()
+	for slug, path := range cloned {
+		f, ok := col.queued[slug]
+		if !ok {
+			continue
+		}
+		if old, ok := col.renamed[slug]; ok {
+			m.Rename(old, slug)
+		}
+		m.Record(f.repo, f.queries, now)
+		m.Repos[slug].setPath(path)
+		if sha, ok := shas[slug]; ok {
+			m.Repos[slug].SHA = sha
+		}
+	}
+	return m.Save(col.Dest)
+}
+
+// Search searches repositories without cloning them and returns their slugs. Filter and Count are
+// applied to the results.
+func (col *Collector) Search() ([]string, error) {
+	results, _, err := col.searchAll()
 	if err != nil {
 		return nil, err
 	}
-	return r, nil
+	slugs := make([]string, 0, len(results))
+	for _, f := range results {
+		slugs = append(slugs, repoSlug(f.repo))
+	}
+	return slugs, nil
 }
 
 // Collect collects all repositories based on results of GitHub Search API. It returns total number
 // of atucally cloned repositories and total number of repositories on GitHub.
 func (col *Collector) Collect() (int, int, error) {
-	log.Println("Searching GitHub repositories with query:", col.Query)
+	if qs := col.queries(); len(qs) > 0 {
+		log.Println("Searching GitHub repositories with query:", strings.Join(qs, ", "))
+	}
 	start := time.Now()
 	cloner := NewCloner(col.Dest, col.Extract, col.Deep, col.SSH)
+	cloner.Retries = col.Retries
+	cloner.Update = col.Update
+	cloner.Layout = col.Layout
+	cloner.MaxSize = col.MaxRepoSize
+	cloner.Mode = col.Mode
+	cloner.WithWiki = col.WithWiki
+	cloner.Submodules = col.Submodules
+	cloner.LFS = col.LFS
+	cloner.Depth = col.Depth
+	cloner.ShallowSince = col.ShallowSince
+	if col.tokens != nil {
+		cloner.Tokens = col.tokens
+	}
+	cloner.Network = col.network
+	cloner.Timeout = col.CloneTimeout
+	cloner.StallTimeout = col.StallTimeout
+	cloner.SSHConfig = col.SSHConfig
+	cloner.RemoteBase = col.RemoteBase
+	if col.Backend != nil {
+		cloner.Backend = col.Backend
+	}
+	if col.WithIssues {
+		cloner.Issues = NewIssueExporter(col.ctx, col.client)
+	}
+	cloner.Budget = col.DiskBudget
+	col.skipped = 0
+	col.queued = map[string]*found{}
+	col.matched = nil
+	col.manifest = nil
+	col.ids = map[int64]string{}
+	col.renamed = map[string]string{}
 	if !col.Dry {
-		cloner.Start(col.Count)
+		m, err := LoadManifest(col.Dest)
+		if err != nil {
+			return 0, 0, err
+		}
+		if err := col.checkLayout(m); err != nil {
+			return 0, 0, err
+		}
+		// Paths of repositories cloned in previous runs are reserved to detect collisions
+		for slug, e := range m.Repos {
+			cloner.Reserve(e.RelPath(), slug)
+			if e.ID != 0 {
+				col.ids[e.ID] = slug
+			}
+		}
+		col.manifest = m
+		para := col.Concurrency
+		if para == 0 {
+			para = col.Count
+		}
+		cloner.Start(para)
+	}
+
+	var count, total int
+	var err error
+	if col.Code || len(col.Queries) > 0 || len(col.Repos) > 0 || col.Query == "" {
+		count, total, err = col.collectAll(cloner)
+	} else {
+		count, total, err = col.collectRepos(cloner)
+	}
+	if err != nil {
+		return 0, 0, err
 	}
 
+	if col.table != nil {
+		if err := col.table.Flush(); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	if !col.Dry {
+		cloner.Shutdown()
+		if err := col.recordManifest(cloner.Cloned(), cloner.SHAs()); err != nil {
+			return 0, 0, err
+		}
+		skipped := len(cloner.Skipped())
+		log.Printf("%d repositories were cloned into '%s' for total %d search results (%f seconds)\n", count-skipped, col.Dest, total, time.Now().Sub(start).Seconds())
+		col.skipped += skipped
+		if n := len(cloner.TimedOut()); n > 0 {
+			log.Printf("%d repositories failed because cloning or updating them timed out\n", n)
+		}
+		if col.WithWiki || col.WithIssues {
+			wikis, exports := cloner.Sidecars()
+			log.Printf("%d wikis were cloned and issues of %d repositories were exported\n", wikis, exports)
+		}
+	}
+	if col.skipped > 0 {
+		log.Printf("%d repositories were skipped because of size limit or disk budget\n", col.skipped)
+	}
+	if col.filtered > 0 {
+		log.Printf("%d repositories were filtered out by '%s'\n", col.filtered, col.Filter)
+	}
+	if col.cache != nil && col.cache.Hits() > 0 {
+		log.Printf("%d API responses were not modified and served from HTTP cache '%s'\n", col.cache.Hits(), col.cache.Dir)
+	}
+
+	return count, total, nil
+}
+
+func (col *Collector) collectRepos(cloner *Cloner) (int, int, error) {
 	total := 0
 	count := 0
+	maxPage := col.lastPage()
 Fetch:
-	for col.page <= col.maxPage {
-		res, err := col.searchRepos()
-		if _, ok := err.(*github.RateLimitError); ok {
-			log.Println("Rate limit exceeded. Sleeping 1 minute")
-			time.Sleep(1 * time.Minute)
+	for col.page <= maxPage {
+		repos, _, t, err := col.search(col.Query, col.page)
+		if waitRateLimit(err) {
 			continue
 		} else if err != nil {
 			return 0, 0, err
 		}
 
-		total = res.GetTotal()
+		total = t
 
-		if res.GetIncompleteResults() {
-			log.Println("TODO: Handle incomplete result returned from GitHub API")
-		}
-
-		if len(res.Repositories) == 0 {
+		if len(repos) == 0 {
 			// All repositories were searched
 			break
 		}
 
-		for _, repo := range res.Repositories {
-			slug := fmt.Sprintf("%s/%s", repo.GetOwner().GetLogin(), repo.GetName())
+		for _, repo := range repos {
+			slug := repoSlug(repo)
+			if col.Filter != nil && !col.Filter.Match(repo) {
+				log.Println("Filtered out:", slug)
+				col.filtered++
+				continue
+			}
+			if col.tooLarge(repo) {
+				continue
+			}
+			col.matched = append(col.matched, slug)
 			if col.Dry {
-				fmt.Printf("dry-run: %s: %s\n", slug, repo.GetDescription())
+				if err := col.printDryRun(&found{repo: repo}, false); err != nil {
+					return 0, 0, err
+				}
 			} else {
-				cloner.Clone(slug)
+				col.clone(cloner, &found{repo: repo})
 			}
 			count++
 			if col.Count > 0 && count >= col.Count {
@@ -104,11 +765,6 @@ Fetch:
 		col.page++
 	}
 
-	if !col.Dry {
-		cloner.Shutdown()
-		log.Printf("%d repositories were cloned into '%s' for total %d search results (%f seconds)\n", count, col.Dest, total, time.Now().Sub(start).Seconds())
-	}
-
 	return count, total, nil
 }
 
@@ -122,35 +778,110 @@ type PageConfig struct {
 	Start uint
 }
 
+// maxSearchResults is the max number of results GitHub Search API can return for one query.
+const maxSearchResults = 1000.0
+
 // PageUnlimited means to fetch and clone repositories as much as possible.
 const PageUnlimited uint = 0
 
+// SetTokenPool makes the collector call GitHub API with tokens in the pool. The tokens are also used
+// for cloning private repositories via HTTPS.
+func (col *Collector) SetTokenPool(pool *TokenPool) {
+	col.tokens = pool
+	col.resetClient()
+}
+
+// SetNetwork makes the collector call GitHub API and clone repositories with the network
+// configuration.
+func (col *Collector) SetNetwork(n *NetworkConfig) error {
+	t, err := n.Transport()
+	if err != nil {
+		return err
+	}
+	col.network = n
+	col.transport = t
+	col.resetClient()
+	return nil
+}
+
+// SetHTTPCache makes the collector cache responses of GitHub API in the cache. Please see HTTPCache.
+func (col *Collector) SetHTTPCache(c *HTTPCache) {
+	col.cache = c
+	col.resetClient()
+}
+
+// SetRecorder makes the collector record responses of GitHub API with the recorder. Please see
+// Recorder.
+func (col *Collector) SetRecorder(r *Recorder) {
+	col.recorder = r
+	col.resetClient()
+}
+
+// SetReplayer makes the collector use responses recorded in the past instead of calling GitHub API.
+// Please see Replayer.
+func (col *Collector) SetReplayer(r *Replayer) {
+	col.replayer = r
+	col.resetClient()
+}
+
+// resetClient creates the API client from the token pool, the recorder, the cache and the transport.
+// The cache is placed under the token pool so that rate limits are recorded from responses of
+// revalidation. The replayer replaces the transport.
+func (col *Collector) resetClient() {
+	t := col.transport
+	if col.replayer != nil {
+		t = col.replayer
+	}
+	if col.cache != nil {
+		col.cache.Base = t
+		t = col.cache
+	}
+	if col.recorder != nil {
+		col.recorder.Base = t
+		t = col.recorder
+	}
+	c := &http.Client{Transport: t}
+	if col.tokens != nil {
+		col.tokens.Base = t
+		c.Transport = col.tokens
+	}
+	col.client = github.NewClient(c)
+}
+
 // NewCollector creates Collector instance.
 func NewCollector(query, token, dest string, extract *regexp.Regexp, count int, dry bool, deep bool, ssh bool, page *PageConfig) *Collector {
 	ctx := context.Background()
 
-	var auth *http.Client
+	c := &Collector{
+		perPage: 100,
+		maxPage: PageUnlimited,
+		page:    1,
+		Query:   query,
+		Dest:    dest,
+		Extract: extract,
+		Count:   count,
+		Dry:     dry,
+		Deep:    deep,
+		SSH:     ssh,
+		client:  github.NewClient(nil),
+		ctx:     ctx,
+	}
 	if token != "" {
-		src := oauth2.StaticTokenSource(
-			&oauth2.Token{AccessToken: token},
-		)
-		auth = oauth2.NewClient(ctx, src)
+		c.SetTokenPool(NewTokenPool(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: token})))
 	}
 
-	client := github.NewClient(auth)
-	c := &Collector{100, PageUnlimited, 1, query, dest, extract, count, dry, deep, ssh, client, ctx}
-
 	if page != nil {
 		c.perPage = page.Per
 		c.maxPage = page.Max
 		c.page = page.Start
 	}
 	if c.maxPage == PageUnlimited {
-		maxRepos := 1000.0
-		if 0 < count && count < 1000 {
+		maxRepos := maxSearchResults
+		if 0 < count && count < maxSearchResults {
 			maxRepos = float64(count)
 		}
 		c.maxPage = uint(math.Ceil(maxRepos / float64(c.perPage)))
+		c.maxPageByCount = 0 < count && count < maxSearchResults
 	}
 
 	return c
@@ -1,12 +1,19 @@
 package ghca
 
 import (
-	"io"
+	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
 )
 
 func TestNewCollector(t *testing.T) {
@@ -49,78 +56,89 @@ func TestNewCollectorWithConfig(t *testing.T) {
 	}
 }
 
-func TestCollectReposTotalIsAFew(t *testing.T) {
-	if testing.Short() {
-		t.Skip("Skipping test in short mode")
+// testReplay makes the collector replay the API session recorded in 'testdata/replay/{name}'.
+func testReplay(t *testing.T, c *Collector, name string) {
+	r, err := NewReplayer(filepath.Join("testdata", "replay", name))
+	if err != nil {
+		t.Fatal(err)
 	}
+	c.SetReplayer(r)
+}
 
-	token := os.Getenv("GITHUB_TOKEN")
-	if token == "" {
-		t.Skip("Skipping because API token not found")
+// testRemoteBase creates bare repositories of the slugs under the directory and returns the base URL
+// to clone them as Collector.RemoteBase.
+func testRemoteBase(t *testing.T, dir string, slugs ...string) string {
+	remote := filepath.Join(dir, "remote")
+	for _, s := range slugs {
+		src := testGitRepo(t, filepath.Join(dir, ".src", filepath.FromSlash(s)), "first")
+		if out, err := exec.Command("git", "clone", "-q", "--bare", src, filepath.Join(remote, filepath.FromSlash(s)+".git")).CombinedOutput(); err != nil {
+			t.Fatal(err, string(out))
+		}
 	}
+	return "file://" + filepath.ToSlash(remote) + "/"
+}
 
-	defer func() {
-		os.RemoveAll("test")
-	}()
+func TestCollectReposTotalIsAFew(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	slugs := []string{"rhysd/clever-f.vim", "vim-scripts/clever-f.vim"}
+	dest := filepath.Join(dir, "repos")
+	c := NewCollector("clever-f.vim language:vim fork:false", "", dest, nil, 0, false, false, false, nil)
+	testReplay(t, c, "clever-f")
+	c.RemoteBase = testRemoteBase(t, dir, slugs...)
 
-	c := NewCollector("clever-f.vim language:vim fork:false", token, "test", nil, 0, false, false, false, nil)
 	count, total, err := c.Collect()
 	if err != nil {
 		t.Fatal("Failed to collect", err)
 	}
-	if total < 2 || count < 2 {
-		t.Fatal("Total repositories is too few:", total)
+	if total != 2 || count != 2 {
+		t.Fatal("Unexpected count and total:", count, total)
 	}
 
-	for _, dir := range []string{
-		"test/rhysd/clever-f.vim",
-		"test/vim-scripts/clever-f.vim",
-	} {
-		dir = filepath.FromSlash(dir)
-		if _, err := os.Stat(dir); err != nil {
-			t.Fatal(dir, "was not cloned")
+	for _, s := range slugs {
+		if !isGitRepo(filepath.Join(dest, filepath.FromSlash(s))) {
+			t.Fatal(s, "was not cloned")
 		}
 	}
 }
 
 func TestCollectReposTotalIsLarge(t *testing.T) {
-	if testing.Short() {
-		t.Skip("Skipping test in short mode")
-	}
-
-	token := os.Getenv("GITHUB_TOKEN")
-	if token == "" {
-		t.Skip("Skipping because API token not found")
-	}
-
-	defer func() {
-		os.RemoveAll("test")
-	}()
+	dir, done := testDestDir(t)
+	defer done()
 
+	slugs := []string{
+		"tpope/vim-fugitive",
+		"junegunn/fzf.vim",
+		"preservim/nerdtree",
+		"vim-airline/vim-airline",
+		"mattn/emmet-vim",
+		"dense-analysis/ale",
+	}
+	dest := filepath.Join(dir, "repos")
 	// Get page 4, 5, 6 and each page results in 2 repos
-	c := NewCollector("language:vim fork:false", token, "test", nil, 0, false, false, false, &PageConfig{
+	c := NewCollector("language:vim fork:false", "", dest, nil, 0, false, false, false, &PageConfig{
 		Per:   2,
 		Max:   6,
 		Start: 4,
 	})
+	testReplay(t, c, "language-vim")
+	c.RemoteBase = testRemoteBase(t, dir, slugs...)
 
 	count, total, err := c.Collect()
 	if err != nil {
 		t.Fatal("Failed to collect", err)
 	}
-	if total == 0 {
-		t.Fatal("No repository was found")
+	if total != 1000 {
+		t.Fatal("Unexpected total:", total)
 	}
 	if count != 6 {
-		t.Fatal("6 repositories (2x3) should be resulted:", total)
+		t.Fatal("6 repositories (2x3) should be resulted:", count)
 	}
-
-	dir, err := os.Open("test")
-	if err != nil {
-		t.Fatal("Failed to open", err)
-	}
-	if _, err := dir.Readdirnames(1); err == io.EOF {
-		t.Fatal("'test' directory is empty")
+	for _, s := range slugs {
+		if !isGitRepo(filepath.Join(dest, filepath.FromSlash(s))) {
+			t.Error(s, "was not cloned")
+		}
 	}
 }
 
@@ -136,59 +154,479 @@ func TestBadCredential(t *testing.T) {
 }
 
 func TestSpecifyCount(t *testing.T) {
-	if testing.Short() {
-		t.Skip("Skipping test in short mode")
+	dir, done := testDestDir(t)
+	defer done()
+
+	dest := filepath.Join(dir, "repos")
+	c := NewCollector("user:rhysd", "", dest, nil, 2, false, false, false, nil)
+	if c.maxPage != 1 {
+		t.Fatal("Max page should be 1 if count is specified as 2 because of 100 repos per page:", c.maxPage)
 	}
+	testReplay(t, c, "user-rhysd")
+	c.RemoteBase = testRemoteBase(t, dir, "rhysd/foo", "rhysd/bar", "rhysd/baz")
 
-	defer func() {
-		os.RemoveAll("test")
-	}()
+	count, total, err := c.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 || total != 3 {
+		t.Fatal("Count is specified as 2 but actually 2 repos are not cloned:", count, total)
+	}
+
+	fs, err := ioutil.ReadDir(filepath.Join(dest, "rhysd"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ns := make([]string, 0, len(fs))
+	for _, f := range fs {
+		ns = append(ns, f.Name())
+	}
+	if strings.Join(ns, " ") != "bar foo" {
+		t.Fatal("Count is specified as 2 but actually 2 repos are not cloned:", count, ", ", strings.Join(ns, " "))
+	}
 
-	token := os.Getenv("GITHUB_TOKEN")
-	if token == "" {
-		t.Skip("Skipping because API token not found")
+	m, err := LoadManifest(dest)
+	if err != nil {
+		t.Fatal(err)
 	}
+	if len(m.Repos) != 2 {
+		t.Error("Cloned repositories should be recorded in manifest:", m.Repos)
+	}
+	if _, err := os.Stat(filepath.Join(dest, tmpDir)); !os.IsNotExist(err) {
+		t.Error("Temporary directory should be removed:", err)
+	}
+}
 
-	c := NewCollector("user:rhysd", token, "test", nil, 2, false, false, false, nil)
-	if c.maxPage != 1 {
-		t.Fatal("Max page should be 1 if count is specified as 2 because of 100 repos per page:", c.maxPage)
+func TestDryRun(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	dest := filepath.Join(dir, "repos")
+	c := NewCollector("user:rhysd", "", dest, nil, 2, true, false, false, nil)
+	testReplay(t, c, "user-rhysd")
+	if _, _, err := c.Collect(); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(c.matched, ",") != "rhysd/foo,rhysd/bar" {
+		t.Error("Recorded search results should be reproduced:", c.matched)
+	}
+	if _, err := os.Stat(dest); err == nil {
+		t.Fatal("Dest directory was created in spite of dry-run")
+	}
+}
+
+func testCollectorWithServer(t *testing.T, query string, h http.HandlerFunc) (*Collector, func()) {
+	srv := httptest.NewServer(h)
+	c := NewCollector(query, "", "test", nil, 0, true, false, false, nil)
+	u, err := url.Parse(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.client.BaseURL = u
+	return c, srv.Close
+}
+
+func TestCollectCodeGroupsByRepo(t *testing.T) {
+	c, done := testCollectorWithServer(t, "filename:.golangci.yml", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/search/code" {
+			t.Error("Unexpected endpoint:", r.URL.Path)
+		}
+		if r.URL.Query().Get("page") != "1" {
+			fmt.Fprint(w, `{"total_count": 3, "items": []}`)
+			return
+		}
+		fmt.Fprint(w, `{"total_count": 3, "items": [
+			{"path": ".golangci.yml", "repository": {"name": "foo", "owner": {"login": "a"}}},
+			{"path": "sub/.golangci.yml", "repository": {"name": "foo", "owner": {"login": "a"}}},
+			{"path": ".golangci.yml", "repository": {"name": "bar", "owner": {"login": "b"}}}
+		]}`)
+	})
+	defer done()
+	c.Code = true
+
+	count, total, err := c.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 {
+		t.Error("Total should be number of matched files:", total)
+	}
+	if count != 2 {
+		t.Error("Matched files should be grouped by repository:", count)
+	}
+}
+
+func TestCollectCodeCount(t *testing.T) {
+	c, done := testCollectorWithServer(t, "filename:.golangci.yml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"total_count": 3, "items": [
+			{"path": ".golangci.yml", "repository": {"name": "foo", "owner": {"login": "a"}}},
+			{"path": ".golangci.yml", "repository": {"name": "bar", "owner": {"login": "b"}}},
+			{"path": ".golangci.yml", "repository": {"name": "piyo", "owner": {"login": "c"}}}
+		]}`)
+	})
+	defer done()
+	c.Code = true
+	c.Count = 2
+
+	count, _, err := c.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Error("Number of repositories should be limited by count:", count)
+	}
+}
+
+func TestCollectSortOrder(t *testing.T) {
+	c, done := testCollectorWithServer(t, "language:rust", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("sort") != "stars" || q.Get("order") != "asc" {
+			t.Error("Sort and order should be passed to API:", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, `{"total_count": 0, "items": []}`)
+	})
+	defer done()
+	c.Sort = "stars"
+	c.Order = "asc"
+
+	if _, _, err := c.Collect(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSortRepos(t *testing.T) {
+	repos := []*found{
+		{repo: &github.Repository{Name: github.String("a"), StargazersCount: github.Int(1), ForksCount: github.Int(3)}},
+		{repo: &github.Repository{Name: github.String("b"), StargazersCount: github.Int(3), ForksCount: github.Int(3)}},
+		{repo: &github.Repository{Name: github.String("c"), StargazersCount: github.Int(2), ForksCount: github.Int(1)}},
+	}
+	names := func() string {
+		ns := make([]string, 0, len(repos))
+		for _, r := range repos {
+			ns = append(ns, r.repo.GetName())
+		}
+		return strings.Join(ns, "")
+	}
+
+	sortRepos(repos, "stars", "")
+	if n := names(); n != "bca" {
+		t.Error("Repositories should be sorted by stars in descending order:", n)
+	}
+	sortRepos(repos, "stars", "asc")
+	if n := names(); n != "acb" {
+		t.Error("Repositories should be sorted by stars in ascending order:", n)
+	}
+	sortRepos(repos, "forks", "desc")
+	if n := names(); n != "abc" {
+		t.Error("Sort should be stable:", n)
+	}
+	sortRepos(repos, "help-wanted-issues", "desc")
+	if n := names(); n != "abc" {
+		t.Error("Unavailable field should not change the order:", n)
 	}
+}
+
+func TestCollectMultipleQueries(t *testing.T) {
+	c, done := testCollectorWithServer(t, "language:vim", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") != "1" {
+			fmt.Fprint(w, `{"total_count": 2, "items": []}`)
+			return
+		}
+		switch r.URL.Query().Get("q") {
+		case "language:vim":
+			fmt.Fprint(w, `{"total_count": 2, "items": [
+				{"name": "foo", "owner": {"login": "a"}, "stargazers_count": 1},
+				{"name": "bar", "owner": {"login": "b"}, "stargazers_count": 2}
+			]}`)
+		case "filename:.vimrc":
+			fmt.Fprint(w, `{"total_count": 2, "items": [
+				{"name": "bar", "owner": {"login": "b"}, "stargazers_count": 2},
+				{"name": "piyo", "owner": {"login": "c"}, "stargazers_count": 3}
+			]}`)
+		default:
+			t.Error("Unexpected query:", r.URL.RawQuery)
+		}
+	})
+	defer done()
+	c.Queries = []string{"filename:.vimrc"}
+
+	results, total, err := c.searchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 4 {
+		t.Error("Total should be sum of totals of all queries:", total)
+	}
+	if len(results) != 3 {
+		t.Fatal("Repositories should be deduplicated:", len(results))
+	}
+	if qs := strings.Join(results[1].queries, ","); qs != "language:vim,filename:.vimrc" {
+		t.Error("Repository found by both queries should be tagged with them:", qs)
+	}
+
+	c.Sort = "stars"
+	c.Count = 2
+	results, _, err = c.searchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatal("Count should be applied after merging:", len(results))
+	}
+	if n := repoSlug(results[0].repo); n != "c/piyo" {
+		t.Error("Merged results should be sorted again before applying count:", n)
+	}
+}
+
+func TestSearchAllSortWithRepoList(t *testing.T) {
+	c, done := testCollectorWithServer(t, "language:vim", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/search/repositories":
+			if r.URL.Query().Get("page") != "1" {
+				fmt.Fprint(w, `{"total_count": 3, "items": []}`)
+				return
+			}
+			fmt.Fprint(w, `{"total_count": 3, "items": [
+				{"name": "foo", "owner": {"login": "a"}, "stargazers_count": 1},
+				{"name": "bar", "owner": {"login": "b"}, "stargazers_count": 2},
+				{"name": "piyo", "owner": {"login": "c"}, "stargazers_count": 3}
+			]}`)
+		case "/repos/d/listed":
+			fmt.Fprint(w, `{"name": "listed", "owner": {"login": "d"}, "stargazers_count": 5}`)
+		default:
+			t.Error("Unexpected endpoint:", r.URL.Path)
+		}
+	})
+	defer done()
+	c.Repos = []string{"a/foo", "d/listed"}
+	c.Sort = "stars"
+	c.Count = 2
+
+	results, _, err := c.searchAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slugs := []string{}
+	for _, f := range results {
+		slugs = append(slugs, repoSlug(f.repo))
+	}
+	if s := strings.Join(slugs, " "); s != "d/listed c/piyo" {
+		t.Error("Results merged with repository list should be sorted again before applying count:", s)
+	}
+}
+
+func TestCollectRepoList(t *testing.T) {
+	c, done := testCollectorWithServer(t, "", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Search API should not be called without query:", r.URL)
+	})
+	defer done()
+	c.Repos = []string{"rhysd/clever-f.vim", "rhysd/vim-gfm-syntax", "rhysd/clever-f.vim"}
 
 	count, _, err := c.Collect()
 	if err != nil {
 		t.Fatal(err)
 	}
 	if count != 2 {
-		t.Fatal("Count is specified as 2 but actually 2 repos are not cloned:", count)
+		t.Error("Repositories in list should be deduplicated:", count)
+	}
+}
+
+func TestCollectFollowRename(t *testing.T) {
+	dest, cleanup := testDestDir(t)
+	defer cleanup()
+	old := testGitRepo(t, filepath.Join(dest, "old", "repo"))
+	if out, err := exec.Command("git", "-C", old, "remote", "add", "origin", "https://github.com/old/repo.git").CombinedOutput(); err != nil {
+		t.Fatal(err, string(out))
+	}
+	m, _ := LoadManifest(dest)
+	m.Record(testManifestRepo("old", "repo", 7), []string{"foo"}, time.Now())
+	if err := m.Save(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	c, done := testCollectorWithServer(t, "foo", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"total_count": 1, "items": [{"id": 7, "name": "repo", "owner": {"login": "new"}}]}`)
+	})
+	defer done()
+	c.Dest = dest
+	c.Dry = false
+	c.Count = 1
+
+	if _, _, err := c.Collect(); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := filepath.Join(dest, "new", "repo")
+	if !isGitRepo(dir) {
+		t.Fatal("Repository should be moved to new directory")
+	}
+	if _, err := os.Stat(filepath.Join(dest, "old")); err == nil {
+		t.Error("Old directory should be removed")
+	}
+	out, err := exec.Command("git", "-C", dir, "remote", "get-url", "origin").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u := strings.TrimSpace(string(out)); u != "https://github.com/new/repo.git" {
+		t.Error("Remote URL should be updated:", u)
 	}
 
-	fs, err := ioutil.ReadDir(filepath.FromSlash("test/rhysd"))
+	m, err = LoadManifest(dest)
 	if err != nil {
 		t.Fatal(err)
 	}
-	if len(fs) != 2 {
-		ns := make([]string, 0, len(fs))
-		for _, f := range fs {
-			ns = append(ns, f.Name())
+	if ss := m.Slugs(); len(ss) != 1 || ss[0] != "new/repo" || m.Repos["new/repo"].ID != 7 {
+		t.Error("Manifest should follow the rename:", ss)
+	}
+}
+
+func TestUpdatePruneFollowsRename(t *testing.T) {
+	dir, cleanup := testDestDir(t)
+	defer cleanup()
+	dest := filepath.Join(dir, "repos")
+	base := testRemoteBase(t, dir, "new/repo", "a/gone")
+	for _, s := range []string{"new/repo", "a/gone"} {
+		p := filepath.Join(dest, filepath.FromSlash(s))
+		if s == "new/repo" {
+			// Cloned before the rename
+			p = filepath.Join(dest, "old", "repo")
 		}
-		t.Fatal("Count is specified as 2 but actually 2 repos are not cloned:", count, ", ", strings.Join(ns, " "))
+		if out, err := exec.Command("git", "clone", "-q", base+s+".git", p).CombinedOutput(); err != nil {
+			t.Fatal(err, string(out))
+		}
+	}
+	m, _ := LoadManifest(dest)
+	m.Record(testManifestRepo("old", "repo", 7), nil, time.Now())
+	m.Record(testManifestRepo("a", "gone", 8), nil, time.Now())
+	if err := m.Save(dest); err != nil {
+		t.Fatal(err)
+	}
+
+	// Update repositories recorded in manifest except for 'a/gone'
+	c, done := testCollectorWithServer(t, "", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repositories/7" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"id": 7, "name": "repo", "owner": {"login": "new"}}`)
+	})
+	defer done()
+	c.Dest = dest
+	c.Dry = false
+	c.Update = true
+	c.Repos = []string{"old/repo"}
+	c.RemoteBase = base
+	if _, _, err := c.Collect(); err != nil {
+		t.Fatal(err)
+	}
+	if !isGitRepo(filepath.Join(dest, "new", "repo")) {
+		t.Fatal("Repository should be moved to new directory")
+	}
+
+	pruned, err := (&Pruner{Dest: dest}).Prune(c.matched)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pruned) != 1 || pruned[0] != "a/gone" {
+		t.Error("Only repository not updated should be pruned:", pruned)
+	}
+	if !isGitRepo(filepath.Join(dest, "new", "repo")) {
+		t.Error("Renamed repository should not be pruned")
 	}
 }
 
-func TestDryRun(t *testing.T) {
-	token := os.Getenv("GITHUB_TOKEN")
-	if token == "" {
-		t.Skip("Skipping because API token not found")
+func TestCollectLookupByID(t *testing.T) {
+	c, done := testCollectorWithServer(t, "", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/repositories/7" {
+			t.Error("Unexpected endpoint:", r.URL.Path)
+		}
+		fmt.Fprint(w, `{"id": 7, "name": "repo", "owner": {"login": "new"}}`)
+	})
+	defer done()
+	c.manifest = &Manifest{Repos: map[string]*ManifestEntry{}}
+	c.manifest.Record(testManifestRepo("old", "repo", 7), nil, time.Now())
+
+	f := &found{repo: repoFromSlug("old/repo")}
+	c.lookup(f)
+	if s := repoSlug(f.repo); s != "new/repo" {
+		t.Error("Current slug should be fetched by ID:", s)
 	}
+}
 
-	c := NewCollector("user:rhysd", token, "test", nil, 2, true, false, false, nil)
-	_, _, err := c.Collect()
+func TestCollectMaxRepoSize(t *testing.T) {
+	c, done := testCollectorWithServer(t, "foo", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") != "1" {
+			fmt.Fprint(w, `{"total_count": 2, "items": []}`)
+			return
+		}
+		fmt.Fprint(w, `{"total_count": 2, "items": [
+			{"name": "small", "owner": {"login": "a"}, "size": 100},
+			{"name": "large", "owner": {"login": "a"}, "size": 2048}
+		]}`)
+	})
+	defer done()
+	c.MaxRepoSize = 1 << 20
+
+	count, _, err := c.Collect()
 	if err != nil {
 		t.Fatal(err)
 	}
+	if count != 1 || c.skipped != 1 {
+		t.Error("Repository larger than 1MB should be skipped:", count, c.skipped)
+	}
+	if len(c.matched) != 1 || c.matched[0] != "a/small" {
+		t.Error("Unexpected repositories:", c.matched)
+	}
+}
 
-	if _, err := os.Stat("test"); err == nil {
-		os.RemoveAll("test")
-		t.Fatal("'test' directory was created in spite of dry-run")
+func TestCollectMaxRepoSizeWithCount(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("page") {
+		case "1":
+			fmt.Fprint(w, `{"total_count": 2, "items": [{"name": "large", "owner": {"login": "a"}, "size": 2048}]}`)
+		case "2":
+			fmt.Fprint(w, `{"total_count": 2, "items": [{"name": "small", "owner": {"login": "a"}, "size": 100}]}`)
+		default:
+			fmt.Fprint(w, `{"total_count": 2, "items": []}`)
+		}
+	}))
+	defer srv.Close()
+
+	c := NewCollector("foo", "", "test", nil, 1, true, false, false, &PageConfig{1, PageUnlimited, 1})
+	u, err := url.Parse(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.client.BaseURL = u
+	c.MaxRepoSize = 1 << 20
+
+	count, _, err := c.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 || len(c.matched) != 1 || c.matched[0] != "a/small" {
+		t.Error("Next page should be fetched when repository is skipped by max size:", count, c.matched)
+	}
+}
+
+func TestCollectLatestRelease(t *testing.T) {
+	c, done := testCollectorWithServer(t, "", func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/a/released/releases/latest":
+			fmt.Fprint(w, `{"tag_name": "v1.2.3"}`)
+		case "/repos/a/unreleased/releases/latest":
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message": "Not Found"}`)
+		default:
+			t.Error("Unexpected endpoint:", r.URL.Path)
+		}
+	})
+	defer done()
+
+	if tag := c.latestRelease(repoFromSlug("a/released")); tag != "v1.2.3" {
+		t.Error("Tag of latest release should be resolved:", tag)
+	}
+	if tag := c.latestRelease(repoFromSlug("a/unreleased")); tag != "" {
+		t.Error("Default branch should be used when no release exists:", tag)
 	}
 }
@@ -0,0 +1,182 @@
+package ghca
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// credentialTimeout is a timeout of running 'git credential fill' since some credential helpers may
+// wait for user's input.
+const credentialTimeout = 10 * time.Second
+
+// tokenLookup is one source of GitHub API token in the resolution chain.
+type tokenLookup struct {
+	// source describes where the token is read from. It is shown in verbose logs
+	source string
+	lookup func() string
+}
+
+// tokenChain returns the chain of token sources in order of priority. Environment variables are
+// preferred, then the hosts file of gh CLI, Git credential helpers and netrc file.
+func tokenChain(host string) []tokenLookup {
+	chain := []tokenLookup{}
+	for _, e := range []string{"GITHUB_TOKEN", "GH_TOKEN"} {
+		e := e
+		chain = append(chain, tokenLookup{"$" + e, func() string { return os.Getenv(e) }})
+	}
+	if p := ghHostsPath(); p != "" {
+		chain = append(chain, tokenLookup{"gh hosts file " + p, func() string { return ghHostsToken(p, host) }})
+	}
+	chain = append(chain, tokenLookup{"git credential helper", func() string { return gitCredentialToken(host) }})
+	if p := netrcPath(); p != "" {
+		chain = append(chain, tokenLookup{"netrc file " + p, func() string { return netrcToken(p, "api."+host, host) }})
+	}
+	return chain
+}
+
+// resolveToken looks up GitHub API token for the host through the chain. It returns the token and
+// its source. Both are empty when no token is found.
+func resolveToken(chain []tokenLookup) (string, string) {
+	for _, l := range chain {
+		if t := strings.TrimSpace(l.lookup()); t != "" {
+			return t, l.source
+		}
+	}
+	return "", ""
+}
+
+// ghHostsPath returns the path to hosts file of gh CLI in the same way as gh.
+func ghHostsPath() string {
+	if d := os.Getenv("GH_CONFIG_DIR"); d != "" {
+		return filepath.Join(d, "hosts.yml")
+	}
+	if d := os.Getenv("XDG_CONFIG_HOME"); d != "" {
+		return filepath.Join(d, "gh", "hosts.yml")
+	}
+	if runtime.GOOS == "windows" {
+		if d := os.Getenv("AppData"); d != "" {
+			return filepath.Join(d, "GitHub CLI", "hosts.yml")
+		}
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".config", "gh", "hosts.yml")
+}
+
+// ghHostsToken reads the token for the host from hosts file of gh CLI. Tokens stored in system
+// keyring by gh cannot be read.
+func ghHostsToken(path, host string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	var hosts map[string]struct {
+		User       string `yaml:"user"`
+		OAuthToken string `yaml:"oauth_token"`
+		Users      map[string]struct {
+			OAuthToken string `yaml:"oauth_token"`
+		} `yaml:"users"`
+	}
+	if err := yaml.Unmarshal(b, &hosts); err != nil {
+		return ""
+	}
+	h, ok := hosts[host]
+	if !ok {
+		return ""
+	}
+	if h.OAuthToken != "" {
+		return h.OAuthToken
+	}
+	return h.Users[h.User].OAuthToken
+}
+
+// gitCredentialToken asks Git credential helpers for the password of the host with 'git credential
+// fill'. Prompts are disabled.
+func gitCredentialToken(host string) string {
+	ctx, cancel := context.WithTimeout(context.Background(), credentialTimeout)
+	defer cancel()
+
+	cmd := newExecBackend().command(ctx, nil, "credential", "fill")
+	// Never prompt even when no credential is stored. Git Credential Manager has its own variable
+	cmd.Env = append(cmd.Env, "GIT_TERMINAL_PROMPT=0", "GCM_INTERACTIVE=never")
+	cmd.Stdin = strings.NewReader(fmt.Sprintf("protocol=https\nhost=%s\n\n", host))
+	out, err := cmd.Output()
+	if err != nil {
+		return ""
+	}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		if p := strings.TrimPrefix(s.Text(), "password="); p != s.Text() {
+			return p
+		}
+	}
+	return ""
+}
+
+// netrcPath returns the path to netrc file. $NETRC is preferred as well as curl.
+func netrcPath() string {
+	if p := os.Getenv("NETRC"); p != "" {
+		return p
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	if runtime.GOOS == "windows" {
+		return filepath.Join(home, "_netrc")
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// netrcToken reads the password of the first matching machine in the netrc file. 'default' entry is
+// ignored so that a password for other hosts is never sent to GitHub.
+func netrcToken(path string, machines ...string) string {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+
+	passwords := map[string]string{}
+	machine := ""
+	fs := strings.Fields(string(b))
+	for i := 0; i < len(fs); i++ {
+		switch fs[i] {
+		case "machine":
+			if i+1 < len(fs) {
+				i++
+				machine = fs[i]
+			}
+		case "default":
+			machine = ""
+		case "password":
+			if i+1 < len(fs) && machine != "" {
+				i++
+				if _, ok := passwords[machine]; !ok {
+					passwords[machine] = fs[i]
+				}
+			}
+		case "macdef":
+			// Macros are not supported. Words in macro definition are ignored until next machine
+			machine = ""
+		}
+	}
+
+	for _, m := range machines {
+		if p, ok := passwords[m]; ok {
+			return p
+		}
+	}
+	return ""
+}
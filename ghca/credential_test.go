@@ -0,0 +1,203 @@
+package ghca
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testWriteFile(t *testing.T, dir, name, content string) string {
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestResolveTokenOrder(t *testing.T) {
+	called := []string{}
+	lookup := func(name, token string) tokenLookup {
+		return tokenLookup{name, func() string {
+			called = append(called, name)
+			return token
+		}}
+	}
+
+	tok, src := resolveToken([]tokenLookup{lookup("a", ""), lookup("b", " token-b\n"), lookup("c", "token-c")})
+	if tok != "token-b" || src != "b" {
+		t.Errorf("First found token should be used but got '%s' from '%s'", tok, src)
+	}
+	if strings.Join(called, ",") != "a,b" {
+		t.Error("Sources after found one should not be looked up:", called)
+	}
+
+	if tok, src := resolveToken([]tokenLookup{lookup("a", "")}); tok != "" || src != "" {
+		t.Errorf("Nothing should be found but got '%s' from '%s'", tok, src)
+	}
+}
+
+func TestGhHostsToken(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	p := testWriteFile(t, dir, "hosts.yml", `
+github.com:
+    user: alice
+    oauth_token: gho_old
+    git_protocol: https
+example.com:
+    oauth_token: other
+`)
+	if tok := ghHostsToken(p, "github.com"); tok != "gho_old" {
+		t.Error("Unexpected token:", tok)
+	}
+
+	p = testWriteFile(t, dir, "hosts2.yml", `
+github.com:
+    git_protocol: ssh
+    users:
+        alice:
+            oauth_token: gho_alice
+        bob:
+            oauth_token: gho_bob
+    user: bob
+`)
+	if tok := ghHostsToken(p, "github.com"); tok != "gho_bob" {
+		t.Error("Token of active user should be read but got", tok)
+	}
+
+	// Token is stored in keyring
+	p = testWriteFile(t, dir, "hosts3.yml", "github.com:\n    user: alice\n    git_protocol: https\n")
+	if tok := ghHostsToken(p, "github.com"); tok != "" {
+		t.Error("No token should be read but got", tok)
+	}
+	if tok := ghHostsToken(filepath.Join(dir, "not-existing.yml"), "github.com"); tok != "" {
+		t.Error("No token should be read from missing file but got", tok)
+	}
+}
+
+func TestNetrcToken(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	p := testWriteFile(t, dir, "netrc", `
+machine example.com login foo password bar
+machine github.com
+  login alice
+  password from-github
+machine api.github.com login alice password from-api
+default login anonymous password from-default
+`)
+	if tok := netrcToken(p, "api.github.com", "github.com"); tok != "from-api" {
+		t.Error("API host should be preferred but got", tok)
+	}
+	if tok := netrcToken(p, "github.com"); tok != "from-github" {
+		t.Error("Unexpected token:", tok)
+	}
+	if tok := netrcToken(p, "ghe.example.com"); tok != "" {
+		t.Error("Default entry should not be used but got", tok)
+	}
+
+	p = testWriteFile(t, dir, "netrc2", "default login anonymous password from-default\n")
+	if tok := netrcToken(p, "api.github.com", "github.com"); tok != "" {
+		t.Error("Default entry should not be used for GitHub but got", tok)
+	}
+}
+
+// testSetenv sets environment variables and returns a function to restore them.
+func testSetenv(envs map[string]string) func() {
+	restores := []func(){}
+	for k, v := range envs {
+		k := k
+		saved, ok := os.LookupEnv(k)
+		os.Setenv(k, v)
+		if ok {
+			restores = append(restores, func() { os.Setenv(k, saved) })
+		} else {
+			restores = append(restores, func() { os.Unsetenv(k) })
+		}
+	}
+	return func() {
+		for _, r := range restores {
+			r()
+		}
+	}
+}
+
+// testCredentialHelper configures Git credential helper via environment variables not to touch
+// user's Git config
+func testCredentialHelper(helper string) func() {
+	return testSetenv(map[string]string{
+		"GIT_CONFIG_COUNT":   "1",
+		"GIT_CONFIG_KEY_0":   "credential.https://github.com.helper",
+		"GIT_CONFIG_VALUE_0": helper,
+	})
+}
+
+func TestGitCredentialToken(t *testing.T) {
+	defer testCredentialHelper("!f() { echo username=x-access-token; echo password=from-helper; }; f")()
+
+	if tok := gitCredentialToken("github.com"); tok != "from-helper" {
+		t.Error("Token should be read from credential helper but got", tok)
+	}
+}
+
+func TestGitCredentialTokenNoPrompt(t *testing.T) {
+	defer testCredentialHelper("!f() { :; }; f")()
+
+	// Without stored credential, git would prompt for username unless prompts are disabled
+	start := time.Now()
+	if tok := gitCredentialToken("github.com"); tok != "" {
+		t.Error("No token should be read but got", tok)
+	}
+	if d := time.Since(start); d > credentialTimeout/2 {
+		t.Error("Asking credential helper should not wait for prompt:", d)
+	}
+}
+
+func TestTokenPreferGitCredentialToNetrc(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	marker := filepath.Join(dir, "called")
+	defer testCredentialHelper("!f() { touch '" + filepath.ToSlash(marker) + "'; echo username=x-access-token; echo password=from-helper; }; f")()
+	defer testSetenv(map[string]string{
+		"GITHUB_TOKEN":  "",
+		"GH_TOKEN":      "",
+		"GH_CONFIG_DIR": dir,
+		"NETRC":         testWriteFile(t, dir, "netrc", "machine api.github.com login x password from-netrc\n"),
+	})()
+
+	j := &Job{Queries: []string{"query"}, Dest: dir}
+	if err := j.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("Credential helper should not be run on validating job")
+	}
+
+	c, err := j.CLI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.token != "from-helper" || c.tokenSource != "git credential helper" {
+		t.Errorf("Token should be read from credential helper but got '%s' from '%s'", c.token, c.tokenSource)
+	}
+}
+
+func TestTokenChainSources(t *testing.T) {
+	chain := tokenChain("github.com")
+	srcs := []string{}
+	for _, l := range chain {
+		srcs = append(srcs, l.source)
+	}
+	s := strings.Join(srcs, ",")
+	for i, want := range []string{"$GITHUB_TOKEN", "$GH_TOKEN", "gh hosts file", "git credential helper", "netrc file"} {
+		if i >= len(srcs) || !strings.HasPrefix(srcs[i], want) {
+			t.Errorf("Source #%d should be %s: %s", i, want, s)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package ghca
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = []struct {
+	suffix string
+	scale  int64
+}{
+	{"TB", 1 << 40},
+	{"GB", 1 << 30},
+	{"MB", 1 << 20},
+	{"KB", 1 << 10},
+	{"T", 1 << 40},
+	{"G", 1 << 30},
+	{"M", 1 << 20},
+	{"K", 1 << 10},
+	{"B", 1},
+}
+
+// ParseSize parses a size such as '500MB', '2G' or '1024' into bytes. Units are 'B', 'K' (or 'KB'),
+// 'M' (or 'MB'), 'G' (or 'GB') and 'T' (or 'TB') and case-insensitive. 1K is 1024 bytes.
+func ParseSize(s string) (int64, error) {
+	t := strings.ToUpper(strings.TrimSpace(s))
+	scale := int64(1)
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(t, u.suffix) {
+			t = strings.TrimSpace(strings.TrimSuffix(t, u.suffix))
+			scale = u.scale
+			break
+		}
+	}
+	f, err := strconv.ParseFloat(t, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("Invalid size '%s'. Size must be a non-negative number with optional unit such as '500MB' or '2G'", s)
+	}
+	return int64(f * float64(scale)), nil
+}
+
+// formatSize formats bytes in human readable form.
+func formatSize(b int64) string {
+	for _, u := range sizeUnits[:4] {
+		if b >= u.scale {
+			return fmt.Sprintf("%.1f%s", float64(b)/float64(u.scale), u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", b)
+}
+
+// dirSize returns the total size of files in the directory. Files removed while walking are ignored.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// DiskBudget is a budget of disk space for dest directory. When the budget is exceeded, no more
+// repositories are cloned.
+type DiskBudget struct {
+	// MaxUsage is max total size of dest directory in bytes. 0 means unlimited.
+	MaxUsage int64
+	// MinFree is min free space of the disk where dest directory is in bytes. 0 means unlimited.
+	MinFree int64
+}
+
+// ParseDiskBudget parses a disk budget. It is comma-separated list of max usage of dest directory
+// such as '50GB' and min free space of the disk prefixed with 'free:' such as 'free:10GB'. For
+// example, '50GB,free:10GB' means stopping cloning when dest directory uses more than 50GB or free
+// space of the disk is less than 10GB.
+func ParseDiskBudget(s string) (*DiskBudget, error) {
+	b := &DiskBudget{}
+	for _, e := range strings.Split(s, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		if strings.HasPrefix(e, "free:") {
+			n, err := ParseSize(strings.TrimPrefix(e, "free:"))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid disk budget '%s': %v", s, err)
+			}
+			b.MinFree = n
+			continue
+		}
+		n, err := ParseSize(e)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid disk budget '%s': %v", s, err)
+		}
+		b.MaxUsage = n
+	}
+	if b.MaxUsage == 0 && b.MinFree == 0 {
+		return nil, fmt.Errorf("Disk budget '%s' must specify max usage such as '50GB' or min free space such as 'free:10GB'", s)
+	}
+	return b, nil
+}
+
+// exceeded checks the budget with current usage of dest directory. It returns the reason when the
+// budget is exceeded.
+func (b *DiskBudget) exceeded(dest string, usage int64) (string, error) {
+	if b.MaxUsage > 0 && usage >= b.MaxUsage {
+		return fmt.Sprintf("usage of '%s' reached %s (budget is %s)", dest, formatSize(usage), formatSize(b.MaxUsage)), nil
+	}
+	if b.MinFree > 0 {
+		free, err := freeSpace(dest)
+		if err != nil {
+			return "", err
+		}
+		if free < b.MinFree {
+			return fmt.Sprintf("free space of '%s' is %s (budget is %s)", dest, formatSize(free), formatSize(b.MinFree)), nil
+		}
+	}
+	return "", nil
+}
+
+// errTooLarge is returned when the repository being cloned grows past max size.
+var errTooLarge = errors.New("Repository exceeded max size")
@@ -0,0 +1,105 @@
+package ghca
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for s, want := range map[string]int64{
+		"0":      0,
+		"1024":   1024,
+		"10B":    10,
+		"2K":     2048,
+		"1.5kb":  1536,
+		"500MB":  500 << 20,
+		"2G":     2 << 30,
+		" 1 TB ": 1 << 40,
+	} {
+		have, err := ParseSize(s)
+		if err != nil {
+			t.Errorf("Size '%s' should be parsed: %v", s, err)
+			continue
+		}
+		if have != want {
+			t.Errorf("Size '%s' should be %d but got %d", s, want, have)
+		}
+	}
+
+	for _, s := range []string{"", "MB", "-1G", "10X", "ten"} {
+		if _, err := ParseSize(s); err == nil {
+			t.Errorf("Size '%s' should cause an error", s)
+		}
+	}
+}
+
+func TestParseDiskBudget(t *testing.T) {
+	b, err := ParseDiskBudget("50GB, free:10G")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.MaxUsage != 50<<30 || b.MinFree != 10<<30 {
+		t.Error("Unexpected budget:", b)
+	}
+
+	for _, s := range []string{"", "free:", "free:foo", "foo", ","} {
+		if _, err := ParseDiskBudget(s); err == nil {
+			t.Errorf("Disk budget '%s' should cause an error", s)
+		}
+	}
+}
+
+func TestDiskBudgetExceeded(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	b := &DiskBudget{MaxUsage: 100}
+	if r, err := b.exceeded(dir, 99); err != nil || r != "" {
+		t.Error("Budget should not be exceeded:", r, err)
+	}
+	if r, err := b.exceeded(dir, 100); err != nil || !strings.Contains(r, "usage") {
+		t.Error("Budget should be exceeded by usage:", r, err)
+	}
+
+	b = &DiskBudget{MinFree: 1 << 60}
+	if r, err := b.exceeded(dir, 0); err != nil || !strings.Contains(r, "free space") {
+		t.Error("Budget should be exceeded by free space:", r, err)
+	}
+}
+
+func TestDirSize(t *testing.T) {
+	dir, done := testDestDir(t, "a/b")
+	defer done()
+	for _, p := range []string{"x", filepath.Join("a", "b", "y")} {
+		if err := ioutil.WriteFile(filepath.Join(dir, p), make([]byte, 100), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, err := dirSize(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s != 200 {
+		t.Error("Total size of files should be 200 bytes:", s)
+	}
+}
+
+func TestClonerSkipOverBudget(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	cl := NewCloner(dir, nil, false, false)
+	cl.Budget = &DiskBudget{MinFree: 1 << 60}
+	cl.Start(1)
+	cl.Clone("rhysd/clever-f.vim")
+	cl.Shutdown()
+
+	if _, ok := cl.Skipped()["rhysd/clever-f.vim"]; !ok {
+		t.Error("Repository should be skipped when disk budget is exceeded:", cl.Skipped())
+	}
+	if len(cl.Cloned()) != 0 {
+		t.Error("Nothing should be cloned:", cl.Cloned())
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package ghca
+
+import "syscall"
+
+// freeSpace returns free space available to the user on the disk where the directory is in bytes.
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
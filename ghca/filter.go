@@ -0,0 +1,447 @@
+package ghca
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// Filter is a predicate on metadata of repositories returned from GitHub Search API. It is used to
+// filter out repositories which cannot be excluded by GitHub search syntax before cloning them.
+//
+// Filter expression consists of comparisons joined with '&&', '||' and '!'. Parentheses can group
+// sub-expressions. For example:
+//
+//	size<50000 && !archived && license in [mit, apache-2.0]
+//
+// Available fields are:
+//
+//	Numbers: size (in KB), stars, forks, open_issues, watchers
+//	Ages:    pushed_age, created_age, updated_age (e.g. pushed_age < 90d. Units are s, m, h, d, w, y)
+//	Strings: name, owner, full_name, language, license (SPDX ID), description
+//	Bools:   archived, fork, private, has_wiki, has_issues, has_pages
+//	Lists:   topics
+//
+// Numbers and ages can be compared with <, <=, >, >=, == and !=. Strings can be compared with ==,
+// != and 'in' (case-insensitively), or matched to a regular expression with =~ and !~. Bools can
+// appear alone or be compared with true or false. Lists can be checked with 'has' (e.g. topics has cli).
+type Filter struct {
+	src  string
+	pred func(*github.Repository) bool
+}
+
+// Match returns true when the repository satisfies the filter.
+func (f *Filter) Match(repo *github.Repository) bool {
+	return f.pred(repo)
+}
+
+func (f *Filter) String() string {
+	return f.src
+}
+
+var filterNumberFields = map[string]func(*github.Repository) float64{
+	"size":        func(r *github.Repository) float64 { return float64(r.GetSize()) },
+	"stars":       func(r *github.Repository) float64 { return float64(r.GetStargazersCount()) },
+	"forks":       func(r *github.Repository) float64 { return float64(r.GetForksCount()) },
+	"open_issues": func(r *github.Repository) float64 { return float64(r.GetOpenIssuesCount()) },
+	"watchers":    func(r *github.Repository) float64 { return float64(r.GetWatchersCount()) },
+}
+
+var filterAgeFields = map[string]func(*github.Repository) time.Time{
+	"pushed_age":  func(r *github.Repository) time.Time { return r.GetPushedAt().Time },
+	"created_age": func(r *github.Repository) time.Time { return r.GetCreatedAt().Time },
+	"updated_age": func(r *github.Repository) time.Time { return r.GetUpdatedAt().Time },
+}
+
+var filterStringFields = map[string]func(*github.Repository) string{
+	"name":        func(r *github.Repository) string { return r.GetName() },
+	"owner":       func(r *github.Repository) string { return r.GetOwner().GetLogin() },
+	"full_name":   func(r *github.Repository) string { return repoSlug(r) },
+	"language":    func(r *github.Repository) string { return r.GetLanguage() },
+	"license":     func(r *github.Repository) string { return r.GetLicense().GetSPDXID() },
+	"description": func(r *github.Repository) string { return r.GetDescription() },
+}
+
+var filterBoolFields = map[string]func(*github.Repository) bool{
+	"archived":   func(r *github.Repository) bool { return r.GetArchived() },
+	"fork":       func(r *github.Repository) bool { return r.GetFork() },
+	"private":    func(r *github.Repository) bool { return r.GetPrivate() },
+	"has_wiki":   func(r *github.Repository) bool { return r.GetHasWiki() },
+	"has_issues": func(r *github.Repository) bool { return r.GetHasIssues() },
+	"has_pages":  func(r *github.Repository) bool { return r.GetHasPages() },
+}
+
+var filterListFields = map[string]func(*github.Repository) []string{
+	"topics": func(r *github.Repository) []string { return r.Topics },
+}
+
+type filterToken struct {
+	kind  string // "word", "string", "op" or "eof"
+	text  string
+	start int
+}
+
+func lexFilter(src string) ([]filterToken, error) {
+	toks := []filterToken{}
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(src[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("Unterminated string at offset %d in filter %q", i, src)
+			}
+			toks = append(toks, filterToken{"string", src[i+1 : i+1+end], i})
+			i += end + 2
+		case strings.IndexByte("()[],", c) >= 0:
+			toks = append(toks, filterToken{"op", src[i : i+1], i})
+			i++
+		case strings.IndexByte("<>=!&|", c) >= 0:
+			op := src[i : i+1]
+			if i+1 < len(src) {
+				switch two := src[i : i+2]; two {
+				case "<=", ">=", "==", "!=", "=~", "!~", "&&", "||":
+					op = two
+				}
+			}
+			if op == "=" || op == "&" || op == "|" {
+				return nil, fmt.Errorf("Unknown operator %q at offset %d in filter %q", op, i, src)
+			}
+			toks = append(toks, filterToken{"op", op, i})
+			i += len(op)
+		default:
+			start := i
+			for i < len(src) && strings.IndexByte(" \t\n\r\"'()[],<>=!&|", src[i]) < 0 {
+				i++
+			}
+			toks = append(toks, filterToken{"word", src[start:i], start})
+		}
+	}
+	return append(toks, filterToken{"eof", "", len(src)}), nil
+}
+
+type filterParser struct {
+	src  string
+	toks []filterToken
+	pos  int
+}
+
+func (p *filterParser) peek() filterToken {
+	return p.toks[p.pos]
+}
+
+func (p *filterParser) next() filterToken {
+	t := p.toks[p.pos]
+	if t.kind != "eof" {
+		p.pos++
+	}
+	return t
+}
+
+func (p *filterParser) errorf(t filterToken, format string, args ...interface{}) error {
+	return fmt.Errorf("Invalid filter %q at offset %d: %s", p.src, t.start, fmt.Sprintf(format, args...))
+}
+
+func (p *filterParser) isOp(op string) bool {
+	t := p.peek()
+	return t.kind == "op" && t.text == op
+}
+
+func (p *filterParser) expect(op string) error {
+	if t := p.next(); t.kind != "op" || t.text != op {
+		return p.errorf(t, "%q is expected but got %q", op, t.text)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (func(*github.Repository) bool, error) {
+	lhs, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("||") {
+		p.next()
+		rhs, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := lhs
+		lhs = func(r *github.Repository) bool { return l(r) || rhs(r) }
+	}
+	return lhs, nil
+}
+
+func (p *filterParser) parseAnd() (func(*github.Repository) bool, error) {
+	lhs, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.isOp("&&") {
+		p.next()
+		rhs, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := lhs
+		lhs = func(r *github.Repository) bool { return l(r) && rhs(r) }
+	}
+	return lhs, nil
+}
+
+func (p *filterParser) parseUnary() (func(*github.Repository) bool, error) {
+	if p.isOp("!") {
+		p.next()
+		e, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(r *github.Repository) bool { return !e(r) }, nil
+	}
+	if p.isOp("(") {
+		p.next()
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *filterParser) parseValue() (filterToken, error) {
+	t := p.next()
+	if t.kind != "word" && t.kind != "string" {
+		return t, p.errorf(t, "value is expected but got %q", t.text)
+	}
+	return t, nil
+}
+
+func (p *filterParser) parseList() ([]string, error) {
+	if err := p.expect("["); err != nil {
+		return nil, err
+	}
+	vs := []string{}
+	for !p.isOp("]") {
+		if len(vs) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		t, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		vs = append(vs, t.text)
+	}
+	p.next()
+	return vs, nil
+}
+
+func isCompareOp(t filterToken) bool {
+	if t.kind != "op" {
+		return false
+	}
+	switch t.text {
+	case "<", "<=", ">", ">=", "==", "!=":
+		return true
+	default:
+		return false
+	}
+}
+
+func compareNumbers(op string, l, r float64) bool {
+	switch op {
+	case "<":
+		return l < r
+	case "<=":
+		return l <= r
+	case ">":
+		return l > r
+	case ">=":
+		return l >= r
+	case "==":
+		return l == r
+	default:
+		return l != r
+	}
+}
+
+// parseAge parses an age such as '90d'. Units are s, m, h, d (days), w (weeks) and y (365 days).
+func parseAge(s string) (time.Duration, bool) {
+	units := map[byte]time.Duration{
+		's': time.Second,
+		'm': time.Minute,
+		'h': time.Hour,
+		'd': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+		'y': 365 * 24 * time.Hour,
+	}
+	if len(s) < 2 {
+		return 0, false
+	}
+	u, ok := units[s[len(s)-1]]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(s[:len(s)-1], 64)
+	if err != nil {
+		return 0, false
+	}
+	return time.Duration(n * float64(u)), true
+}
+
+func (p *filterParser) parseComparison() (func(*github.Repository) bool, error) {
+	field := p.next()
+	if field.kind != "word" {
+		return nil, p.errorf(field, "field name is expected but got %q", field.text)
+	}
+	name := field.text
+	op := p.peek()
+
+	if get, ok := filterBoolFields[name]; ok {
+		if op.kind != "op" || (op.text != "==" && op.text != "!=") {
+			return get, nil
+		}
+		p.next()
+		t, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		want, err := strconv.ParseBool(t.text)
+		if err != nil {
+			return nil, p.errorf(t, "boolean value is expected for field %q but got %q", name, t.text)
+		}
+		if op.text == "!=" {
+			want = !want
+		}
+		return func(r *github.Repository) bool { return get(r) == want }, nil
+	}
+
+	if get, ok := filterListFields[name]; ok {
+		if op.kind != "word" || op.text != "has" {
+			return nil, p.errorf(op, "only 'has' operator is available for field %q", name)
+		}
+		p.next()
+		t, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return func(r *github.Repository) bool {
+			for _, v := range get(r) {
+				if strings.EqualFold(v, t.text) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	if get, ok := filterNumberFields[name]; ok {
+		if !isCompareOp(op) {
+			return nil, p.errorf(op, "comparison operator is expected after field %q but got %q", name, op.text)
+		}
+		p.next()
+		t, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		want, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, p.errorf(t, "number is expected for field %q but got %q", name, t.text)
+		}
+		return func(r *github.Repository) bool { return compareNumbers(op.text, get(r), want) }, nil
+	}
+
+	if get, ok := filterAgeFields[name]; ok {
+		if !isCompareOp(op) {
+			return nil, p.errorf(op, "comparison operator is expected after field %q but got %q", name, op.text)
+		}
+		p.next()
+		t, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		want, ok := parseAge(t.text)
+		if !ok {
+			return nil, p.errorf(t, "age such as '30d' is expected for field %q but got %q", name, t.text)
+		}
+		return func(r *github.Repository) bool {
+			return compareNumbers(op.text, float64(time.Since(get(r))), float64(want))
+		}, nil
+	}
+
+	if get, ok := filterStringFields[name]; ok {
+		if op.kind == "word" && op.text == "in" {
+			p.next()
+			vs, err := p.parseList()
+			if err != nil {
+				return nil, err
+			}
+			return func(r *github.Repository) bool {
+				s := get(r)
+				for _, v := range vs {
+					if strings.EqualFold(s, v) {
+						return true
+					}
+				}
+				return false
+			}, nil
+		}
+		if op.kind != "op" {
+			return nil, p.errorf(op, "operator is expected after field %q but got %q", name, op.text)
+		}
+		p.next()
+		t, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		switch op.text {
+		case "==":
+			return func(r *github.Repository) bool { return strings.EqualFold(get(r), t.text) }, nil
+		case "!=":
+			return func(r *github.Repository) bool { return !strings.EqualFold(get(r), t.text) }, nil
+		case "=~", "!~":
+			re, err := regexp.Compile(t.text)
+			if err != nil {
+				return nil, p.errorf(t, "invalid regular expression: %v", err)
+			}
+			neg := op.text == "!~"
+			return func(r *github.Repository) bool { return re.MatchString(get(r)) != neg }, nil
+		default:
+			return nil, p.errorf(op, "operator %q is not available for field %q", op.text, name)
+		}
+	}
+
+	return nil, p.errorf(field, "unknown field %q", name)
+}
+
+// ParseFilter parses given filter expression. Please see the document of Filter for the syntax.
+func ParseFilter(src string) (*Filter, error) {
+	toks, err := lexFilter(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &filterParser{src: src, toks: toks}
+	if p.peek().kind == "eof" {
+		return nil, errors.New("Filter cannot be empty")
+	}
+	pred, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != "eof" {
+		return nil, p.errorf(t, "unexpected token %q", t.text)
+	}
+	return &Filter{src, pred}, nil
+}
@@ -0,0 +1,122 @@
+package ghca
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func testFilterRepo() *github.Repository {
+	return &github.Repository{
+		Name:            github.String("clever-f.vim"),
+		Owner:           &github.User{Login: github.String("rhysd")},
+		Language:        github.String("Vim script"),
+		Size:            github.Int(1000),
+		StargazersCount: github.Int(500),
+		Archived:        github.Bool(false),
+		Fork:            github.Bool(false),
+		License:         &github.License{SPDXID: github.String("MIT")},
+		Topics:          []string{"vim", "plugin"},
+		PushedAt:        &github.Timestamp{Time: time.Now().Add(-48 * time.Hour)},
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	repo := testFilterRepo()
+	for _, tc := range []struct {
+		src  string
+		want bool
+	}{
+		{"size<50000", true},
+		{"size>=50000", false},
+		{"stars == 500", true},
+		{"!archived", true},
+		{"archived", false},
+		{"archived == false", true},
+		{"fork != true", true},
+		{"license in [mit, apache-2.0]", true},
+		{"license in [apache-2.0]", false},
+		{"license == mit", true},
+		{"language == 'vim script'", true},
+		{"name =~ '\\.vim$'", true},
+		{"name !~ '\\.vim$'", false},
+		{"full_name == rhysd/clever-f.vim", true},
+		{"topics has plugin", true},
+		{"topics has go", false},
+		{"pushed_age < 3d", true},
+		{"pushed_age < 1d", false},
+		{"size<50000 && !archived && license in [mit, apache-2.0]", true},
+		{"size>50000 || stars>100", true},
+		{"!(size<50000 && stars>100)", false},
+		{"size>50000 || stars>100 && archived", false},
+	} {
+		f, err := ParseFilter(tc.src)
+		if err != nil {
+			t.Errorf("Failed to parse %q: %v", tc.src, err)
+			continue
+		}
+		if have := f.Match(repo); have != tc.want {
+			t.Errorf("Filter %q should return %v but got %v", tc.src, tc.want, have)
+		}
+	}
+}
+
+func TestFilterParseError(t *testing.T) {
+	for _, src := range []string{
+		"",
+		"unknown_field > 1",
+		"size < foo",
+		"size =~ foo",
+		"size = 1",
+		"pushed_age < 10",
+		"archived == maybe",
+		"license in mit",
+		"license in [mit",
+		"topics == foo",
+		"name =~ '('",
+		"(size < 1",
+		"size < 1 stars > 2",
+		"name == 'foo",
+	} {
+		if _, err := ParseFilter(src); err == nil {
+			t.Errorf("Invalid filter %q should cause an error", src)
+		}
+	}
+}
+
+func TestCollectWithFilter(t *testing.T) {
+	c, done := testCollectorWithServer(t, "language:vim", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") != "1" {
+			fmt.Fprint(w, `{"total_count": 3, "items": []}`)
+			return
+		}
+		fmt.Fprint(w, `{"total_count": 3, "items": [
+			{"name": "foo", "owner": {"login": "a"}, "size": 100},
+			{"name": "bar", "owner": {"login": "b"}, "size": 100, "archived": true},
+			{"name": "piyo", "owner": {"login": "c"}, "size": 100000}
+		]}`)
+	})
+	defer done()
+	f, err := ParseFilter("size<50000 && !archived")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Filter = f
+
+	count, total, err := c.Collect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 3 {
+		t.Error("Unexpected total:", total)
+	}
+	if count != 1 {
+		t.Error("Only one repository should pass the filter:", count)
+	}
+	if c.filtered != 2 {
+		t.Error("Two repositories should be filtered out:", c.filtered)
+	}
+}
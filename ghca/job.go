@@ -0,0 +1,311 @@
+package ghca
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Job is a declarative description of one run of github-clone-all. It is loaded from a YAML or TOML
+// file with LoadJob and maps onto the same options as command line flags. For example,
+//
+//	queries:
+//	  - language:vim fork:false
+//	  - filename:.vimrc
+//	repos:
+//	  - rhysd/clever-f.vim
+//	dest: ./repos
+//	extract: '(\.vim|vimrc)$'
+//	filter: size<50000 && !archived
+//	concurrency: 4
+//	retries: 2
+type Job struct {
+	// Queries is a list of queries to search.
+	Queries []string `yaml:"queries" toml:"queries"`
+	// Repos is a list of repositories to clone in 'owner/name' format.
+	Repos []string `yaml:"repos" toml:"repos"`
+	// Code indicates searching code instead of repositories.
+	Code bool `yaml:"code" toml:"code"`
+	// MatchedOnly indicates only files matched by code search remain.
+	MatchedOnly bool `yaml:"matched_only" toml:"matched_only"`
+	// Token is a GitHub API token. Writing a token in a file is not recommended. Please consider to
+	// use TokenEnv instead.
+	Token string `yaml:"token" toml:"token"`
+	// TokenEnv is a name of environment variable which has GitHub API token.
+	TokenEnv string `yaml:"token_env" toml:"token_env"`
+	// TokensEnv is a list of names of environment variables which have additional GitHub API tokens.
+	// All tokens are rotated in a token pool.
+	TokensEnv []string `yaml:"tokens_env" toml:"tokens_env"`
+	// AppID is an ID of GitHub App to authenticate with its installation tokens.
+	AppID int64 `yaml:"app_id" toml:"app_id"`
+	// AppInstallationID is an ID of installation of the GitHub App.
+	AppInstallationID int64 `yaml:"app_installation_id" toml:"app_installation_id"`
+	// AppPrivateKey is a path to private key file of the GitHub App.
+	AppPrivateKey string `yaml:"app_private_key" toml:"app_private_key"`
+	// Verbose indicates showing verbose logs such as where the token was read from.
+	Verbose bool `yaml:"verbose" toml:"verbose"`
+	// Proxy is a URL of HTTP proxy to access GitHub API and remotes.
+	Proxy string `yaml:"proxy" toml:"proxy"`
+	// CABundle is a path to PEM file of extra CA certificates.
+	CABundle string `yaml:"ca_bundle" toml:"ca_bundle"`
+	// APITimeout is a timeout of each API request such as '30s'.
+	APITimeout string `yaml:"api_timeout" toml:"api_timeout"`
+	// CloneTimeout is a timeout of cloning one repository such as '10m'.
+	CloneTimeout string `yaml:"clone_timeout" toml:"clone_timeout"`
+	// StallTimeout is a duration to wait for progress of cloning one repository such as '60s'.
+	StallTimeout string `yaml:"stall_timeout" toml:"stall_timeout"`
+	// HTTPCache is a directory to cache responses of GitHub API. Relative path is resolved from
+	// current working directory.
+	HTTPCache string `yaml:"http_cache" toml:"http_cache"`
+	// Record is a directory to record responses of GitHub API into.
+	Record string `yaml:"record" toml:"record"`
+	// Replay is a directory of API responses recorded with Record to use instead of calling GitHub API.
+	Replay string `yaml:"replay" toml:"replay"`
+	// Dest is a directory to clone repositories into. Relative path is resolved from current
+	// working directory.
+	Dest string `yaml:"dest" toml:"dest"`
+	// Extract is a regular expression to extract files by name in each cloned repository.
+	Extract string `yaml:"extract" toml:"extract"`
+	// Filter is an expression to filter repositories. Please see Filter.
+	Filter string `yaml:"filter" toml:"filter"`
+	// Sort is a field to sort search results.
+	Sort string `yaml:"sort" toml:"sort"`
+	// Order is an order of sorting search results.
+	Order string `yaml:"order" toml:"order"`
+	// Count is max number of repositories to clone.
+	Count int `yaml:"count" toml:"count"`
+	// Dry indicates doing dry-run instead of cloning repositories.
+	Dry bool `yaml:"dry" toml:"dry"`
+	// Deep indicates shallow clone is not used.
+	Deep bool `yaml:"deep" toml:"deep"`
+	// SSH indicates use of SSH protocol instead of HTTPS.
+	SSH bool `yaml:"ssh" toml:"ssh"`
+	// Quiet indicates running quietly.
+	Quiet bool `yaml:"quiet" toml:"quiet"`
+	// Concurrency is the number of workers to clone repositories.
+	Concurrency int `yaml:"concurrency" toml:"concurrency"`
+	// Retries is how many times cloning a repository is retried on failure.
+	Retries int `yaml:"retries" toml:"retries"`
+	// Format is a format of dry-run output. 'text', 'table' or 'json'.
+	Format string `yaml:"format" toml:"format"`
+	// Layout is a template of directory path to clone each repository into. Please see Layout.
+	Layout string `yaml:"layout" toml:"layout"`
+	// Prune indicates repositories in dest directory which are no longer in search results are
+	// pruned after cloning.
+	Prune bool `yaml:"prune" toml:"prune"`
+	// Quarantine is a directory to move pruned repositories into instead of removing them.
+	Quarantine string `yaml:"quarantine" toml:"quarantine"`
+	// MaxRepoSize is max size of one repository such as '500MB'.
+	MaxRepoSize string `yaml:"max_repo_size" toml:"max_repo_size"`
+	// DiskBudget is a disk budget of dest directory such as '50GB,free:10GB'.
+	DiskBudget string `yaml:"disk_budget" toml:"disk_budget"`
+	// Bare indicates cloning bare repositories into 'owner/name.git' directories.
+	Bare bool `yaml:"bare" toml:"bare"`
+	// Mirror indicates cloning mirror repositories into 'owner/name.git' directories.
+	Mirror bool `yaml:"mirror" toml:"mirror"`
+	// WithWiki indicates wikis are also cloned.
+	WithWiki bool `yaml:"with_wiki" toml:"with_wiki"`
+	// WithIssues indicates issues, pull requests and their comments are also exported as JSON.
+	WithIssues bool `yaml:"with_issues" toml:"with_issues"`
+	// Submodules indicates submodules are cloned recursively.
+	Submodules bool `yaml:"submodules" toml:"submodules"`
+	// LFS is how to handle Git LFS objects. 'skip' or 'fetch'.
+	LFS string `yaml:"lfs" toml:"lfs"`
+	// Ref is a branch or tag to clone, ':latest-release' or ':all'.
+	Ref string `yaml:"ref" toml:"ref"`
+	// Depth is the number of commits to fetch on shallow clone.
+	Depth int `yaml:"depth" toml:"depth"`
+	// ShallowSince is a date or age such as '1y' to limit history on shallow clone.
+	ShallowSince string `yaml:"shallow_since" toml:"shallow_since"`
+	// Backend is a backend to clone repositories. 'exec', 'go-git' or 'archive'.
+	Backend string `yaml:"backend" toml:"backend"`
+	// SSHKnownHosts is a path to known_hosts file to verify host keys on cloning via SSH.
+	SSHKnownHosts string `yaml:"ssh_known_hosts" toml:"ssh_known_hosts"`
+	// SSHIdentity is a path to private key file to authenticate on cloning via SSH.
+	SSHIdentity string `yaml:"ssh_identity" toml:"ssh_identity"`
+	// InsecureSSH disables verification of host keys on cloning via SSH.
+	InsecureSSH bool `yaml:"insecure_ssh" toml:"insecure_ssh"`
+}
+
+// Validate checks values of the job.
+func (j *Job) Validate() error {
+	if len(j.Queries) == 0 && len(j.Repos) == 0 {
+		return errors.New("At least one of 'queries' or 'repos' must be specified")
+	}
+	for _, q := range j.Queries {
+		if strings.TrimSpace(q) == "" {
+			return errors.New("Query in 'queries' cannot be empty")
+		}
+	}
+	for _, r := range j.Repos {
+		if err := validateSlug(r); err != nil {
+			return err
+		}
+	}
+	if j.Token != "" && j.TokenEnv != "" {
+		return errors.New("Only one of 'token' or 'token_env' can be specified")
+	}
+	if j.TokenEnv != "" && os.Getenv(j.TokenEnv) == "" {
+		return fmt.Errorf("Environment variable $%s specified at 'token_env' is not set", j.TokenEnv)
+	}
+	for _, e := range j.TokensEnv {
+		if os.Getenv(e) == "" {
+			return fmt.Errorf("Environment variable $%s specified at 'tokens_env' is not set", e)
+		}
+	}
+	if j.Extract != "" {
+		if _, err := regexp.Compile(j.Extract); err != nil {
+			return fmt.Errorf("Invalid regular expression at 'extract': %v", err)
+		}
+	}
+	if j.Count < 0 {
+		return fmt.Errorf("'count' must not be negative but got %d", j.Count)
+	}
+	c, err := j.cli()
+	if err != nil {
+		return err
+	}
+	_, err = c.config()
+	return err
+}
+
+// CLI creates a command line interface from the job. When no token is specified in the job, it is
+// looked up from environment.
+func (j *Job) CLI() (*CLI, error) {
+	c, err := j.cli()
+	if err != nil {
+		return nil, err
+	}
+	c.lookupToken()
+	return c, nil
+}
+
+func (j *Job) cli() (*CLI, error) {
+	token := j.Token
+	if j.TokenEnv != "" {
+		token = os.Getenv(j.TokenEnv)
+	}
+
+	query := ""
+	queries := []string{}
+	for _, q := range j.Queries {
+		queries = append(queries, strings.TrimSpace(q))
+	}
+	if len(queries) > 0 {
+		query = queries[0]
+		queries = queries[1:]
+	}
+
+	c, err := newCLI(token, query, j.Dest, j.Extract, j.Count, j.Dry, j.Deep, j.SSH)
+	if err != nil {
+		return nil, err
+	}
+	if j.TokenEnv != "" {
+		c.tokenSource = "$" + j.TokenEnv
+	}
+	c.Code = j.Code
+	c.MatchedOnly = j.MatchedOnly
+	c.Filter = j.Filter
+	c.Queries = queries
+	c.Sort = j.Sort
+	c.Order = j.Order
+	c.Repos = j.Repos
+	c.Concurrency = j.Concurrency
+	c.Retries = j.Retries
+	c.Format = j.Format
+	c.Layout = j.Layout
+	c.PruneStale = j.Prune
+	c.Quarantine = j.Quarantine
+	c.MaxRepoSize = j.MaxRepoSize
+	c.DiskBudget = j.DiskBudget
+	c.Bare = j.Bare
+	c.Mirror = j.Mirror
+	c.WithWiki = j.WithWiki
+	c.WithIssues = j.WithIssues
+	c.Submodules = j.Submodules
+	c.LFS = j.LFS
+	c.Ref = j.Ref
+	c.Depth = j.Depth
+	c.ShallowSince = j.ShallowSince
+	c.Backend = j.Backend
+	c.SSHKnownHosts = j.SSHKnownHosts
+	c.SSHIdentity = j.SSHIdentity
+	c.InsecureSSH = j.InsecureSSH
+	for _, e := range j.TokensEnv {
+		if t := os.Getenv(e); t != "" {
+			c.Tokens = append(c.Tokens, t)
+		}
+	}
+	c.AppID = j.AppID
+	c.AppInstallationID = j.AppInstallationID
+	c.AppPrivateKey = j.AppPrivateKey
+	c.Verbose = j.Verbose
+	c.Proxy = j.Proxy
+	c.CABundle = j.CABundle
+	c.APITimeout = j.APITimeout
+	c.CloneTimeout = j.CloneTimeout
+	c.StallTimeout = j.StallTimeout
+	c.HTTPCache = j.HTTPCache
+	c.Record = j.Record
+	c.Replay = j.Replay
+	return c, nil
+}
+
+func parseJob(b []byte, ext string) (*Job, error) {
+	j := &Job{}
+	switch ext {
+	case ".yml", ".yaml":
+		if err := yaml.UnmarshalStrict(b, j); err != nil {
+			return nil, err
+		}
+	case ".toml":
+		md, err := toml.DecodeReader(bytes.NewReader(b), j)
+		if err != nil {
+			return nil, err
+		}
+		if keys := md.Undecoded(); len(keys) > 0 {
+			ks := make([]string, 0, len(keys))
+			for _, k := range keys {
+				ks = append(ks, k.String())
+			}
+			return nil, fmt.Errorf("Unknown keys: %s", strings.Join(ks, ", "))
+		}
+	default:
+		return nil, fmt.Errorf("Unknown file extension '%s'. Only .yml, .yaml and .toml are supported", ext)
+	}
+	return j, nil
+}
+
+// ReadJob reads a job from a YAML (.yml or .yaml) or TOML (.toml) file without validating values.
+// Call Validate after modifying the job, for example with command line options.
+func ReadJob(path string) (*Job, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	j, err := parseJob(b, strings.ToLower(filepath.Ext(path)))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid job file '%s': %v", path, err)
+	}
+	return j, nil
+}
+
+// LoadJob loads a job from a YAML (.yml or .yaml) or TOML (.toml) file and validates it.
+func LoadJob(path string) (*Job, error) {
+	j, err := ReadJob(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := j.Validate(); err != nil {
+		return nil, fmt.Errorf("Invalid job file '%s': %v", path, err)
+	}
+	return j, nil
+}
@@ -0,0 +1,174 @@
+package ghca
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestJob(t *testing.T, name, content string) (string, func()) {
+	dir, err := ioutil.TempDir("", "ghca-job")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return p, func() { os.RemoveAll(dir) }
+}
+
+func TestLoadJobYAML(t *testing.T) {
+	p, done := writeTestJob(t, "job.yaml", `
+queries:
+  - language:vim fork:false
+  - filename:.vimrc
+repos:
+  - rhysd/clever-f.vim
+token: foo
+dest: out
+extract: '\.vim$'
+filter: size<50000 && !archived
+sort: stars
+count: 10
+dry: true
+concurrency: 4
+retries: 2
+format: json
+`)
+	defer done()
+
+	j, err := LoadJob(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := j.CLI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.query != "language:vim fork:false" {
+		t.Error("First query should be main query:", c.query)
+	}
+	if len(c.Queries) != 1 || c.Queries[0] != "filename:.vimrc" {
+		t.Error("Rest of queries should be additional queries:", c.Queries)
+	}
+	if len(c.Repos) != 1 || c.Repos[0] != "rhysd/clever-f.vim" {
+		t.Error("Unexpected repos:", c.Repos)
+	}
+	if c.token != "foo" || c.dest != "out" || c.extract == nil || c.count != 10 || !c.dry {
+		t.Error("Options were not mapped to CLI:", c)
+	}
+	if c.Filter != "size<50000 && !archived" || c.Sort != "stars" || c.Concurrency != 4 || c.Retries != 2 || c.Format != "json" {
+		t.Error("Options were not mapped to CLI:", c)
+	}
+}
+
+func TestLoadJobTOML(t *testing.T) {
+	p, done := writeTestJob(t, "job.toml", `
+repos = ["rhysd/clever-f.vim", "rhysd/vim-gfm-syntax"]
+token_env = "GHCA_TEST_TOKEN"
+deep = true
+`)
+	defer done()
+
+	os.Setenv("GHCA_TEST_TOKEN", "from-env")
+	defer os.Unsetenv("GHCA_TEST_TOKEN")
+
+	j, err := LoadJob(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := j.CLI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.query != "" || len(c.Repos) != 2 {
+		t.Error("Only repositories should be set:", c.query, c.Repos)
+	}
+	if c.token != "from-env" {
+		t.Error("Token should be read from environment variable:", c.token)
+	}
+	if !c.deep {
+		t.Error("Deep clone should be enabled")
+	}
+}
+
+func TestLoadJobError(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		want    string
+	}{
+		{"job.yaml", "queries: [foo]\nunknown: 1\n", "unknown"},
+		{"job.toml", "queries = [\"foo\"]\nunknown = 1\n", "Unknown keys: unknown"},
+		{"job.json", "{}", "Unknown file extension"},
+		{"job.yaml", "dest: foo\n", "At least one of 'queries' or 'repos'"},
+		{"job.yaml", "queries: ['  ']\n", "cannot be empty"},
+		{"job.yaml", "repos: [foo]\n", "'owner/name' format"},
+		{"job.yaml", "queries: [foo]\nextract: '(foo'\n", "'extract'"},
+		{"job.yaml", "queries: [foo]\nfilter: 'size <'\n", "Invalid filter"},
+		{"job.yaml", "queries: [foo]\nsort: name\n", "Sort must be"},
+		{"job.yaml", "queries: [foo]\nformat: xml\n", "Format must be"},
+		{"job.yaml", "queries: [foo]\ncount: -1\n", "'count'"},
+		{"job.yaml", "queries: [foo]\ntoken: a\ntoken_env: B\n", "'token' or 'token_env'"},
+		{"job.yaml", "queries: [foo]\ntoken_env: GHCA_TEST_NOT_EXISTING_ENV\n", "is not set"},
+		{"job.yaml", "queries: foo: bar\n", "job.yaml"},
+	} {
+		p, done := writeTestJob(t, tc.name, tc.content)
+		_, err := LoadJob(p)
+		done()
+		if err == nil {
+			t.Errorf("Job %q should cause an error", tc.content)
+			continue
+		}
+		if msg := err.Error(); !strings.Contains(msg, tc.want) || !strings.Contains(msg, p) {
+			t.Errorf("Error for job %q should mention %q and the file path: %s", tc.content, tc.want, msg)
+		}
+	}
+}
+
+func TestReadJobThenOverride(t *testing.T) {
+	p, done := writeTestJob(t, "job.yaml", "dest: out\ntoken_env: GHCA_TEST_NOT_EXISTING_ENV\n")
+	defer done()
+
+	if _, err := LoadJob(p); err == nil {
+		t.Fatal("Job without queries should be invalid")
+	}
+	j, err := ReadJob(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Values given by command line options are merged before validation
+	j.Queries = []string{"foo"}
+	j.Token = "bar"
+	j.TokenEnv = ""
+	if err := j.Validate(); err != nil {
+		t.Fatal("Job should be valid after merging options:", err)
+	}
+	c, err := j.CLI()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.query != "foo" || c.token != "bar" || c.dest != "out" {
+		t.Errorf("Unexpected CLI: query=%q token=%q dest=%q", c.query, c.token, c.dest)
+	}
+}
+
+func TestValidateJobWithoutSideEffect(t *testing.T) {
+	j := &Job{
+		Queries:           []string{"foo"},
+		AppID:             12,
+		AppInstallationID: 42,
+		AppPrivateKey:     "/path/to/not-existing.pem",
+	}
+	// Private key is read on running, not on validation
+	if err := j.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	j.AppInstallationID = 0
+	if err := j.Validate(); err == nil {
+		t.Error("App ID without installation ID should be invalid")
+	}
+}
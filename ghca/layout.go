@@ -0,0 +1,161 @@
+package ghca
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/github"
+)
+
+// DefaultLayout is a layout used when no layout is specified.
+const DefaultLayout = "{owner}/{name}"
+
+// layoutVars is a map from placeholder to a function to get its value from repository metadata.
+var layoutVars = map[string]func(r *github.Repository) string{
+	"owner":          func(r *github.Repository) string { return r.GetOwner().GetLogin() },
+	"name":           func(r *github.Repository) string { return r.GetName() },
+	"id":             func(r *github.Repository) string { return strconv.FormatInt(r.GetID(), 10) },
+	"language":       func(r *github.Repository) string { return r.GetLanguage() },
+	"license":        func(r *github.Repository) string { return r.GetLicense().GetSPDXID() },
+	"default_branch": func(r *github.Repository) string { return r.GetDefaultBranch() },
+	"stars_bucket":   func(r *github.Repository) string { return starsBucket(r.GetStargazersCount()) },
+}
+
+// starsBucket returns a range of stars by power of 10 such as '100-999'.
+func starsBucket(stars int) string {
+	if stars < 10 {
+		return "0-9"
+	}
+	lo := 1
+	for lo*10 <= stars {
+		lo *= 10
+	}
+	return fmt.Sprintf("%d-%d", lo, lo*10-1)
+}
+
+// sanitizePathElem replaces characters which are unsafe in a file path with '_'. Empty value is
+// replaced with 'unknown'.
+func sanitizePathElem(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	b := []byte(s)
+	for i, c := range b {
+		if c < 0x20 || c == 0x7f || strings.IndexByte(`/\:*?"<>|`, c) >= 0 {
+			b[i] = '_'
+		}
+	}
+	if b[0] == '.' {
+		// Avoid '..' and hidden entries which are ignored as repositories
+		b[0] = '_'
+	}
+	return string(b)
+}
+
+type layoutPart struct {
+	lit string
+	// name is a name of placeholder. Empty when this part is a literal.
+	name string
+}
+
+// Layout is a template of the directory path where each repository is cloned. Path is relative to
+// dest directory and separated with '/'. Placeholders enclosed with '{' and '}' are replaced with
+// repository metadata. Available placeholders are:
+//
+//	{owner}, {name}, {id}, {language}, {license}, {default_branch}, {stars_bucket} (e.g. '100-999') and
+//	{sha} (commit SHA of cloned HEAD)
+//
+// Characters unsafe in a file path in values are replaced with '_' and empty values are replaced with
+// 'unknown'.
+type Layout struct {
+	src   string
+	parts []layoutPart
+	sha   bool
+	depth int
+}
+
+// ParseLayout parses the layout template.
+func ParseLayout(src string) (*Layout, error) {
+	if src == "" {
+		return nil, errors.New("Layout cannot be empty")
+	}
+	if strings.HasPrefix(src, "/") || strings.Contains(src, `\`) {
+		return nil, fmt.Errorf("Layout must be a relative path separated with '/' but got '%s'", src)
+	}
+	for _, e := range strings.Split(src, "/") {
+		if e == "" || e == "." || e == ".." {
+			return nil, fmt.Errorf("Layout '%s' contains invalid path element '%s'", src, e)
+		}
+	}
+
+	l := &Layout{src: src, depth: strings.Count(src, "/") + 1}
+	hasName, hasID := false, false
+	for s := src; s != ""; {
+		i := strings.IndexByte(s, '{')
+		if i < 0 {
+			l.parts = append(l.parts, layoutPart{lit: s})
+			break
+		}
+		if i > 0 {
+			l.parts = append(l.parts, layoutPart{lit: s[:i]})
+		}
+		j := strings.IndexByte(s[i:], '}')
+		if j < 0 {
+			return nil, fmt.Errorf("Placeholder is not closed with '}' in layout '%s'", src)
+		}
+		name := s[i+1 : i+j]
+		if _, ok := layoutVars[name]; !ok && name != "sha" {
+			return nil, fmt.Errorf("Unknown placeholder '{%s}' in layout '%s'", name, src)
+		}
+		switch name {
+		case "sha":
+			l.sha = true
+		case "name":
+			hasName = true
+		case "id":
+			hasID = true
+		}
+		l.parts = append(l.parts, layoutPart{name: name})
+		s = s[i+j+1:]
+	}
+	if !hasName && !hasID {
+		return nil, fmt.Errorf("Layout '%s' must contain '{name}' or '{id}' to distinguish repositories", src)
+	}
+
+	return l, nil
+}
+
+// Render renders the path of the repository. 'sha' is a commit SHA of cloned HEAD. It can be empty
+// when the layout does not contain '{sha}'.
+func (l *Layout) Render(repo *github.Repository, sha string) string {
+	var b strings.Builder
+	for _, p := range l.parts {
+		if p.name == "" {
+			b.WriteString(p.lit)
+			continue
+		}
+		v := sha
+		if p.name != "sha" {
+			v = layoutVars[p.name](repo)
+		}
+		b.WriteString(sanitizePathElem(v))
+	}
+	return path.Clean(b.String())
+}
+
+// NeedsSHA returns true when rendering the layout requires commit SHA of cloned HEAD.
+func (l *Layout) NeedsSHA() bool {
+	return l.sha
+}
+
+// Depth returns the number of path elements of rendered paths.
+func (l *Layout) Depth() int {
+	return l.depth
+}
+
+func (l *Layout) String() string {
+	return l.src
+}
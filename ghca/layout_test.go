@@ -0,0 +1,107 @@
+package ghca
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func TestLayoutRender(t *testing.T) {
+	repo := &github.Repository{
+		ID:              github.Int64(42),
+		Owner:           &github.User{Login: github.String("rhysd")},
+		Name:            github.String("clever-f.vim"),
+		Language:        github.String("Vim script"),
+		StargazersCount: github.Int(1234),
+		DefaultBranch:   github.String("feature/foo"),
+	}
+	for _, tc := range []struct {
+		layout string
+		sha    string
+		want   string
+	}{
+		{DefaultLayout, "", "rhysd/clever-f.vim"},
+		{"{language}/{owner}__{name}", "", "Vim script/rhysd__clever-f.vim"},
+		{"{stars_bucket}/{owner}/{name}", "", "1000-9999/rhysd/clever-f.vim"},
+		{"{owner}/{name}@{sha}", "0123abcd", "rhysd/clever-f.vim@0123abcd"},
+		{"{license}/{id}", "", "unknown/42"},
+		{"{owner}/{name}/{default_branch}", "", "rhysd/clever-f.vim/feature_foo"},
+	} {
+		l, err := ParseLayout(tc.layout)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have := l.Render(repo, tc.sha); have != tc.want {
+			t.Errorf("Layout '%s' should render '%s' but got '%s'", tc.layout, tc.want, have)
+		}
+	}
+}
+
+func TestLayoutSanitize(t *testing.T) {
+	repo := &github.Repository{
+		Owner: &github.User{Login: github.String("..")},
+		Name:  github.String(`a\b:c*d?"e<f>g|h`),
+	}
+	l, err := ParseLayout(DefaultLayout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := l.Render(repo, ""); have != "_./a_b_c_d__e_f_g_h" {
+		t.Error("Unsafe characters should be sanitized:", have)
+	}
+}
+
+func TestStarsBucket(t *testing.T) {
+	for stars, want := range map[int]string{
+		0:     "0-9",
+		9:     "0-9",
+		10:    "10-99",
+		999:   "100-999",
+		1000:  "1000-9999",
+		54321: "10000-99999",
+	} {
+		if have := starsBucket(stars); have != want {
+			t.Errorf("Bucket of %d stars should be '%s' but got '%s'", stars, want, have)
+		}
+	}
+}
+
+func TestParseLayoutError(t *testing.T) {
+	for _, tc := range []struct {
+		layout string
+		want   string
+	}{
+		{"", "cannot be empty"},
+		{"/{owner}/{name}", "relative path"},
+		{`{owner}\{name}`, "relative path"},
+		{"{owner}//{name}", "invalid path element"},
+		{"../{name}", "invalid path element"},
+		{"{owner}/{name", "not closed"},
+		{"{owner}/{stars}", "Unknown placeholder '{stars}'"},
+		{"{owner}/{language}", "must contain '{name}' or '{id}'"},
+	} {
+		_, err := ParseLayout(tc.layout)
+		if err == nil {
+			t.Errorf("Layout '%s' should cause an error", tc.layout)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Error for layout '%s' should contain %q: %s", tc.layout, tc.want, err)
+		}
+	}
+}
+
+func TestClonerLayoutCollision(t *testing.T) {
+	l, err := ParseLayout("{name}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cl := NewCloner(t.TempDir(), nil, false, false)
+	cl.Layout = l
+	cl.Reserve("dotfiles", "foo/dotfiles")
+	err = cl.cloneRepo(cloneJob{slug: "bar/dotfiles", repo: repoFromSlug("bar/dotfiles")}, nil)
+	if err == nil || !strings.Contains(err.Error(), "collides with repository foo/dotfiles") {
+		t.Error("Collision should be detected:", err)
+	}
+}
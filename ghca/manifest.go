@@ -0,0 +1,294 @@
+package ghca
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+// ManifestFile is a name of the file put in dest directory to record cloned repositories.
+const ManifestFile = ".github-clone-all.json"
+
+// ManifestEntry is a record of one repository cloned into dest directory.
+type ManifestEntry struct {
+	// Slug is a name of repository in 'owner/name' format.
+	Slug string `json:"slug"`
+	// Path is a slash-separated path of the repository relative to dest directory. Empty means the
+	// same as Slug.
+	Path string `json:"path,omitempty"`
+	// ID is a numeric ID of the repository on GitHub. 0 means unknown.
+	ID int64 `json:"id,omitempty"`
+	// Description is a description of the repository.
+	Description string `json:"description,omitempty"`
+	// Language is a main language of the repository.
+	Language string `json:"language,omitempty"`
+	// Stars is the number of stargazers of the repository.
+	Stars int `json:"stars,omitempty"`
+	// SHA is the commit SHA of HEAD of the repository when it was cloned or updated last time. Empty
+	// means unknown.
+	SHA string `json:"sha,omitempty"`
+	// Queries is a list of queries which matched the repository.
+	Queries []string `json:"queries,omitempty"`
+	// ClonedAt is when the repository was cloned.
+	ClonedAt time.Time `json:"cloned_at"`
+	// UpdatedAt is when the repository was updated last time.
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Manifest records repositories cloned into dest directory. It is saved as ManifestFile in the
+// directory and used to know the state of the directory.
+type Manifest struct {
+	// Layout is a layout of directories used for cloning. Empty means DefaultLayout.
+	Layout string `json:"layout,omitempty"`
+	// Repos is a map from slug to the record of the repository.
+	Repos map[string]*ManifestEntry `json:"repos"`
+}
+
+// LoadManifest loads the manifest in dest directory. When the manifest file does not exist, it
+// returns an empty manifest.
+func LoadManifest(dest string) (*Manifest, error) {
+	m := &Manifest{Repos: map[string]*ManifestEntry{}}
+	b, err := ioutil.ReadFile(filepath.Join(dest, ManifestFile))
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, err
+	}
+	if m.Repos == nil {
+		m.Repos = map[string]*ManifestEntry{}
+	}
+	return m, nil
+}
+
+// Save saves the manifest in dest directory.
+func (m *Manifest) Save(dest string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dest, ManifestFile), b, 0644)
+}
+
+// Record records the repository as cloned or updated at the time.
+func (m *Manifest) Record(repo *github.Repository, queries []string, now time.Time) {
+	slug := repoSlug(repo)
+	e, ok := m.Repos[slug]
+	if !ok {
+		e = &ManifestEntry{Slug: slug, ClonedAt: now}
+		m.Repos[slug] = e
+	}
+	if id := repo.GetID(); id != 0 {
+		e.ID = id
+	}
+	if d := repo.GetDescription(); d != "" {
+		e.Description = d
+	}
+	if l := repo.GetLanguage(); l != "" {
+		e.Language = l
+	}
+	if s := repo.GetStargazersCount(); s != 0 {
+		e.Stars = s
+	}
+	if len(queries) > 0 {
+		e.Queries = queries
+	}
+	e.UpdatedAt = now
+}
+
+// Rename renames the record of the repository when it was renamed or transferred on GitHub.
+func (m *Manifest) Rename(from, to string) {
+	e, ok := m.Repos[from]
+	if !ok {
+		return
+	}
+	delete(m.Repos, from)
+	e.Slug = to
+	m.Repos[to] = e
+}
+
+// RelPath returns a slash-separated path of the repository relative to dest directory.
+func (e *ManifestEntry) RelPath() string {
+	if e.Path == "" {
+		return e.Slug
+	}
+	return e.Path
+}
+
+func (e *ManifestEntry) setPath(p string) {
+	if p == e.Slug {
+		p = ""
+	}
+	e.Path = p
+}
+
+// depth returns the number of path elements of repository directories in dest directory.
+func (m *Manifest) depth() (int, error) {
+	if m.Layout == "" {
+		return 2, nil
+	}
+	l, err := ParseLayout(m.Layout)
+	if err != nil {
+		return 0, err
+	}
+	return l.Depth(), nil
+}
+
+// Slugs returns sorted slugs of all repositories in the manifest.
+func (m *Manifest) Slugs() []string {
+	ss := make([]string, 0, len(m.Repos))
+	for s := range m.Repos {
+		ss = append(ss, s)
+	}
+	sort.Strings(ss)
+	return ss
+}
+
+// Export writes repositories in the manifest to the writer in the format. 'text' writes one slug per
+// line, 'json' writes an array of entries and 'csv' writes entries as CSV with a header line.
+func (m *Manifest) Export(w io.Writer, format string) error {
+	slugs := m.Slugs()
+	switch format {
+	case "", "text":
+		for _, s := range slugs {
+			if _, err := fmt.Fprintln(w, s); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "json":
+		es := make([]*ManifestEntry, 0, len(slugs))
+		for _, s := range slugs {
+			es = append(es, m.Repos[s])
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(es)
+	case "csv":
+		c := csv.NewWriter(w)
+		if err := c.Write([]string{"slug", "id", "language", "stars", "description", "queries", "cloned_at", "updated_at"}); err != nil {
+			return err
+		}
+		for _, s := range slugs {
+			e := m.Repos[s]
+			if err := c.Write([]string{
+				e.Slug,
+				strconv.FormatInt(e.ID, 10),
+				e.Language,
+				strconv.Itoa(e.Stars),
+				e.Description,
+				strings.Join(e.Queries, "\n"),
+				e.ClonedAt.Format(time.RFC3339),
+				e.UpdatedAt.Format(time.RFC3339),
+			}); err != nil {
+				return err
+			}
+		}
+		c.Flush()
+		return c.Error()
+	default:
+		return fmt.Errorf("Export format must be one of 'text', 'json' and 'csv' but got '%s'", format)
+	}
+}
+
+// listClonedDirs lists directories at the depth in dest directory as slash-separated paths. Entries
+// starting with '.' are ignored since they are not repositories.
+func listClonedDirs(dest string, depth int) ([]string, error) {
+	es, err := ioutil.ReadDir(dest)
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{}
+	for _, e := range es {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		if depth <= 1 {
+			paths = append(paths, e.Name())
+			continue
+		}
+		children, err := listClonedDirs(filepath.Join(dest, e.Name()), depth-1)
+		if err != nil {
+			return nil, err
+		}
+		for _, c := range children {
+			paths = append(paths, e.Name()+"/"+c)
+		}
+	}
+	return paths, nil
+}
+
+// Repository states reported by Status.
+const (
+	// StatusOK means the repository is recorded in the manifest and exists in dest directory.
+	StatusOK = "ok"
+	// StatusMissing means the repository is recorded in the manifest but does not exist in dest
+	// directory.
+	StatusMissing = "missing"
+	// StatusUntracked means the repository exists in dest directory but is not recorded in the
+	// manifest.
+	StatusUntracked = "untracked"
+)
+
+// RepoStatus is a state of one repository in dest directory.
+type RepoStatus struct {
+	// Slug is a name of repository in 'owner/name' format. When the state is StatusUntracked, it is
+	// a path relative to dest directory since the repository is unknown.
+	Slug string
+	// State is one of StatusOK, StatusMissing and StatusUntracked.
+	State string
+	// Entry is a record in the manifest. It is nil when the state is StatusUntracked.
+	Entry *ManifestEntry
+}
+
+// Status compares repositories in dest directory with the manifest. Results are sorted by slug.
+func Status(dest string) ([]RepoStatus, error) {
+	m, err := LoadManifest(dest)
+	if err != nil {
+		return nil, err
+	}
+	depth, err := m.depth()
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := listClonedDirs(dest, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	byPath := make(map[string]*ManifestEntry, len(m.Repos))
+	for _, e := range m.Repos {
+		byPath[e.RelPath()] = e
+	}
+	exists := make(map[string]struct{}, len(dirs))
+	ret := []RepoStatus{}
+	for _, d := range dirs {
+		exists[d] = struct{}{}
+		if e, ok := byPath[d]; ok {
+			ret = append(ret, RepoStatus{e.Slug, StatusOK, e})
+		} else {
+			ret = append(ret, RepoStatus{d, StatusUntracked, nil})
+		}
+	}
+	for s, e := range m.Repos {
+		if _, ok := exists[e.RelPath()]; !ok {
+			ret = append(ret, RepoStatus{s, StatusMissing, e})
+		}
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Slug < ret[j].Slug })
+	return ret, nil
+}
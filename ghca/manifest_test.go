@@ -0,0 +1,138 @@
+package ghca
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/github"
+)
+
+func testDestDir(t *testing.T, slugs ...string) (string, func()) {
+	dir, err := ioutil.TempDir("", "ghca-dest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range slugs {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.FromSlash(s)), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func testManifestRepo(owner, name string, id int64) *github.Repository {
+	return &github.Repository{
+		ID:    github.Int64(id),
+		Owner: &github.User{Login: github.String(owner)},
+		Name:  github.String(name),
+	}
+}
+
+func TestManifestSaveLoad(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	m, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Repos) != 0 {
+		t.Fatal("Manifest should be empty when file does not exist:", m.Repos)
+	}
+
+	t1 := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	m.Record(testManifestRepo("rhysd", "clever-f.vim", 42), []string{"language:vim"}, t1)
+	m.Record(testManifestRepo("rhysd", "clever-f.vim", 42), nil, t2)
+	if err := m.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err = LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := m.Repos["rhysd/clever-f.vim"]
+	if !ok {
+		t.Fatal("Recorded repository was not loaded:", m.Repos)
+	}
+	if e.ID != 42 {
+		t.Error("ID should be recorded:", e.ID)
+	}
+	if !e.ClonedAt.Equal(t1) || !e.UpdatedAt.Equal(t2) {
+		t.Error("Clone time should be kept and update time should be updated:", e.ClonedAt, e.UpdatedAt)
+	}
+	if len(e.Queries) != 1 || e.Queries[0] != "language:vim" {
+		t.Error("Queries should be kept when not given:", e.Queries)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	dir, done := testDestDir(t, "a/ok", "b/untracked", ".quarantine/x/y")
+	defer done()
+
+	m, _ := LoadManifest(dir)
+	m.Record(testManifestRepo("a", "ok", 1), nil, time.Now())
+	m.Record(testManifestRepo("c", "missing", 2), nil, time.Now())
+	if err := m.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	ss, err := Status(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []struct{ slug, state string }{
+		{"a/ok", StatusOK},
+		{"b/untracked", StatusUntracked},
+		{"c/missing", StatusMissing},
+	}
+	if len(ss) != len(want) {
+		t.Fatal("Unexpected status:", ss)
+	}
+	for i, w := range want {
+		if ss[i].Slug != w.slug || ss[i].State != w.state {
+			t.Errorf("Status of %s should be %s but got %s %s", w.slug, w.state, ss[i].Slug, ss[i].State)
+		}
+	}
+}
+
+func TestManifestExport(t *testing.T) {
+	m := &Manifest{Repos: map[string]*ManifestEntry{}}
+	m.Record(testManifestRepo("b", "two", 2), nil, time.Now())
+	m.Record(testManifestRepo("a", "one", 1), nil, time.Now())
+
+	var buf bytes.Buffer
+	if err := m.Export(&buf, "text"); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "a/one\nb/two\n" {
+		t.Error("Unexpected text output:", buf.String())
+	}
+
+	buf.Reset()
+	if err := m.Export(&buf, "json"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"slug": "a/one"`) {
+		t.Error("Unexpected JSON output:", buf.String())
+	}
+
+	buf.Reset()
+	if err := m.Export(&buf, "csv"); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 || !strings.HasPrefix(lines[0], "slug,id,") || !strings.HasPrefix(lines[1], "a/one,1,") {
+		t.Error("Unexpected CSV output:", buf.String())
+	}
+
+	if err := m.Export(&buf, "xml"); err == nil {
+		t.Error("Unknown format should cause an error")
+	}
+}
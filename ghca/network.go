@@ -0,0 +1,195 @@
+package ghca
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// systemCAFiles are well-known paths of CA bundle files of systems. Git command only accepts one CA
+// bundle file, so extra CA certificates are combined with one of them.
+var systemCAFiles = []string{
+	"/etc/ssl/certs/ca-certificates.crt",                // Debian, Ubuntu, Gentoo, Arch
+	"/etc/pki/tls/certs/ca-bundle.crt",                  // Fedora, RHEL 6
+	"/etc/ssl/ca-bundle.pem",                            // openSUSE
+	"/etc/pki/tls/cacert.pem",                           // OpenELEC
+	"/etc/pki/ca-trust/extracted/pem/tls-ca-bundle.pem", // CentOS, RHEL 7
+	"/etc/ssl/cert.pem",                                 // Alpine, macOS
+}
+
+// NetworkConfig is configuration of network connections to GitHub API and Git remotes. It is applied
+// to both the API client and Git operations of clone backends.
+type NetworkConfig struct {
+	// Proxy is a URL of HTTP proxy. Empty means proxy environment variables such as $HTTPS_PROXY are
+	// respected.
+	Proxy string
+	// CABundle is a path to PEM file of CA certificates trusted in addition to the system's ones. It
+	// is useful behind a proxy which intercepts TLS connections.
+	CABundle string
+	// APITimeout is a timeout of connecting to GitHub API and waiting for the response of each
+	// request. Reading the response body is also aborted when no data arrives for the duration. 0
+	// means no timeout.
+	APITimeout time.Duration
+}
+
+// Validate checks the configuration.
+func (c *NetworkConfig) Validate() error {
+	if c.Proxy != "" {
+		u, err := url.Parse(c.Proxy)
+		if err != nil {
+			return fmt.Errorf("Invalid proxy URL '%s': %v", c.Proxy, err)
+		}
+		if u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("Proxy URL must have scheme and host such as 'http://proxy.example.com:8080' but got '%s'", c.Proxy)
+		}
+	}
+	if c.CABundle != "" {
+		if _, err := c.certPool(); err != nil {
+			return err
+		}
+	}
+	if c.APITimeout < 0 {
+		return fmt.Errorf("API timeout must not be negative but got %s", c.APITimeout)
+	}
+	return nil
+}
+
+// certPool returns the system's certificate pool with certificates in CABundle.
+func (c *NetworkConfig) certPool() (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(c.CABundle)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read CA bundle: %v", err)
+	}
+	pool, err := x509.SystemCertPool()
+	if err != nil || pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("No certificate was found in CA bundle '%s'", c.CABundle)
+	}
+	return pool, nil
+}
+
+// Transport creates an HTTP transport to call GitHub API with the configuration.
+func (c *NetworkConfig) Transport() (http.RoundTripper, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if c.Proxy != "" {
+		u, err := url.Parse(c.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		t.Proxy = http.ProxyURL(u)
+	}
+	if c.CABundle != "" {
+		pool, err := c.certPool()
+		if err != nil {
+			return nil, err
+		}
+		t.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	if c.APITimeout == 0 {
+		return t, nil
+	}
+	d := &net.Dialer{Timeout: c.APITimeout, KeepAlive: 30 * time.Second}
+	t.DialContext = d.DialContext
+	t.TLSHandshakeTimeout = c.APITimeout
+	t.ResponseHeaderTimeout = c.APITimeout
+	// Total time to read body is not limited since archive backend downloads large tarballs via API.
+	// Instead, the request is aborted when no data arrives for the timeout.
+	return &idleTimeoutTransport{base: t, timeout: c.APITimeout}, nil
+}
+
+// idleTimeoutTransport is an HTTP transport which aborts the request when reading the response body
+// makes no progress for the timeout.
+type idleTimeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *idleTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	res, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	b := &idleTimeoutBody{body: res.Body, timeout: t.timeout, cancel: cancel}
+	b.timer = time.AfterFunc(t.timeout, b.expire)
+	res.Body = b
+	return res, nil
+}
+
+// idleTimeoutBody is a response body which cancels the request when no data is read for the timeout.
+type idleTimeoutBody struct {
+	body    io.ReadCloser
+	timeout time.Duration
+	cancel  context.CancelFunc
+	timer   *time.Timer
+	expired int32
+}
+
+func (b *idleTimeoutBody) expire() {
+	atomic.StoreInt32(&b.expired, 1)
+	b.cancel()
+}
+
+func (b *idleTimeoutBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	if atomic.LoadInt32(&b.expired) != 0 {
+		return n, fmt.Errorf("No data was received from GitHub API for %s", b.timeout)
+	}
+	if n > 0 {
+		b.timer.Reset(b.timeout)
+	}
+	return n, err
+}
+
+func (b *idleTimeoutBody) Close() error {
+	b.timer.Stop()
+	b.cancel()
+	return b.body.Close()
+}
+
+// writeGitCABundle writes a CA bundle file for Git into 'dir' and returns its path. Git replaces the
+// system's CA certificates with the file, so the file contains both the system's CA bundle and
+// CABundle. When the system's CA bundle file is not found, only CABundle is contained.
+func (c *NetworkConfig) writeGitCABundle(dir string) (string, error) {
+	extra, err := ioutil.ReadFile(c.CABundle)
+	if err != nil {
+		return "", fmt.Errorf("Could not read CA bundle: %v", err)
+	}
+
+	files := systemCAFiles
+	if f := os.Getenv("SSL_CERT_FILE"); f != "" {
+		files = append([]string{f}, files...)
+	}
+	var buf bytes.Buffer
+	for _, f := range files {
+		if b, err := ioutil.ReadFile(f); err == nil {
+			buf.Write(b)
+			buf.WriteByte('\n')
+			break
+		}
+	}
+	buf.Write(extra)
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	p := filepath.Join(dir, "ca-bundle.pem")
+	if err := ioutil.WriteFile(p, buf.Bytes(), 0644); err != nil {
+		return "", err
+	}
+	return p, nil
+}
@@ -0,0 +1,224 @@
+package ghca
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCABundle writes the certificate of the TLS test server into a PEM file.
+func testCABundle(t *testing.T, dir string, srv *httptest.Server) string {
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	return testWriteFile(t, dir, "ca.pem", string(b))
+}
+
+func TestNetworkConfigValidate(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	dir, done := testDestDir(t)
+	defer done()
+	ca := testCABundle(t, dir, srv)
+	notCA := testWriteFile(t, dir, "not-ca.pem", "hello")
+
+	for _, c := range []*NetworkConfig{
+		{},
+		{Proxy: "http://proxy.example.com:8080"},
+		{CABundle: ca},
+		{APITimeout: time.Second},
+	} {
+		if err := c.Validate(); err != nil {
+			t.Errorf("%+v should be valid: %v", c, err)
+		}
+	}
+	for _, c := range []*NetworkConfig{
+		{Proxy: "proxy.example.com:8080"},
+		{Proxy: "http://%zz"},
+		{CABundle: filepath.Join(dir, "not-existing.pem")},
+		{CABundle: notCA},
+		{APITimeout: -time.Second},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%+v should be invalid", c)
+		}
+	}
+}
+
+func TestNetworkTransportCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer srv.Close()
+	dir, done := testDestDir(t)
+	defer done()
+
+	tr, err := (&NetworkConfig{}).Transport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&http.Client{Transport: tr}).Get(srv.URL); err == nil {
+		t.Fatal("Unknown certificate should be rejected")
+	}
+
+	tr, err = (&NetworkConfig{CABundle: testCABundle(t, dir, srv)}).Transport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := (&http.Client{Transport: tr}).Get(srv.URL)
+	if err != nil {
+		t.Fatal("Certificate in CA bundle should be trusted:", err)
+	}
+	res.Body.Close()
+}
+
+func TestNetworkTransportProxy(t *testing.T) {
+	proxied := ""
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r.URL.String()
+		w.Write([]byte("ok"))
+	}))
+	defer proxy.Close()
+
+	tr, err := (&NetworkConfig{Proxy: proxy.URL}).Transport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := (&http.Client{Transport: tr}).Get("http://api.example.com/search/repositories")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if proxied != "http://api.example.com/search/repositories" {
+		t.Error("Request should be sent via proxy:", proxied)
+	}
+}
+
+func TestNetworkTransportAPITimeout(t *testing.T) {
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stop
+	}))
+	defer srv.Close()
+	defer close(stop)
+
+	tr, err := (&NetworkConfig{APITimeout: 50 * time.Millisecond}).Transport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := (&http.Client{Transport: tr}).Get(srv.URL); err == nil {
+		t.Fatal("Stalled request should time out")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Error("Request did not time out soon:", d)
+	}
+}
+
+func TestNetworkTransportAPITimeoutStalledBody(t *testing.T) {
+	stop := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write([]byte("{\"total_count\":"))
+		w.(http.Flusher).Flush()
+		<-stop
+	}))
+	defer srv.Close()
+	defer close(stop)
+
+	tr, err := (&NetworkConfig{APITimeout: 50 * time.Millisecond}).Transport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := (&http.Client{Transport: tr}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	start := time.Now()
+	_, err = ioutil.ReadAll(res.Body)
+	if err == nil {
+		t.Fatal("Reading stalled body should time out")
+	}
+	if !strings.Contains(err.Error(), "No data was received") {
+		t.Error("Unexpected error:", err)
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Error("Reading body did not time out soon:", d)
+	}
+}
+
+func TestNetworkTransportAPITimeoutSlowBody(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Total time exceeds the timeout but data keeps arriving
+		for i := 0; i < 5; i++ {
+			w.Write([]byte("abcd"))
+			w.(http.Flusher).Flush()
+			time.Sleep(20 * time.Millisecond)
+		}
+	}))
+	defer srv.Close()
+
+	tr, err := (&NetworkConfig{APITimeout: 50 * time.Millisecond}).Transport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := (&http.Client{Transport: tr}).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != strings.Repeat("abcd", 5) {
+		t.Fatal("Unexpected body:", string(b))
+	}
+}
+
+func TestWriteGitCABundle(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	sys := testWriteFile(t, dir, "system.pem", "SYSTEM CERTS")
+	saved, ok := os.LookupEnv("SSL_CERT_FILE")
+	os.Setenv("SSL_CERT_FILE", sys)
+	if ok {
+		defer os.Setenv("SSL_CERT_FILE", saved)
+	} else {
+		defer os.Unsetenv("SSL_CERT_FILE")
+	}
+
+	extra := testWriteFile(t, dir, "extra.pem", "EXTRA CERTS")
+	p, err := (&NetworkConfig{CABundle: extra}).writeGitCABundle(filepath.Join(dir, "tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); !strings.Contains(s, "SYSTEM CERTS") || !strings.Contains(s, "EXTRA CERTS") {
+		t.Error("Both system's and extra CA certificates should be contained:", s)
+	}
+}
+
+func TestExecBackendNetworkArgs(t *testing.T) {
+	cmd := newExecBackend().command(context.Background(), &CloneOptions{Proxy: "http://proxy:8080", CABundle: "/ca.pem"}, "version")
+	args := strings.Join(cmd.Args, " ")
+	for _, want := range []string{"-c http.proxy=http://proxy:8080", "-c http.sslCAInfo=/ca.pem"} {
+		if !strings.Contains(args, want) {
+			t.Errorf("'%s' should be in arguments: %s", want, args)
+		}
+	}
+	if !strings.HasSuffix(args, " version") {
+		t.Error("Subcommand should be the last argument:", args)
+	}
+}
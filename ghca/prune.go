@@ -0,0 +1,170 @@
+package ghca
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Pruner removes repositories in dest directory which no longer match queries. For example, they were
+// deleted, renamed or fell below the star threshold of the query.
+type Pruner struct {
+	// Dest is a directory where repositories were cloned.
+	Dest string
+	// Quarantine is a directory to move pruned repositories into instead of removing them. Each
+	// repository is moved to the same relative path in it. Empty means removing them.
+	Quarantine string
+	// Dry indicates only previewing repositories to be pruned. Nothing is removed or moved.
+	Dry bool
+}
+
+// validate checks the quarantine directory is not a place where repositories are cloned.
+func (p *Pruner) validate() error {
+	if p.Quarantine == "" {
+		return nil
+	}
+	dest, err := filepath.Abs(p.Dest)
+	if err != nil {
+		return err
+	}
+	q, err := filepath.Abs(p.Quarantine)
+	if err != nil {
+		return err
+	}
+	rel, err := filepath.Rel(dest, q)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil
+	}
+	if rel == "." || !strings.HasPrefix(rel, ".") {
+		return fmt.Errorf("Quarantine directory '%s' in '%s' must be a hidden directory like '.pruned' not to be regarded as repositories", p.Quarantine, p.Dest)
+	}
+	return nil
+}
+
+// quarantine moves the repository directory to the quarantine directory.
+func (p *Pruner) quarantine(rel string) error {
+	from := filepath.Join(p.Dest, filepath.FromSlash(rel))
+	if _, err := os.Stat(from); os.IsNotExist(err) {
+		return nil
+	}
+	to := filepath.Join(p.Quarantine, filepath.FromSlash(rel))
+	log.Println("Moving", from, "to", to)
+	// Older quarantined copy of the same repository is replaced
+	if err := os.RemoveAll(to); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0755); err != nil {
+		return err
+	}
+	return os.Rename(from, to)
+}
+
+// removeEmptyParents removes parent directories of 'dir' in 'dest' if they are empty. Error is
+// ignored since it fails when other repositories remain.
+func removeEmptyParents(dest, dir string) {
+	for p := filepath.Dir(dir); p != filepath.Clean(dest) && p != "."; p = filepath.Dir(p) {
+		if os.Remove(p) != nil {
+			break
+		}
+	}
+}
+
+// Prune removes repositories in dest directory which are not included in 'keep' slugs. It is the
+// same as Pruner.Prune with no quarantine directory.
+func Prune(dest string, keep []string) ([]string, error) {
+	p := &Pruner{Dest: dest}
+	return p.Prune(keep)
+}
+
+// Prune removes repositories in dest directory which are not included in 'keep' slugs, or moves them
+// into quarantine directory. Only repositories recorded in the manifest are pruned. Directories which
+// were not cloned by github-clone-all are never touched and only warned. It returns slugs of pruned
+// repositories. When Dry is true, it only returns repositories to be pruned.
+func (p *Pruner) Prune(keep []string) ([]string, error) {
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	dest := p.Dest
+	if _, err := os.Stat(dest); os.IsNotExist(err) {
+		// Nothing was cloned yet
+		return []string{}, nil
+	}
+	m, err := LoadManifest(dest)
+	if err != nil {
+		return nil, err
+	}
+	depth, err := m.depth()
+	if err != nil {
+		return nil, err
+	}
+	dirs, err := listClonedDirs(dest, depth)
+	if err != nil {
+		return nil, err
+	}
+
+	kept := make(map[string]struct{}, len(keep))
+	for _, s := range keep {
+		kept[s] = struct{}{}
+	}
+
+	// stale is a map from slug to its path relative to dest
+	stale := map[string]string{}
+	tracked := make(map[string]struct{}, len(m.Repos))
+	for s, e := range m.Repos {
+		tracked[e.RelPath()] = struct{}{}
+		if _, ok := kept[s]; !ok {
+			stale[s] = e.RelPath()
+		}
+	}
+	for _, d := range dirs {
+		if _, ok := tracked[d]; !ok {
+			log.Println("Skipped pruning", filepath.Join(dest, filepath.FromSlash(d)), "since it is not recorded in manifest")
+		}
+	}
+
+	removed := make([]string, 0, len(stale))
+	for s := range stale {
+		removed = append(removed, s)
+	}
+	sort.Strings(removed)
+
+	if p.Dry {
+		for _, s := range removed {
+			log.Println("Would prune", filepath.Join(dest, filepath.FromSlash(stale[s])))
+		}
+		return removed, nil
+	}
+
+	for _, s := range removed {
+		dir := filepath.Join(dest, filepath.FromSlash(stale[s]))
+		side := sidecarDir(stale[s])
+		if p.Quarantine != "" {
+			if err := p.quarantine(stale[s]); err != nil {
+				return nil, err
+			}
+			if err := p.quarantine(side); err != nil {
+				return nil, err
+			}
+		} else {
+			log.Println("Pruning", dir)
+			if err := os.RemoveAll(dir); err != nil {
+				return nil, err
+			}
+			if err := os.RemoveAll(filepath.Join(dest, filepath.FromSlash(side))); err != nil {
+				return nil, err
+			}
+		}
+		removeEmptyParents(dest, dir)
+		delete(m.Repos, s)
+	}
+
+	if len(removed) > 0 {
+		if err := m.Save(dest); err != nil {
+			return nil, err
+		}
+	}
+	return removed, nil
+}
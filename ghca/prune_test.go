@@ -0,0 +1,135 @@
+package ghca
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testRecordRepos records the slugs in the manifest of the dest directory as cloned repositories.
+func testRecordRepos(t *testing.T, dir string, slugs ...string) {
+	m, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range slugs {
+		ss := strings.SplitN(s, "/", 2)
+		m.Record(testManifestRepo(ss[0], ss[1], int64(i+1)), nil, time.Now())
+	}
+	if err := m.Save(dir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir, done := testDestDir(t, "a/keep", "a/stale", "b/stale", "b/untracked")
+	defer done()
+	testRecordRepos(t, dir, "a/keep", "a/stale", "b/stale", "c/gone")
+
+	removed, err := Prune(dir, []string{"a/keep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(removed, ",") != "a/stale,b/stale,c/gone" {
+		t.Fatal("Unexpected pruned repositories:", removed)
+	}
+
+	for _, p := range []string{"a/keep", "b/untracked"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(p))); err != nil {
+			t.Error("Directory should not be removed:", p)
+		}
+	}
+	for _, p := range []string{"a/stale", "b/stale"} {
+		if _, err := os.Stat(filepath.Join(dir, filepath.FromSlash(p))); err == nil {
+			t.Error("Stale repository was not removed:", p)
+		}
+	}
+
+	m, err := LoadManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Repos) != 1 {
+		t.Error("Pruned repositories should be removed from manifest:", m.Slugs())
+	}
+}
+
+func TestPruneIgnoresUntracked(t *testing.T) {
+	dir, done := testDestDir(t, "a/keep", "user/own-project")
+	defer done()
+	testRecordRepos(t, dir, "a/keep")
+
+	removed, err := Prune(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(removed, ",") != "a/keep" {
+		t.Error("Only repository in manifest should be pruned:", removed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "user", "own-project")); err != nil {
+		t.Error("Directory not cloned by github-clone-all should never be removed:", err)
+	}
+}
+
+func TestPruneDry(t *testing.T) {
+	dir, done := testDestDir(t, "a/keep", "a/stale")
+	defer done()
+	testRecordRepos(t, dir, "a/keep", "a/stale")
+
+	p := &Pruner{Dest: dir, Dry: true}
+	removed, err := p.Prune([]string{"a/keep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != "a/stale" {
+		t.Fatal("Unexpected repositories to be pruned:", removed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "stale")); err != nil {
+		t.Error("Repository should not be removed on dry run")
+	}
+}
+
+func TestPruneQuarantine(t *testing.T) {
+	dir, done := testDestDir(t, "a/keep", "a/stale")
+	defer done()
+	testRecordRepos(t, dir, "a/keep", "a/stale")
+	q := filepath.Join(dir, ".pruned")
+
+	p := &Pruner{Dest: dir, Quarantine: q}
+	removed, err := p.Prune([]string{"a/keep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != "a/stale" {
+		t.Fatal("Unexpected pruned repositories:", removed)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "stale")); err == nil {
+		t.Error("Stale repository was not moved")
+	}
+	if _, err := os.Stat(filepath.Join(q, "a", "stale")); err != nil {
+		t.Error("Stale repository was not moved to quarantine directory:", err)
+	}
+
+	// Quarantine directory must not be regarded as a repository on next pruning
+	removed, err = p.Prune([]string{"a/keep"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Error("Quarantine directory should be ignored:", removed)
+	}
+}
+
+func TestPruneQuarantineInDest(t *testing.T) {
+	dir, done := testDestDir(t, "a/keep")
+	defer done()
+
+	for _, q := range []string{dir, filepath.Join(dir, "pruned")} {
+		p := &Pruner{Dest: dir, Quarantine: q}
+		if _, err := p.Prune([]string{"a/keep"}); err == nil {
+			t.Error("Quarantine directory should not be a non-hidden directory in dest:", q)
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package ghca
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httputil"
+	"path/filepath"
+	"sync"
+)
+
+// replayIndex is a file in the directory of recorded API session. It maps each request to files of
+// its responses in recorded order.
+const replayIndex = "index.json"
+
+// replayKey returns the key of the request in the index. Scheme and host are not a part of the key
+// so that recorded sessions can be replayed with any base URL of the API.
+func replayKey(req *http.Request) string {
+	return req.Method + " " + req.URL.RequestURI()
+}
+
+// Recorder is an HTTP transport which records responses of GitHub API into a directory so that the
+// session can be replayed later with Replayer. Each response is written to a numbered file with
+// 'index.json' mapping requests to them. Existing recording in the directory is replaced. Responses
+// of downloads such as tarballs are not recorded since they are not API responses.
+type Recorder struct {
+	// Dir is a directory to write recorded responses.
+	Dir string
+	// Base is a transport to send requests. nil means http.DefaultTransport.
+	Base  http.RoundTripper
+	mu    sync.Mutex
+	index map[string][]string
+	count int
+}
+
+// NewRecorder creates a new recorder which writes responses into the directory.
+func NewRecorder(dir string) *Recorder {
+	return &Recorder{Dir: dir, index: map[string][]string{}}
+}
+
+func (r *Recorder) base() http.RoundTripper {
+	if r.Base == nil {
+		return http.DefaultTransport
+	}
+	return r.Base
+}
+
+// RoundTrip sends the request and records the response.
+func (r *Recorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := r.base().RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode/100 == 2 {
+		if t, _, err := mime.ParseMediaType(res.Header.Get("Content-Type")); err != nil || t != "application/json" {
+			return res, nil
+		}
+	}
+	b, err := httputil.DumpResponse(res, true)
+	if err != nil {
+		return nil, err
+	}
+	if err := r.record(replayKey(req), b); err != nil {
+		res.Body.Close()
+		return nil, fmt.Errorf("Could not record response of %s: %v", replayKey(req), err)
+	}
+	return res, nil
+}
+
+// record writes the dumped response and the index. The index is written on every response so that
+// the recording is usable even if the run is aborted.
+func (r *Recorder) record(key string, b []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.count++
+	name := fmt.Sprintf("%04d.http", r.count)
+	if err := writeFileAtomic(filepath.Join(r.Dir, name), b); err != nil {
+		return err
+	}
+	r.index[key] = append(r.index[key], name)
+	var idx bytes.Buffer
+	enc := json.NewEncoder(&idx)
+	// Keep '&' in query strings readable
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(r.index); err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(r.Dir, replayIndex), idx.Bytes())
+}
+
+// Replayer is an HTTP transport which serves responses recorded by Recorder instead of calling GitHub
+// API. Requests are matched by method, path and query. When the same request was recorded multiple
+// times, responses are served in recorded order and the last one is served repeatedly after that.
+type Replayer struct {
+	// Dir is a directory of the recorded session.
+	Dir   string
+	mu    sync.Mutex
+	index map[string][]string
+	// served is a map from request key to the number of responses served for it
+	served map[string]int
+}
+
+// NewReplayer creates a new replayer of the session recorded in the directory.
+func NewReplayer(dir string) (*Replayer, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, replayIndex))
+	if err != nil {
+		return nil, fmt.Errorf("Could not read recorded API session: %v", err)
+	}
+	r := &Replayer{Dir: dir, served: map[string]int{}}
+	if err := json.Unmarshal(b, &r.index); err != nil {
+		return nil, fmt.Errorf("Broken index of recorded API session '%s': %v", dir, err)
+	}
+	return r, nil
+}
+
+// RoundTrip returns the recorded response of the request. It returns an error when the request was
+// not recorded.
+func (r *Replayer) RoundTrip(req *http.Request) (*http.Response, error) {
+	key := replayKey(req)
+	r.mu.Lock()
+	files := r.index[key]
+	i := r.served[key]
+	if i < len(files)-1 {
+		r.served[key] = i + 1
+	}
+	r.mu.Unlock()
+
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("Response of %s was not recorded in '%s'", key, r.Dir)
+	}
+	res, err := readResponseFile(filepath.Join(r.Dir, files[i]), req)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read recorded response of %s: %v", key, err)
+	}
+	return res, nil
+}
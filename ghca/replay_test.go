@@ -0,0 +1,98 @@
+package ghca
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func testReplayGet(t *testing.T, c *http.Client, url string) (string, int) {
+	res, err := c.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(b), res.StatusCode
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+	rec := filepath.Join(dir, "rec")
+
+	n := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/search/repositories":
+			n++
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"total_count":%d}`, n)
+		case "/repos/a/b":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			fmt.Fprint(w, `{"message":"Not Found"}`)
+		default:
+			w.Header().Set("Content-Type", "application/x-gzip")
+			w.Write([]byte("archive"))
+		}
+	}))
+
+	c := &http.Client{Transport: NewRecorder(rec)}
+	for _, p := range []string{"/search/repositories?q=foo", "/search/repositories?q=foo", "/repos/a/b", "/a/b/tarball"} {
+		testReplayGet(t, c, srv.URL+p)
+	}
+	srv.Close()
+
+	fs, err := ioutil.ReadDir(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, f := range fs {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	if s := strings.Join(names, ","); s != "0001.http,0002.http,0003.http,index.json" {
+		t.Error("Only API responses should be recorded:", s)
+	}
+
+	r, err := NewReplayer(rec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Host is different from the recorded session since the server was closed
+	c = &http.Client{Transport: r}
+	for i, want := range []string{`{"total_count":1}`, `{"total_count":2}`, `{"total_count":2}`} {
+		if b, _ := testReplayGet(t, c, "https://api.github.com/search/repositories?q=foo"); b != want {
+			t.Errorf("Response #%d should be %s but got %s", i, want, b)
+		}
+	}
+	if b, s := testReplayGet(t, c, "https://api.github.com/repos/a/b"); s != http.StatusNotFound || !strings.Contains(b, "Not Found") {
+		t.Error("Error response should be replayed:", s, b)
+	}
+	if _, err := c.Get("https://api.github.com/search/repositories?q=bar"); err == nil || !strings.Contains(err.Error(), "was not recorded") {
+		t.Error("Request which was not recorded should cause an error:", err)
+	}
+}
+
+func TestNewReplayerError(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+
+	if _, err := NewReplayer(dir); err == nil {
+		t.Error("Directory without index should cause an error")
+	}
+	testWriteFile(t, dir, replayIndex, "{")
+	if _, err := NewReplayer(dir); err == nil {
+		t.Error("Broken index should cause an error")
+	}
+}
@@ -0,0 +1,124 @@
+package ghca
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/google/go-github/github"
+)
+
+// sidecarDir returns a slash-separated path of the sidecar directory of the repository at 'rel'
+// relative to dest. Sidecar directory is put next to the repository to store its wiki and exported
+// metadata. It is hidden not to be regarded as a repository.
+func sidecarDir(rel string) string {
+	return path.Join(path.Dir(rel), "."+path.Base(rel)+".meta")
+}
+
+// IssueExporter exports issues, pull requests and their comments of repositories as JSON files via
+// GitHub API.
+type IssueExporter struct {
+	client *github.Client
+	ctx    context.Context
+}
+
+// NewIssueExporter creates a new IssueExporter instance with the API client.
+func NewIssueExporter(ctx context.Context, client *github.Client) *IssueExporter {
+	return &IssueExporter{client, ctx}
+}
+
+// listAll calls 'list' for each page until all pages are fetched. It waits when API rate limit
+// exceeded.
+func (e *IssueExporter) listAll(list func(o github.ListOptions) (*github.Response, error)) error {
+	o := github.ListOptions{PerPage: 100, Page: 1}
+	for {
+		res, err := list(o)
+		if waitRateLimit(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if res.NextPage == 0 {
+			return nil
+		}
+		o.Page = res.NextPage
+	}
+}
+
+func writeJSON(dir, name string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, name), b, 0644)
+}
+
+// Export exports issues, pull requests and their comments of the repository into the directory as
+// 'issues.json', 'pulls.json', 'comments.json' and 'review_comments.json'. Note that 'issues.json'
+// also contains pull requests since GitHub regards them as issues.
+func (e *IssueExporter) Export(repo *github.Repository, dir string) error {
+	slug := repoSlug(repo)
+	owner, name := repo.GetOwner().GetLogin(), repo.GetName()
+	log.Println("Exporting issues of", slug)
+
+	files := map[string]interface{}{}
+
+	// Issues API returns 410 when issues are disabled
+	if repo.HasIssues == nil || repo.GetHasIssues() {
+		issues := []*github.Issue{}
+		if err := e.listAll(func(o github.ListOptions) (*github.Response, error) {
+			is, res, err := e.client.Issues.ListByRepo(e.ctx, owner, name, &github.IssueListByRepoOptions{State: "all", ListOptions: o})
+			issues = append(issues, is...)
+			return res, err
+		}); err != nil {
+			return fmt.Errorf("Could not export issues of %s: %v", slug, err)
+		}
+		files["issues.json"] = issues
+
+		comments := []*github.IssueComment{}
+		if err := e.listAll(func(o github.ListOptions) (*github.Response, error) {
+			cs, res, err := e.client.Issues.ListComments(e.ctx, owner, name, 0, &github.IssueListCommentsOptions{ListOptions: o})
+			comments = append(comments, cs...)
+			return res, err
+		}); err != nil {
+			return fmt.Errorf("Could not export comments of issues of %s: %v", slug, err)
+		}
+		files["comments.json"] = comments
+	}
+
+	pulls := []*github.PullRequest{}
+	if err := e.listAll(func(o github.ListOptions) (*github.Response, error) {
+		ps, res, err := e.client.PullRequests.List(e.ctx, owner, name, &github.PullRequestListOptions{State: "all", ListOptions: o})
+		pulls = append(pulls, ps...)
+		return res, err
+	}); err != nil {
+		return fmt.Errorf("Could not export pull requests of %s: %v", slug, err)
+	}
+	files["pulls.json"] = pulls
+
+	reviews := []*github.PullRequestComment{}
+	if err := e.listAll(func(o github.ListOptions) (*github.Response, error) {
+		cs, res, err := e.client.PullRequests.ListComments(e.ctx, owner, name, 0, &github.PullRequestListCommentsOptions{ListOptions: o})
+		reviews = append(reviews, cs...)
+		return res, err
+	}); err != nil {
+		return fmt.Errorf("Could not export review comments of %s: %v", slug, err)
+	}
+	files["review_comments.json"] = reviews
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for n, v := range files {
+		if err := writeJSON(dir, n, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
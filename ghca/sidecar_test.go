@@ -0,0 +1,104 @@
+package ghca
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/go-github/github"
+)
+
+func TestSidecarDir(t *testing.T) {
+	for rel, want := range map[string]string{
+		"a/b":     "a/.b.meta",
+		"a/b.git": "a/.b.git.meta",
+		"b":       ".b.meta",
+	} {
+		if have := sidecarDir(rel); have != want {
+			t.Errorf("Sidecar of '%s' should be '%s' but got '%s'", rel, want, have)
+		}
+	}
+}
+
+func TestExportIssues(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/repos/a/b/issues":
+			if r.URL.Query().Get("state") != "all" {
+				t.Error("Closed issues should also be exported:", r.URL)
+			}
+			if r.URL.Query().Get("page") == "1" {
+				w.Header().Set("Link", fmt.Sprintf(`<%s/repos/a/b/issues?state=all&page=2>; rel="next"`, srv.URL))
+				fmt.Fprint(w, `[{"number": 1}]`)
+			} else {
+				fmt.Fprint(w, `[{"number": 2}]`)
+			}
+		case "/repos/a/b/issues/comments":
+			fmt.Fprint(w, `[{"id": 10, "body": "hello"}]`)
+		case "/repos/a/b/pulls":
+			fmt.Fprint(w, `[{"number": 2}]`)
+		case "/repos/a/b/pulls/comments":
+			fmt.Fprint(w, `[]`)
+		default:
+			t.Error("Unexpected endpoint:", r.URL.Path)
+		}
+	}))
+	defer srv.Close()
+
+	client := github.NewClient(nil)
+	u, err := url.Parse(srv.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.BaseURL = u
+
+	dir, done := testDestDir(t)
+	defer done()
+	side := filepath.Join(dir, ".b.meta")
+
+	e := NewIssueExporter(context.Background(), client)
+	if err := e.Export(repoFromSlug("a/b"), side); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(side, "issues.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var issues []*github.Issue
+	if err := json.Unmarshal(b, &issues); err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 2 || issues[0].GetNumber() != 1 || issues[1].GetNumber() != 2 {
+		t.Error("All pages of issues should be exported:", issues)
+	}
+	for _, f := range []string{"comments.json", "pulls.json", "review_comments.json"} {
+		if _, err := os.Stat(filepath.Join(side, f)); err != nil {
+			t.Error(f, "should be exported:", err)
+		}
+	}
+}
+
+func TestPruneSidecar(t *testing.T) {
+	dir, done := testDestDir(t, "a/keep", "a/stale", "a/.stale.meta")
+	defer done()
+	testRecordRepos(t, dir, "a/keep", "a/stale")
+
+	if _, err := Prune(dir, []string{"a/keep"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", ".stale.meta")); err == nil {
+		t.Error("Sidecar directory should be pruned with its repository")
+	}
+	if _, err := os.Stat(filepath.Join(dir, "a", "keep")); err != nil {
+		t.Error("Repository matching to query was removed")
+	}
+}
@@ -0,0 +1,73 @@
+package ghca
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// SSHConfig is configuration of SSH connections to clone repositories via SSH. Empty config respects
+// the user's $GIT_SSH_COMMAND and SSH config.
+type SSHConfig struct {
+	// KnownHosts is a path to known_hosts file to verify host keys instead of the user's default one.
+	// Unknown hosts are rejected.
+	KnownHosts string
+	// Identity is a path to private key file used for authentication instead of keys in the user's
+	// SSH config or agent.
+	Identity string
+	// Insecure disables verification of host keys. It should not be used except for testing.
+	Insecure bool
+}
+
+// Validate checks the configuration. Files must exist and host key verification cannot be both
+// pinned and disabled.
+func (c *SSHConfig) Validate() error {
+	if c.Insecure && c.KnownHosts != "" {
+		return errors.New("Known hosts file cannot be specified with insecure SSH since host keys are not verified")
+	}
+	for _, f := range []string{c.KnownHosts, c.Identity} {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err != nil {
+			return fmt.Errorf("Could not read file for SSH: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c *SSHConfig) empty() bool {
+	return c == nil || (c.KnownHosts == "" && c.Identity == "" && !c.Insecure)
+}
+
+// shellQuote quotes the argument for shell which runs $GIT_SSH_COMMAND.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// sshCommand returns the value of $GIT_SSH_COMMAND to apply the configuration. Options are appended
+// to 'base', which is the user's $GIT_SSH_COMMAND or empty. When 'base' is empty, ssh always runs in
+// batch mode so that it never prompts for passwords or unknown host keys while cloning in parallel.
+// It returns an empty string when the user's $GIT_SSH_COMMAND can be used as it is.
+func (c *SSHConfig) sshCommand(base string) string {
+	if base == "" {
+		base = "ssh -o BatchMode=yes"
+	} else if c.empty() {
+		return ""
+	}
+	if c.empty() {
+		return base
+	}
+	args := []string{base}
+	if c.KnownHosts != "" {
+		args = append(args, "-o", "StrictHostKeyChecking=yes", "-o", "UserKnownHostsFile="+shellQuote(c.KnownHosts))
+	}
+	if c.Insecure {
+		args = append(args, "-o", "StrictHostKeyChecking=no")
+	}
+	if c.Identity != "" {
+		args = append(args, "-o", "IdentitiesOnly=yes", "-i", shellQuote(c.Identity))
+	}
+	return strings.Join(args, " ")
+}
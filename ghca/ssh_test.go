@@ -0,0 +1,151 @@
+package ghca
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"golang.org/x/crypto/ssh"
+)
+
+func testIdentityFile(t *testing.T, dir string) string {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(dir, "id_ed25519")
+	if err := ioutil.WriteFile(p, pem.EncodeToMemory(b), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestShellQuote(t *testing.T) {
+	for in, want := range map[string]string{
+		"/path/to/file":    `'/path/to/file'`,
+		"/path with space": `'/path with space'`,
+		"it's":             `'it'\''s'`,
+	} {
+		if have := shellQuote(in); have != want {
+			t.Errorf("Quoted '%s' should be %s but got %s", in, want, have)
+		}
+	}
+}
+
+func TestSSHCommand(t *testing.T) {
+	for _, tc := range []struct {
+		conf *SSHConfig
+		base string
+		want string
+	}{
+		{nil, "", "ssh -o BatchMode=yes"},
+		{&SSHConfig{}, "", "ssh -o BatchMode=yes"},
+		{nil, "ssh -v", ""},
+		{&SSHConfig{}, "ssh -v", ""},
+		{&SSHConfig{KnownHosts: "/k"}, "", "ssh -o BatchMode=yes -o StrictHostKeyChecking=yes -o UserKnownHostsFile='/k'"},
+		{&SSHConfig{Identity: "/id"}, "ssh -p 2222", "ssh -p 2222 -o IdentitiesOnly=yes -i '/id'"},
+		{&SSHConfig{Insecure: true}, "", "ssh -o BatchMode=yes -o StrictHostKeyChecking=no"},
+	} {
+		if have := tc.conf.sshCommand(tc.base); have != tc.want {
+			t.Errorf("Wanted '%s' for %+v with '%s' but got '%s'", tc.want, tc.conf, tc.base, have)
+		}
+	}
+}
+
+func TestSSHConfigValidate(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+	id := testIdentityFile(t, dir)
+
+	for _, c := range []*SSHConfig{
+		{},
+		{Identity: id},
+		{KnownHosts: id},
+		{Identity: id, Insecure: true},
+	} {
+		if err := c.Validate(); err != nil {
+			t.Errorf("%+v should be valid: %v", c, err)
+		}
+	}
+
+	for _, c := range []*SSHConfig{
+		{KnownHosts: id, Insecure: true},
+		{Identity: filepath.Join(dir, "not-existing")},
+		{KnownHosts: filepath.Join(dir, "not-existing")},
+	} {
+		if err := c.Validate(); err == nil {
+			t.Errorf("%+v should be invalid", c)
+		}
+	}
+}
+
+func TestExecBackendSSHCommand(t *testing.T) {
+	saved := os.Getenv("GIT_SSH_COMMAND")
+	os.Setenv("GIT_SSH_COMMAND", "ssh -F /my/config")
+	defer os.Setenv("GIT_SSH_COMMAND", saved)
+
+	b := newExecBackend()
+	env := func(opts *CloneOptions) string {
+		v := ""
+		for _, e := range b.command(context.Background(), opts, "version").Env {
+			if strings.HasPrefix(e, "GIT_SSH_COMMAND=") {
+				v = strings.TrimPrefix(e, "GIT_SSH_COMMAND=")
+			}
+		}
+		return v
+	}
+
+	if have := env(&CloneOptions{}); have != "ssh -F /my/config" {
+		t.Error("User's $GIT_SSH_COMMAND should be respected but got", have)
+	}
+	want := "ssh -F /my/config -o StrictHostKeyChecking=yes -o UserKnownHostsFile='/k'"
+	if have := env(&CloneOptions{SSH: &SSHConfig{KnownHosts: "/k"}}); have != want {
+		t.Errorf("Wanted '%s' but got '%s'", want, have)
+	}
+
+	os.Unsetenv("GIT_SSH_COMMAND")
+	if have := env(&CloneOptions{}); have != "ssh -o BatchMode=yes" {
+		t.Error("ssh should run in batch mode without $GIT_SSH_COMMAND but got", have)
+	}
+}
+
+func TestGoGitSSHAuth(t *testing.T) {
+	dir, done := testDestDir(t)
+	defer done()
+	id := testIdentityFile(t, dir)
+
+	opts := &CloneOptions{SSH: &SSHConfig{Identity: id, Insecure: true}}
+	a, err := auth("git@github.com:o/r.git", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k, ok := a.(*gitssh.PublicKeys)
+	if !ok {
+		t.Fatalf("Identity file should be used but got %T", a)
+	}
+	if k.User != "git" || k.HostKeyCallback == nil {
+		t.Errorf("Unexpected authentication: %+v", k)
+	}
+
+	for _, u := range []string{"https://github.com/o/r.git", "https://example.com/o/r.git"} {
+		if a, err := auth(u, opts); err != nil || a != nil {
+			t.Errorf("SSH config should not be applied to '%s' but got %v (%v)", u, a, err)
+		}
+	}
+
+	opts.SSH = &SSHConfig{Identity: filepath.Join(dir, "not-existing")}
+	if _, err := auth("ssh://git@github.com/o/r.git", opts); err == nil {
+		t.Error("Missing identity file should cause an error")
+	}
+}
@@ -0,0 +1,277 @@
+package ghca
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/go-github/github"
+	"golang.org/x/oauth2"
+)
+
+// rateLimit is the last known rate limit of one token for one API resource.
+type rateLimit struct {
+	remaining int
+	reset     time.Time
+}
+
+// TokenPool is a pool of GitHub API tokens. Each request sent via the pool's client is authenticated
+// with the token which has the most remaining rate limit of the API resource (search or core), so
+// requests rotate through tokens before one of them reaches its rate limit. When a response tells
+// the rate limit of the token was exceeded, the request is retried with another token. TokenPool
+// also implements oauth2.TokenSource to provide a token for cloning private repositories.
+type TokenPool struct {
+	// Base is the transport to send requests. nil means http.DefaultTransport.
+	Base    http.RoundTripper
+	mu      sync.Mutex
+	sources []oauth2.TokenSource
+	limits  []map[string]rateLimit
+	now     func() time.Time
+}
+
+// NewTokenPool creates a new token pool from the token sources. Static tokens can be added with
+// oauth2.StaticTokenSource and GitHub App installation tokens with NewAppTokenSource.
+func NewTokenPool(sources ...oauth2.TokenSource) *TokenPool {
+	limits := make([]map[string]rateLimit, 0, len(sources))
+	for range sources {
+		limits = append(limits, map[string]rateLimit{})
+	}
+	return &TokenPool{sources: sources, limits: limits, now: time.Now}
+}
+
+// Len returns the number of tokens in the pool.
+func (p *TokenPool) Len() int {
+	return len(p.sources)
+}
+
+// Client returns an HTTP client which authenticates requests with tokens in the pool.
+func (p *TokenPool) Client() *http.Client {
+	return &http.Client{Transport: p}
+}
+
+// resourceOf returns the kind of rate limit applied to the request.
+func resourceOf(req *http.Request) string {
+	if strings.Contains(req.URL.Path, "/search/") {
+		return "search"
+	}
+	return "core"
+}
+
+// pick returns the index of the token which has the most remaining rate limit of the resource.
+// Tokens whose rate limit is unknown or was already reset are preferred. Tokens in 'tried' are not
+// picked. It returns -1 when all tokens were tried.
+func (p *TokenPool) pick(resource string, tried map[int]bool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+	best, bestRemaining := -1, 0
+	for i, ls := range p.limits {
+		if tried[i] {
+			continue
+		}
+		l, ok := ls[resource]
+		if !ok || now.After(l.reset) {
+			return i
+		}
+		if best < 0 || l.remaining > bestRemaining || (l.remaining == 0 && bestRemaining == 0 && l.reset.Before(p.limits[best][resource].reset)) {
+			best, bestRemaining = i, l.remaining
+		}
+	}
+	return best
+}
+
+// record records the rate limit of the token from the response headers. It returns true when the
+// rate limit of the token was exceeded.
+func (p *TokenPool) record(i int, resource string, res *http.Response) bool {
+	remaining, err := strconv.Atoi(res.Header.Get("X-RateLimit-Remaining"))
+	if err != nil {
+		return false
+	}
+	reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return false
+	}
+
+	p.mu.Lock()
+	p.limits[i][resource] = rateLimit{remaining, time.Unix(reset, 0)}
+	p.mu.Unlock()
+
+	return remaining == 0 && (res.StatusCode == http.StatusForbidden || res.StatusCode == http.StatusTooManyRequests)
+}
+
+func (p *TokenPool) base() http.RoundTripper {
+	if p.Base == nil {
+		return http.DefaultTransport
+	}
+	return p.Base
+}
+
+// RoundTrip implements http.RoundTripper.
+func (p *TokenPool) RoundTrip(req *http.Request) (*http.Response, error) {
+	resource := resourceOf(req)
+	tried := map[int]bool{}
+	for {
+		i := p.pick(resource, tried)
+		if i < 0 {
+			return nil, errors.New("No token is available in token pool")
+		}
+		tok, err := p.sources[i].Token()
+		if err != nil {
+			return nil, err
+		}
+
+		r := req.Clone(req.Context())
+		if len(tried) > 0 && req.Body != nil && req.Body != http.NoBody {
+			b, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			r.Body = b
+		}
+		tok.SetAuthHeader(r)
+
+		res, err := p.base().RoundTrip(r)
+		if err != nil {
+			return nil, err
+		}
+		tried[i] = true
+
+		exceeded := p.record(i, resource, res)
+		rewindable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+		if !exceeded || len(tried) == len(p.sources) || !rewindable {
+			return res, nil
+		}
+		res.Body.Close()
+	}
+}
+
+// Token returns the token which has the most remaining rate limit of core API. It implements
+// oauth2.TokenSource.
+func (p *TokenPool) Token() (*oauth2.Token, error) {
+	i := p.pick("core", nil)
+	if i < 0 {
+		return nil, errors.New("No token is available in token pool")
+	}
+	return p.sources[i].Token()
+}
+
+// appTokenSource creates installation access tokens of GitHub App. Each token is created via GitHub
+// API authenticated with JWT signed by the private key of the app.
+type appTokenSource struct {
+	appID          int64
+	installationID int64
+	key            *rsa.PrivateKey
+	client         *github.Client
+	now            func() time.Time
+}
+
+// NewAppTokenSource creates a token source of installation access tokens of the GitHub App. 'key' is
+// the content of the private key file (PEM) of the app. Installation tokens expire after one hour
+// and a new token is created automatically before the current one expires. 'base' is the transport
+// to call GitHub API. nil means http.DefaultTransport.
+func NewAppTokenSource(appID, installationID int64, key []byte, base http.RoundTripper) (oauth2.TokenSource, error) {
+	s, err := newAppTokenSource(appID, installationID, key, base)
+	if err != nil {
+		return nil, err
+	}
+	return oauth2.ReuseTokenSource(nil, s), nil
+}
+
+func newAppTokenSource(appID, installationID int64, key []byte, base http.RoundTripper) (*appTokenSource, error) {
+	k, err := parseRSAPrivateKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse private key of GitHub App: %v", err)
+	}
+	s := &appTokenSource{appID: appID, installationID: installationID, key: k, now: time.Now}
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	s.client = github.NewClient(&http.Client{Transport: &jwtTransport{s, base}})
+	return s, nil
+}
+
+func parseRSAPrivateKey(b []byte) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return nil, errors.New("PEM block was not found")
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rk, ok := k.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("RSA private key is expected but got %T", k)
+	}
+	return rk, nil
+}
+
+// jwt creates JWT to authenticate as the app. It is valid for 10 minutes at most. Issued time is set
+// in the past to allow clock drift.
+func (s *appTokenSource) jwt() (string, error) {
+	now := s.now()
+	enc := base64.RawURLEncoding
+	claims, err := json.Marshal(map[string]int64{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": s.appID,
+	})
+	if err != nil {
+		return "", err
+	}
+	signed := enc.EncodeToString([]byte(`{"alg":"RS256","typ":"JWT"}`)) + "." + enc.EncodeToString(claims)
+	d := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, d[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + enc.EncodeToString(sig), nil
+}
+
+// Token creates a new installation access token. It implements oauth2.TokenSource.
+func (s *appTokenSource) Token() (*oauth2.Token, error) {
+	// Apps.CreateInstallationToken of go-github v17 uses the endpoint which was already removed
+	req, err := s.client.NewRequest("POST", fmt.Sprintf("app/installations/%d/access_tokens", s.installationID), nil)
+	if err != nil {
+		return nil, err
+	}
+	t := &github.InstallationToken{}
+	if _, err := s.client.Do(context.Background(), req, t); err != nil {
+		return nil, fmt.Errorf("Could not create installation token of GitHub App %d: %v", s.appID, err)
+	}
+	// Refresh the token a bit before it actually expires since it may be used by long git-clone
+	return &oauth2.Token{AccessToken: t.GetToken(), Expiry: t.GetExpiresAt().Add(-5 * time.Minute)}, nil
+}
+
+// jwtTransport authenticates requests as GitHub App with JWT.
+type jwtTransport struct {
+	src  *appTokenSource
+	base http.RoundTripper
+}
+
+func (t *jwtTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	j, err := t.src.jwt()
+	if err != nil {
+		return nil, err
+	}
+	r := req.Clone(req.Context())
+	r.Header.Set("Authorization", "Bearer "+j)
+	return t.base.RoundTrip(r)
+}
@@ -0,0 +1,213 @@
+package ghca
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+func testStaticTokens(tokens ...string) []oauth2.TokenSource {
+	srcs := []oauth2.TokenSource{}
+	for _, t := range tokens {
+		srcs = append(srcs, oauth2.StaticTokenSource(&oauth2.Token{AccessToken: t}))
+	}
+	return srcs
+}
+
+// testRateLimitServer responds with rate limit of each token. 'remaining' is decreased on each request.
+func testRateLimitServer(remaining map[string]int, used *[]string) *httptest.Server {
+	reset := time.Now().Add(time.Hour).Unix()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tok := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		*used = append(*used, tok)
+		n := remaining[tok]
+		if n > 0 {
+			n--
+			remaining[tok] = n
+		}
+		w.Header().Set("X-RateLimit-Remaining", fmt.Sprint(n))
+		w.Header().Set("X-RateLimit-Reset", fmt.Sprint(reset))
+		if n == 0 {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("ok"))
+	}))
+}
+
+func TestTokenPoolRotation(t *testing.T) {
+	used := []string{}
+	srv := testRateLimitServer(map[string]int{"a": 3, "b": 10}, &used)
+	defer srv.Close()
+
+	pool := NewTokenPool(testStaticTokens("a", "b")...)
+	c := pool.Client()
+	for i := 0; i < 4; i++ {
+		res, err := c.Get(srv.URL + "/search/repositories")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatal("Request should succeed with some token but got status", res.StatusCode)
+		}
+	}
+
+	// 'a' and 'b' are tried first since their rate limits are unknown. After that, 'b' has more
+	// remaining rate limit
+	want := []string{"a", "b", "b", "b"}
+	if strings.Join(used, ",") != strings.Join(want, ",") {
+		t.Errorf("Wanted tokens %v but got %v", want, used)
+	}
+}
+
+func TestTokenPoolRetryOnExceeded(t *testing.T) {
+	used := []string{}
+	srv := testRateLimitServer(map[string]int{"a": 1, "b": 10}, &used)
+	defer srv.Close()
+
+	pool := NewTokenPool(testStaticTokens("a", "b")...)
+	res, err := pool.Client().Get(srv.URL + "/search/code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatal("Request should be retried with another token but got status", res.StatusCode)
+	}
+	if strings.Join(used, ",") != "a,b" {
+		t.Error("Exceeded token should be retried with next token:", used)
+	}
+
+	// Rate limit of 'core' is tracked separately from 'search'
+	u, _ := url.Parse(srv.URL + "/repos/o/r")
+	if i := pool.pick(resourceOf(&http.Request{URL: u}), nil); i != 0 {
+		t.Error("Token with unknown core rate limit should be picked but got", i)
+	}
+}
+
+func TestTokenPoolAllExceeded(t *testing.T) {
+	used := []string{}
+	srv := testRateLimitServer(map[string]int{"a": 1, "b": 1}, &used)
+	defer srv.Close()
+
+	pool := NewTokenPool(testStaticTokens("a", "b")...)
+	res, err := pool.Client().Get(srv.URL + "/search/code")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusForbidden {
+		t.Error("Last response should be returned when all tokens exceeded rate limit but got", res.StatusCode)
+	}
+	if len(used) != 2 {
+		t.Error("Each token should be tried once:", used)
+	}
+}
+
+func TestTokenPoolToken(t *testing.T) {
+	pool := NewTokenPool(testStaticTokens("a", "b")...)
+	pool.limits[0]["core"] = rateLimit{10, time.Now().Add(time.Hour)}
+	pool.limits[1]["core"] = rateLimit{100, time.Now().Add(time.Hour)}
+	tok, err := pool.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "b" {
+		t.Error("Token with most remaining rate limit should be returned but got", tok.AccessToken)
+	}
+
+	pool.limits[1]["core"] = rateLimit{0, time.Now().Add(-time.Minute)}
+	if i := pool.pick("core", nil); i != 1 {
+		t.Error("Token whose rate limit was reset should be picked but got", i)
+	}
+}
+
+func testAppKey(t *testing.T) (*rsa.PrivateKey, []byte) {
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)})
+}
+
+func TestAppTokenSource(t *testing.T) {
+	key, b := testAppKey(t)
+	expires := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/app/installations/42/access_tokens" {
+			http.NotFound(w, r)
+			return
+		}
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		if len(parts) != 3 {
+			http.Error(w, "invalid JWT", http.StatusUnauthorized)
+			return
+		}
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		d := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, d[:], sig); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		c, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims map[string]int64
+		if err := json.Unmarshal(c, &claims); err != nil || claims["iss"] != 12 || claims["exp"] <= claims["iat"] {
+			http.Error(w, "invalid claims: "+string(c), http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token":"installation-token","expires_at":"%s"}`, expires.Format(time.RFC3339))
+	}))
+	defer srv.Close()
+
+	src, err := newAppTokenSource(12, 42, b, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(srv.URL + "/")
+	src.client.BaseURL = u
+
+	tok, err := src.Token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken != "installation-token" {
+		t.Error("Unexpected installation token:", tok.AccessToken)
+	}
+	if !tok.Expiry.Before(expires) {
+		t.Error("Token should be refreshed before it expires:", tok.Expiry)
+	}
+}
+
+func TestParseRSAPrivateKey(t *testing.T) {
+	k, b := testAppKey(t)
+	if _, err := parseRSAPrivateKey(b); err != nil {
+		t.Error("PKCS#1 key should be parsed:", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseRSAPrivateKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})); err != nil {
+		t.Error("PKCS#8 key should be parsed:", err)
+	}
+	if _, err := parseRSAPrivateKey([]byte("not a key")); err == nil {
+		t.Error("Invalid key should cause an error")
+	}
+}
@@ -15,16 +15,43 @@ import (
 
 const version = "2.4.0"
 
-const usageHeader = `USAGE: github-clone-all [FLAGS] {query}
+const usageHeader = `USAGE: github-clone-all [SUBCOMMAND] [FLAGS] [{query}]
 
   github-clone-all is a command to clone all repositories matching to given
   query via GitHub Search API. Query must not be empty.
   It clones many repositories in parallel.
 
+SUBCOMMANDS:
+
+  search      Search repositories and show them without cloning
+  clone       Search repositories and clone them (default)
+  update      Update repositories in 'dest' directory and clone new ones
+  status      Report state of 'dest' directory compared with its manifest
+  prune       Remove repositories in 'dest' which no longer match query
+  export      Export repositories recorded in manifest of 'dest' directory
+  run         Run as described in a job file
+  version     Show version
+  selfupdate  Update this tool to the latest
+
+  Run 'github-clone-all {subcommand} -help' to know flags of each
+  subcommand. When no subcommand is given, 'clone' is run. Cloned
+  repositories are recorded in '.github-clone-all.json' manifest file in
+  'dest' directory.
+
+  A query which is the same as a subcommand name runs the subcommand. Put
+  '--' before such query to search it:
+
+  $ github-clone-all -- update
+
+DESCRIPTION:
+
   Repository is cloned to 'dest' directory. It is $cwd/repos by default and
-  can be specified with -dest flag.
+  can be specified with -dest flag. Path of each repository in 'dest' is
+  '{owner}/{name}' by default and can be changed with -layout flag such as
+  '{language}/{owner}__{name}' or '{stars_bucket}/{owner}/{name}'.
 
-  All arguments in {query} are regarded as query.
+  All arguments in {query} are regarded as query. More queries can be given
+  with -q or -query-file flags.
   For example,
 
   $ github-clone-all foo bar
@@ -74,6 +101,21 @@ EXAMPLE:
     Above command will clone the most popular repository of JavaScript on
     GitHub.
 
+  $ github-clone-all -sort stars -count 50 'language:rust'
+
+    Above command will clone the 50 most-starred repositories of Rust.
+
+  $ github-clone-all -q 'language:vim' -q 'filename:.vimrc'
+
+    Above command will search both queries and clone repositories found by
+    either of them. Repositories found by both queries are cloned once.
+    Queries can also be read from a file with -query-file.
+
+  $ github-clone-all run job.yaml
+
+    Above command will run github-clone-all as described in 'job.yaml'.
+    Please see 'github-clone-all run -help' for more details.
+
   $ github-clone-all -dry 'language:go'
 
     Above command will only list up most popular 1000 repositories of Go
@@ -84,6 +126,67 @@ EXAMPLE:
     Above command will clone all your repositories (except for forks) with
     full history. It's useful when you want to clone all your repositories.
 
+  $ github-clone-all -code -matched-only 'filename:.golangci.yml gofmt'
+
+    Above command will search code instead of repositories and clone each
+    repository containing '.golangci.yml' files which mention 'gofmt'. Only
+    the matched files remain in cloned repositories.
+
+  $ github-clone-all -filter 'size<50000 && !archived' 'language:go stars:>100'
+
+    Above command will clone popular Go repositories except for archived
+    ones and ones whose size is larger than 50MB. Fields available in the
+    expression are:
+
+      Numbers: size (in KB), stars, forks, open_issues, watchers
+      Ages:    pushed_age, created_age, updated_age (e.g. pushed_age<90d)
+      Strings: name, owner, full_name, language, license, description
+               (==, !=, in [a, b], =~ regexp, !~ regexp)
+      Bools:   archived, fork, private, has_wiki, has_issues, has_pages
+      Lists:   topics (e.g. topics has cli)
+
+FLAGS:`
+
+type queriesFlag []string
+
+func (qs *queriesFlag) String() string {
+	return strings.Join(*qs, ", ")
+}
+
+func (qs *queriesFlag) Set(q string) error {
+	*qs = append(*qs, q)
+	return nil
+}
+
+const runUsageHeader = `USAGE: github-clone-all run [FLAGS] {job file}
+
+  Run github-clone-all as described in the job file. The job file is written
+  in YAML (.yml, .yaml) or TOML (.toml) and describes the same options as
+  flags. Flags given in command line override values in the job file.
+
+  Example of job file in YAML:
+
+    queries:
+      - language:vim fork:false stars:>1
+      - filename:.vimrc
+    repos:
+      - rhysd/clever-f.vim
+    token_env: GITHUB_TOKEN
+    dest: ./repos
+    extract: '(\.vim|vimrc)$'
+    filter: size<50000 && !archived
+    concurrency: 4
+    retries: 2
+
+  Available keys are queries, repos, code, matched_only, token, token_env,
+  dest, extract, filter, sort, order, count, dry, deep, ssh, quiet,
+  concurrency, retries, format, layout, prune, quarantine, max_repo_size,
+  disk_budget, bare, mirror, with_wiki, with_issues, submodules, lfs, ref,
+  depth, shallow_since, backend, ssh_known_hosts, ssh_identity,
+  insecure_ssh, tokens_env, app_id, app_installation_id, app_private_key,
+  verbose, proxy, ca_bundle, api_timeout, clone_timeout, stall_timeout,
+  http_cache, record and replay.
+
 FLAGS:`
 
 func usage() {
@@ -109,24 +212,493 @@ func selfUpdate() int {
 	return 0
 }
 
+type options struct {
+	help        *bool
+	h           *bool
+	token       *string
+	dest        *string
+	extract     *string
+	quiet       *bool
+	count       *int
+	dry         *bool
+	deep        *bool
+	ssh         *bool
+	code        *bool
+	matchedOnly *bool
+	filter      *string
+	sort        *string
+	order       *string
+	queries     queriesFlag
+	queryFile   *string
+	concurrency *int
+	retries     *int
+	format      *string
+	layout      *string
+	prune       *bool
+	quarantine  *string
+	maxRepoSize *string
+	diskBudget  *string
+	bare        *bool
+	mirror      *bool
+	withWiki    *bool
+	withIssues  *bool
+	submodules  *bool
+	lfs         *string
+	ref         *string
+	depth       *int
+	since       *string
+	backend     *string
+	knownHosts  *string
+	identity    *string
+	insecureSSH *bool
+	tokensEnv   *string
+	appID       *int64
+	appInstall  *int64
+	appKey      *string
+	verbose     *bool
+	proxy       *string
+	caBundle    *string
+	apiTimeout  *string
+	cloneTime   *string
+	stallTime   *string
+	httpCache   *string
+	record      *string
+	replay      *string
+}
+
+func defineOptions(fs *flag.FlagSet) *options {
+	o := &options{
+		help:        fs.Bool("help", false, "Show this help"),
+		h:           fs.Bool("h", false, "Show this help"),
+		token:       fs.String("token", "", "GitHub token to call GitHub API. When not given, $GITHUB_TOKEN, $GH_TOKEN, hosts file of gh CLI and netrc are referred in order"),
+		dest:        fs.String("dest", "", "Directory to store the downloaded files. By default 'repos' in current working directory"),
+		extract:     fs.String("extract", "", "Regular expression to extract files by path relative to the root of each cloned repo"),
+		verbose:     fs.Bool("v", false, "Show verbose logs such as where GitHub token was read from"),
+		quiet:       fs.Bool("quiet", false, "Run quietly. When exit status is non-zero, it means error occurred"),
+		count:       fs.Int("count", 0, "Max number of repositories to clone"),
+		dry:         fs.Bool("dry", false, "Do dry run. Only shows which repositories will be cloned by given query with repositorie's descriptions"),
+		deep:        fs.Bool("deep", false, "Do not use shallow clone"),
+		ssh:         fs.Bool("ssh", false, "Use git@github.com/... URL instead of https://github.com/... URL"),
+		code:        fs.Bool("code", false, "Search code instead of repositories and clone each repository containing matched files once"),
+		matchedOnly: fs.Bool("matched-only", false, "Only leave files matched by code search in cloned repositories. Only available with -code"),
+		filter:      fs.String("filter", "", "Expression to filter repositories by their metadata before cloning. e.g. 'size<50000 && !archived && license in [mit, apache-2.0]'"),
+		sort:        fs.String("sort", "", "Sort search results by 'stars', 'forks', 'updated' or 'help-wanted-issues' ('indexed' for -code). By default results are sorted by best match"),
+		order:       fs.String("order", "", "Order of sorted search results. 'asc' or 'desc' (default 'desc'). Only available with -sort"),
+		queryFile:   fs.String("query-file", "", "File containing queries to search, one query per line. Empty lines and lines starting with '#' are ignored"),
+		concurrency: fs.Int("concurrency", 0, "Number of workers to clone repositories. By default it is decided from the number of CPUs"),
+		retries:     fs.Int("retries", 0, "How many times cloning a repository is retried on failure"),
+		format:      fs.String("format", "text", "Format of dry-run output. 'text', 'table' or 'json'"),
+		prune:       fs.Bool("prune", false, "Prune repositories in 'dest' which are no longer in search results after cloning. With -dry, only shows them"),
+		quarantine:  fs.String("quarantine", "", "Directory to move pruned repositories into instead of removing them"),
+		maxRepoSize: fs.String("max-repo-size", "", "Skip repositories larger than the size such as '500MB'. Cloning a repository growing past it is aborted"),
+		diskBudget:  fs.String("disk-budget", "", "Stop cloning when 'dest' uses more than the size such as '50GB' or free space of the disk is less than 'free:SIZE' such as 'free:10GB'. Both can be combined with ','"),
+		bare:        fs.Bool("bare", false, "Clone bare repositories with all branches and tags into 'owner/name.git' directories"),
+		mirror:      fs.Bool("mirror", false, "Clone mirror repositories with all refs into 'owner/name.git' directories for backup"),
+		withWiki:    fs.Bool("with-wiki", false, "Also clone wiki of each repository which has it into its sidecar directory '.{name}.meta'"),
+		withIssues:  fs.Bool("with-issues", false, "Also export issues, pull requests and their comments of each repository as JSON into its sidecar directory '.{name}.meta'"),
+		submodules:  fs.Bool("submodules", false, "Clone submodules recursively. They are cloned shallowly unless -deep is given"),
+		lfs:         fs.String("lfs", "skip", "How to handle Git LFS objects. 'skip' leaves pointer files and 'fetch' downloads objects"),
+		ref:         fs.String("ref", "", "Branch or tag to clone instead of the default branch. ':latest-release' clones the tag of the latest release and ':all' clones all branches. Default branch is cloned when the ref is missing"),
+		depth:       fs.Int("depth", 0, "Number of commits to fetch on shallow clone. By default only the latest commit is fetched"),
+		since:       fs.String("shallow-since", "", "Fetch history after the date on shallow clone. Date such as '2020-01-02' or age such as '1y' or '90d'"),
+		backend:     fs.String("backend", "exec", "Backend to clone repositories. 'exec' runs git command, 'go-git' clones with pure Go implementation without git command and 'archive' downloads tarballs without history"),
+		knownHosts:  fs.String("ssh-known-hosts", "", "known_hosts file to verify host keys on cloning via SSH instead of the default one. Unknown hosts are rejected"),
+		identity:    fs.String("ssh-identity", "", "Private key file to authenticate on cloning via SSH instead of keys in SSH config or agent"),
+		insecureSSH: fs.Bool("insecure-ssh", false, "Do not verify host keys on cloning via SSH. This is insecure and should only be used for testing"),
+		tokensEnv:   fs.String("tokens-env", "", "Comma-separated names of environment variables which have additional GitHub tokens. Requests rotate through all tokens to avoid rate limit"),
+		appID:       fs.Int64("app-id", 0, "ID of GitHub App to call GitHub API with its installation tokens. -app-installation-id and -app-private-key are also required"),
+		appInstall:  fs.Int64("app-installation-id", 0, "ID of installation of GitHub App given by -app-id"),
+		appKey:      fs.String("app-private-key", "", "Private key file of GitHub App given by -app-id"),
+		proxy:       fs.String("proxy", "", "URL of HTTP proxy to access GitHub API and clone repositories. By default $HTTPS_PROXY and other proxy environment variables are respected"),
+		caBundle:    fs.String("ca-bundle", "", "PEM file of CA certificates trusted in addition to system's ones on accessing GitHub API and cloning repositories"),
+		apiTimeout:  fs.String("api-timeout", "", "Timeout of connecting to GitHub API and waiting for response of each request such as '30s'"),
+		cloneTime:   fs.String("clone-timeout", "", "Timeout of cloning or updating one repository such as '10m'. Git is aborted when the timeout is exceeded"),
+		stallTime:   fs.String("stall-timeout", "", "Abort cloning or updating one repository when no progress is made for the duration such as '60s'"),
+		httpCache:   fs.String("http-cache", "", "Directory to cache responses of GitHub API. Cached responses are revalidated and do not consume rate limit when not modified"),
+		record:      fs.String("record", "", "Directory to record responses of GitHub API into. They can be replayed with -replay"),
+		replay:      fs.String("replay", "", "Directory of GitHub API responses recorded with -record. They are used instead of calling GitHub API to reproduce the past run"),
+		layout:      fs.String("layout", ghca.DefaultLayout, "Template of directory path to clone each repository into. Placeholders are {owner}, {name}, {id}, {language}, {license}, {default_branch}, {stars_bucket} and {sha}"),
+	}
+	fs.Var(&o.queries, "q", "Query to search. Can be specified multiple times. Results of all queries are merged and deduplicated")
+	return o
+}
+
+// readQueries collects queries from positional arguments, -q flags and -query-file.
+func (o *options) readQueries(args []string) ([]string, error) {
+	qs := []string(o.queries)
+	if q := strings.Join(args, " "); strings.TrimSpace(q) != "" {
+		qs = append([]string{q}, qs...)
+	}
+	if *o.queryFile != "" {
+		fqs, err := ghca.ReadQueryFile(*o.queryFile)
+		if err != nil {
+			return nil, err
+		}
+		qs = append(qs, fqs...)
+	}
+	return qs, nil
+}
+
+// applyTo sets values of flags to the job. 'visit' is Visit of the flag set to apply only flags given
+// in command line or VisitAll to apply all flags. Queries are not set.
+func (o *options) applyTo(job *ghca.Job, visit func(func(*flag.Flag))) {
+	visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "token":
+			job.Token = *o.token
+			job.TokenEnv = ""
+		case "dest":
+			job.Dest = *o.dest
+		case "extract":
+			job.Extract = *o.extract
+		case "quiet":
+			job.Quiet = *o.quiet
+		case "count":
+			job.Count = *o.count
+		case "dry":
+			job.Dry = *o.dry
+		case "deep":
+			job.Deep = *o.deep
+		case "ssh":
+			job.SSH = *o.ssh
+		case "code":
+			job.Code = *o.code
+		case "matched-only":
+			job.MatchedOnly = *o.matchedOnly
+		case "filter":
+			job.Filter = *o.filter
+		case "sort":
+			job.Sort = *o.sort
+		case "order":
+			job.Order = *o.order
+		case "concurrency":
+			job.Concurrency = *o.concurrency
+		case "retries":
+			job.Retries = *o.retries
+		case "format":
+			job.Format = *o.format
+		case "layout":
+			job.Layout = *o.layout
+		case "prune":
+			job.Prune = *o.prune
+		case "quarantine":
+			job.Quarantine = *o.quarantine
+		case "max-repo-size":
+			job.MaxRepoSize = *o.maxRepoSize
+		case "disk-budget":
+			job.DiskBudget = *o.diskBudget
+		case "bare":
+			job.Bare = *o.bare
+		case "mirror":
+			job.Mirror = *o.mirror
+		case "with-wiki":
+			job.WithWiki = *o.withWiki
+		case "with-issues":
+			job.WithIssues = *o.withIssues
+		case "submodules":
+			job.Submodules = *o.submodules
+		case "lfs":
+			job.LFS = *o.lfs
+		case "ref":
+			job.Ref = *o.ref
+		case "depth":
+			job.Depth = *o.depth
+		case "shallow-since":
+			job.ShallowSince = *o.since
+		case "backend":
+			job.Backend = *o.backend
+		case "ssh-known-hosts":
+			job.SSHKnownHosts = *o.knownHosts
+		case "ssh-identity":
+			job.SSHIdentity = *o.identity
+		case "insecure-ssh":
+			job.InsecureSSH = *o.insecureSSH
+		case "tokens-env":
+			job.TokensEnv = nil
+			for _, e := range strings.Split(*o.tokensEnv, ",") {
+				if e = strings.TrimSpace(e); e != "" {
+					job.TokensEnv = append(job.TokensEnv, e)
+				}
+			}
+		case "app-id":
+			job.AppID = *o.appID
+		case "app-installation-id":
+			job.AppInstallationID = *o.appInstall
+		case "app-private-key":
+			job.AppPrivateKey = *o.appKey
+		case "v":
+			job.Verbose = *o.verbose
+		case "proxy":
+			job.Proxy = *o.proxy
+		case "ca-bundle":
+			job.CABundle = *o.caBundle
+		case "api-timeout":
+			job.APITimeout = *o.apiTimeout
+		case "clone-timeout":
+			job.CloneTimeout = *o.cloneTime
+		case "stall-timeout":
+			job.StallTimeout = *o.stallTime
+		case "http-cache":
+			job.HTTPCache = *o.httpCache
+		case "record":
+			job.Record = *o.record
+		case "replay":
+			job.Replay = *o.replay
+		}
+	})
+}
+
+func exitError(err error) int {
+	fmt.Fprintln(os.Stderr, err)
+	return 3
+}
+
+func runJob(args []string) int {
+	fs := flag.NewFlagSet("run", flag.ExitOnError)
+	o := defineOptions(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, runUsageHeader)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *o.help || *o.h {
+		fs.Usage()
+		return 0
+	}
+
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Exactly one job file must be given to 'run'. Please see 'github-clone-all run -help'")
+		return 3
+	}
+
+	job, err := ghca.ReadJob(fs.Arg(0))
+	if err != nil {
+		return exitError(err)
+	}
+	o.applyTo(job, fs.Visit)
+	if len(o.queries) > 0 || *o.queryFile != "" {
+		if job.Queries, err = o.readQueries(nil); err != nil {
+			return exitError(err)
+		}
+	}
+	if err := job.Validate(); err != nil {
+		return exitError(err)
+	}
+
+	if job.Quiet {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	cli, err := job.CLI()
+	if err != nil {
+		return exitError(err)
+	}
+	if err := cli.Run(); err != nil {
+		return exitError(err)
+	}
+	return 0
+}
+
+var queryCommandHeaders = map[string]string{
+	"search": `USAGE: github-clone-all search [FLAGS] {query}
+
+  Search repositories matching to the query and show them without cloning.
+  By default they are shown in a table with stars and languages. -format
+  can change the output format ('text', 'table' or 'json').`,
+	"clone": `USAGE: github-clone-all clone [FLAGS] {query}
+
+  Search repositories matching to the query and clone them into 'dest'
+  directory. Cloned repositories are recorded in the manifest file in 'dest'
+  directory.`,
+	"update": `USAGE: github-clone-all update [FLAGS] [{query}]
+
+  Update repositories in 'dest' directory. When no query is given,
+  repositories recorded in the manifest of 'dest' directory are updated.
+  When a query is given, repositories matching to it are updated and ones
+  not existing in 'dest' yet are newly cloned. Repositories whose files were
+  extracted with -extract are cloned again. Renamed or transferred
+  repositories are moved to their new directories.`,
+	"prune": `USAGE: github-clone-all prune [FLAGS] {query}
+
+  Search repositories matching to the query and remove repositories in
+  'dest' directory which are not included in the results. With -quarantine,
+  they are moved to the directory instead of being removed. With -dry, they
+  are only shown.`,
+}
+
+// runQueryCommand runs subcommands which search repositories with queries.
+func runQueryCommand(name string, args []string) int {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	o := defineOptions(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, queryCommandHeaders[name])
+		fmt.Fprintln(os.Stderr, "\nFLAGS:")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *o.help || *o.h {
+		fs.Usage()
+		return 0
+	}
+
+	return runQuery(name, fs, o)
+}
+
+// runQuery runs the subcommand with parsed flags.
+func runQuery(name string, fs *flag.FlagSet, o *options) int {
+	if *o.quiet {
+		log.SetOutput(ioutil.Discard)
+	}
+
+	job := &ghca.Job{}
+	o.applyTo(job, fs.VisitAll)
+	qs, err := o.readQueries(fs.Args())
+	if err != nil {
+		return exitError(err)
+	}
+	job.Queries = qs
+
+	if name == "search" {
+		job.Dry = true
+		visited := false
+		fs.Visit(func(f *flag.Flag) { visited = visited || f.Name == "format" })
+		if !visited {
+			job.Format = "table"
+		}
+	}
+
+	if name != "update" && len(job.Queries) == 0 {
+		return exitError(fmt.Errorf("Query cannot be empty. Please see 'github-clone-all %s -help'", name))
+	}
+
+	cli, err := job.CLI()
+	if err != nil {
+		return exitError(err)
+	}
+
+	switch name {
+	case "update":
+		err = cli.Update()
+	case "prune":
+		var removed []string
+		removed, err = cli.Prune()
+		if err == nil {
+			label := "pruned:"
+			if job.Dry {
+				label = "would prune:"
+			} else if job.Quarantine != "" {
+				label = "quarantined:"
+			}
+			for _, r := range removed {
+				fmt.Println(label, r)
+			}
+		}
+	default:
+		err = cli.Run()
+	}
+	if err != nil {
+		return exitError(err)
+	}
+	return 0
+}
+
+const statusUsageHeader = `USAGE: github-clone-all status [FLAGS]
+
+  Report state of repositories in 'dest' directory compared with its
+  manifest. Each line shows a state and a repository. States are 'ok'
+  (recorded and existing), 'missing' (recorded but not existing) and
+  'untracked' (existing but not recorded).
+
+FLAGS:`
+
+func runStatus(args []string) int {
+	fs := flag.NewFlagSet("status", flag.ExitOnError)
+	dest := fs.String("dest", "", "Directory where repositories were cloned. By default 'repos' in current working directory")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, statusUsageHeader)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	d, err := ghca.ResolveDest(*dest)
+	if err != nil {
+		return exitError(err)
+	}
+	ss, err := ghca.Status(d)
+	if err != nil {
+		return exitError(err)
+	}
+
+	counts := map[string]int{}
+	for _, s := range ss {
+		fmt.Printf("%-9s %s\n", s.State, s.Slug)
+		counts[s.State]++
+	}
+	fmt.Printf("\n%d ok, %d missing, %d untracked\n", counts[ghca.StatusOK], counts[ghca.StatusMissing], counts[ghca.StatusUntracked])
+	return 0
+}
+
+const exportUsageHeader = `USAGE: github-clone-all export [FLAGS]
+
+  Export repositories recorded in the manifest of 'dest' directory to stdout.
+
+FLAGS:`
+
+func runExport(args []string) int {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dest := fs.String("dest", "", "Directory where repositories were cloned. By default 'repos' in current working directory")
+	format := fs.String("format", "text", "Output format. 'text' (one repository per line), 'json' or 'csv'")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, exportUsageHeader)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	d, err := ghca.ResolveDest(*dest)
+	if err != nil {
+		return exitError(err)
+	}
+	m, err := ghca.LoadManifest(d)
+	if err != nil {
+		return exitError(err)
+	}
+	if err := m.Export(os.Stdout, *format); err != nil {
+		return exitError(err)
+	}
+	return 0
+}
+
 func main() {
-	help := flag.Bool("help", false, "Show this help")
-	h := flag.Bool("h", false, "Show this help")
-	token := flag.String("token", "", "GitHub token to call GitHub API. $GITHUB_TOKEN environment variable is also referred")
-	dest := flag.String("dest", "", "Directory to store the downloaded files. By default 'repos' in current working directory")
-	extract := flag.String("extract", "", "Regular expression to extract files by name in each cloned repo")
-	quiet := flag.Bool("quiet", false, "Run quietly. When exit status is non-zero, it means error occurred")
-	count := flag.Int("count", 0, "Max number of repositories to clone")
-	dry := flag.Bool("dry", false, "Do dry run. Only shows which repositories will be cloned by given query with repositorie's descriptions")
-	deep := flag.Bool("deep", false, "Do not use shallow clone")
-	ssh := flag.Bool("ssh", false, "Use git@github.com/... URL instead of https://github.com/... URL")
-	ver := flag.Bool("version", false, "Show version")
-	update := flag.Bool("selfupdate", false, "Update this tool to the latest")
+	// Query after '--' such as 'github-clone-all -- update' is not regarded as a subcommand. '--' is
+	// consumed on parsing flags
+	if len(os.Args) > 1 {
+		switch cmd, args := os.Args[1], os.Args[2:]; cmd {
+		case "search", "clone", "update", "prune":
+			os.Exit(runQueryCommand(cmd, args))
+		case "status":
+			os.Exit(runStatus(args))
+		case "export":
+			os.Exit(runExport(args))
+		case "run":
+			os.Exit(runJob(args))
+		case "version":
+			fmt.Println(version)
+			os.Exit(0)
+		case "selfupdate":
+			os.Exit(selfUpdate())
+		}
+	}
+
+	o := defineOptions(flag.CommandLine)
+	ver := flag.Bool("version", false, "Show version. Same as 'version' subcommand")
+	update := flag.Bool("selfupdate", false, "Update this tool to the latest. Same as 'selfupdate' subcommand")
 
 	flag.Usage = usage
 	flag.Parse()
 
-	if *help || *h {
+	if *o.help || *o.h {
 		usage()
 		os.Exit(0)
 	}
@@ -140,19 +712,5 @@ func main() {
 		os.Exit(selfUpdate())
 	}
 
-	if *quiet {
-		log.SetOutput(ioutil.Discard)
-	}
-
-	query := strings.Join(flag.Args(), " ")
-
-	cli, err := ghca.NewCLI(*token, query, *dest, *extract, *count, *dry, *deep, *ssh)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(3)
-	}
-	if err = cli.Run(); err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(3)
-	}
+	os.Exit(runQuery("clone", flag.CommandLine, o))
 }